@@ -0,0 +1,153 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/pkg/errors"
+)
+
+// IAcknowledger lets callbacks acknowledge the message being processed themselves, instead of relying on the
+// consumer to delete the message once the callback returns successfully
+type IAcknowledger interface {
+	// Ack deletes the message from the queue. The consumer won't retry the message, even if the callback fails.
+	Ack(ctx context.Context) error
+
+	// Nack makes the message visible again after the given delay, so it's retried
+	Nack(ctx context.Context, delay time.Duration) error
+
+	// ExtendVisibility sets the visibility timeout of the message to the given duration, counting from now
+	ExtendVisibility(ctx context.Context, timeout time.Duration) error
+
+	// HandOff takes over acknowledging the message from the consumer, so it's neither deleted nor retried by the
+	// consumer once the callback returns. Ack or Nack must be called later, e.g. from a background goroutine, before
+	// the visibility timeout expires. Messages that are nacked or handed off aren't marked as processed by the
+	// idempotency store, and messages published with DeferredPublisher are dropped.
+	HandOff()
+}
+
+type contextKey int
+
+const (
+	acknowledgerKey contextKey = iota
+	messageKey
+	deferredPublisherKey
+	pollTrackerKey
+	panicRecoveryKey
+)
+
+// Acknowledger returns the acknowledgement handle for the message being processed by a callback, or nil if the
+// message wasn't received from an SQS queue
+func Acknowledger(ctx context.Context) IAcknowledger {
+	if ack, ok := ctx.Value(acknowledgerKey).(*sqsAcknowledger); ok {
+		return ack
+	}
+	return nil
+}
+
+type ackState int
+
+const (
+	ackPending ackState = iota
+	ackAcked
+	ackNacked
+)
+
+type sqsAcknowledger struct {
+	lock          sync.Mutex
+	sqs           sqsiface.SQSAPI
+	queueURL      *string
+	receiptHandle *string
+	state         ackState
+	handedOff     bool
+}
+
+func newSQSAcknowledger(sqsClient sqsiface.SQSAPI, queueURL *string, queueMessage *sqs.Message) *sqsAcknowledger {
+	return &sqsAcknowledger{
+		sqs:           sqsClient,
+		queueURL:      queueURL,
+		receiptHandle: queueMessage.ReceiptHandle,
+	}
+}
+
+func (a *sqsAcknowledger) withContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, acknowledgerKey, a)
+}
+
+func (a *sqsAcknowledger) Ack(ctx context.Context) error {
+	_, err := a.sqs.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      a.queueURL,
+		ReceiptHandle: a.receiptHandle,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to ack message")
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.state = ackAcked
+	return nil
+}
+
+func (a *sqsAcknowledger) Nack(ctx context.Context, delay time.Duration) error {
+	if err := a.changeVisibility(ctx, delay); err != nil {
+		return errors.Wrap(err, "failed to nack message")
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.state = ackNacked
+	return nil
+}
+
+func (a *sqsAcknowledger) ExtendVisibility(ctx context.Context, timeout time.Duration) error {
+	return errors.Wrap(a.changeVisibility(ctx, timeout), "failed to extend message visibility")
+}
+
+func (a *sqsAcknowledger) changeVisibility(ctx context.Context, timeout time.Duration) error {
+	if timeout > maxVisibilityTimeout {
+		timeout = maxVisibilityTimeout
+	}
+	_, err := a.sqs.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          a.queueURL,
+		ReceiptHandle:     a.receiptHandle,
+		VisibilityTimeout: aws.Int64(int64(timeout / time.Second)),
+	})
+	return err
+}
+
+func (a *sqsAcknowledger) HandOff() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.handedOff = true
+}
+
+// status returns whether the message was acknowledged by the callback, and whether it was handed off
+func (a *sqsAcknowledger) status() (ackState, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.state, a.handedOff
+}
+
+// errNotDone is used to release the idempotency lease of a message that was nacked or handed off by its callback
+var errNotDone = errors.New("message was nacked or handed off by the callback")
+
+// notDone returns true if the callback the context was passed to nacked the message or handed it off, so processing
+// the message isn't done once the callback returns
+func notDone(ctx context.Context) bool {
+	ack, ok := Acknowledger(ctx).(*sqsAcknowledger)
+	if !ok {
+		return false
+	}
+	state, handedOff := ack.status()
+	return handedOff || state == ackNacked
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const testQueueURL = "https://sqs.us-east-1.amazonaws.com/686176732873/HEDWIG-DEV-MYAPP"
+
+func newTestAcknowledger(fakeSqs *FakeSQS) *sqsAcknowledger {
+	return newSQSAcknowledger(fakeSqs, aws.String(testQueueURL), &sqs.Message{
+		MessageId:     aws.String("123"),
+		ReceiptHandle: aws.String("receipt"),
+	})
+}
+
+func TestAcknowledger(t *testing.T) {
+	ctx := context.Background()
+	assert.Nil(t, Acknowledger(ctx))
+
+	ack := newTestAcknowledger(&FakeSQS{})
+	assert.Equal(t, ack, Acknowledger(ack.withContext(ctx)))
+}
+
+func TestSQSAcknowledger_Ack(t *testing.T) {
+	ctx := context.Background()
+	fakeSqs := &FakeSQS{}
+	ack := newTestAcknowledger(fakeSqs)
+
+	fakeSqs.On("DeleteMessageWithContext", ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(testQueueURL),
+		ReceiptHandle: aws.String("receipt"),
+	}, mock.Anything).Return(&sqs.DeleteMessageOutput{}, nil)
+
+	assert.NoError(t, ack.Ack(ctx))
+	state, handedOff := ack.status()
+	assert.Equal(t, ackAcked, state)
+	assert.False(t, handedOff)
+	fakeSqs.AssertExpectations(t)
+}
+
+func TestSQSAcknowledger_AckError(t *testing.T) {
+	ctx := context.Background()
+	fakeSqs := &FakeSQS{}
+	ack := newTestAcknowledger(fakeSqs)
+
+	fakeSqs.On("DeleteMessageWithContext", ctx, mock.Anything, mock.Anything).
+		Return((*sqs.DeleteMessageOutput)(nil), errors.New("no internet"))
+
+	assert.EqualError(t, ack.Ack(ctx), "failed to ack message: no internet")
+	state, _ := ack.status()
+	assert.Equal(t, ackPending, state)
+}
+
+func TestSQSAcknowledger_Nack(t *testing.T) {
+	ctx := context.Background()
+	fakeSqs := &FakeSQS{}
+	ack := newTestAcknowledger(fakeSqs)
+
+	fakeSqs.On("ChangeMessageVisibilityWithContext", ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(testQueueURL),
+		ReceiptHandle:     aws.String("receipt"),
+		VisibilityTimeout: aws.Int64(30),
+	}, mock.Anything).Return(&sqs.ChangeMessageVisibilityOutput{}, nil)
+
+	assert.NoError(t, ack.Nack(ctx, 30*time.Second))
+	state, _ := ack.status()
+	assert.Equal(t, ackNacked, state)
+	fakeSqs.AssertExpectations(t)
+}
+
+func TestSQSAcknowledger_ExtendVisibility(t *testing.T) {
+	ctx := context.Background()
+	fakeSqs := &FakeSQS{}
+	ack := newTestAcknowledger(fakeSqs)
+
+	fakeSqs.On("ChangeMessageVisibilityWithContext", ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(testQueueURL),
+		ReceiptHandle:     aws.String("receipt"),
+		VisibilityTimeout: aws.Int64(int64(maxVisibilityTimeout / time.Second)),
+	}, mock.Anything).Return(&sqs.ChangeMessageVisibilityOutput{}, nil)
+
+	assert.NoError(t, ack.ExtendVisibility(ctx, 24*time.Hour))
+	state, _ := ack.status()
+	assert.Equal(t, ackPending, state)
+	fakeSqs.AssertExpectations(t)
+}
+
+func TestSQSAcknowledger_HandOff(t *testing.T) {
+	ack := newTestAcknowledger(&FakeSQS{})
+	ack.HandOff()
+	state, handedOff := ack.status()
+	assert.Equal(t, ackPending, state)
+	assert.True(t, handedOff)
+}
+
+func TestAWSClient_messageHandlerAcknowledgementIdempotent(t *testing.T) {
+	for _, handOff := range []bool{false, true} {
+		ctx := context.Background()
+		fakeSqs := &FakeSQS{}
+		fakeSns := &FakeSns{}
+		settings := createTestSettings()
+		settings.IdempotencyStore = NewMemoryIdempotencyStore(10)
+		settings.MessageRouting = map[MessageRouteKey]string{
+			{MessageType: "vehicle_created", MessageMajorVersion: 1}: "dev-vehicle-created-v1",
+		}
+		calls := 0
+		settings.CallbackRegistry.RegisterCallback(
+			CallbackKey{MessageType: "vehicle_created", MessageMajorVersion: 1},
+			func(ctx context.Context, message *Message) error {
+				calls++
+				if err := DeferredPublisher(ctx).Publish(ctx, newTestCorrelationMessage(t, settings, nil)); err != nil {
+					return err
+				}
+				if handOff {
+					Acknowledger(ctx).HandOff()
+					return nil
+				}
+				return Acknowledger(ctx).Nack(ctx, time.Minute)
+			},
+			func() interface{} { return new(FakeHedwigDataField) })
+		fakeSqs.On("ChangeMessageVisibilityWithContext", mock.Anything, mock.Anything, mock.Anything).
+			Return(&sqs.ChangeMessageVisibilityOutput{}, nil)
+
+		messageJSON, err := newTestCorrelationMessage(t, settings, nil).JSONString()
+		assert.NoError(t, err)
+		awsClient := &awsClient{sns: fakeSns, sqs: fakeSqs}
+
+		// the message isn't marked as processed, so it's processed again when redelivered, and nothing is published
+		for i := 0; i < 2; i++ {
+			ack := newTestAcknowledger(fakeSqs)
+			err = awsClient.messageHandler(ack.withContext(ctx), settings, messageJSON,
+				&messageDelivery{receipt: "receipt", throttle: true}, nil)
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, 2, calls)
+		fakeSns.AssertNotCalled(t, "PublishWithContext", mock.Anything, mock.Anything)
+	}
+}
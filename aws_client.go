@@ -11,23 +11,30 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/sns"
 	"github.com/aws/aws-sdk-go/service/sns/snsiface"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 	"github.com/pkg/errors"
-	"golang.org/x/sync/errgroup"
 )
 
 // iAmazonWebServicesClient represents an interface to the AWS client
 type iAmazonWebServicesClient interface {
-	FetchAndProcessMessages(ctx context.Context, settings *Settings, numMessages uint32, visibilityTimeoutS uint32) error
+	FetchAndProcessMessages(ctx context.Context, settings *Settings, numMessages uint32, visibilityTimeoutS uint32,
+		state *consumerState) error
+	PollAndProcessMessages(ctx context.Context, settings *Settings, numMessages uint32, visibilityTimeoutS uint32,
+		waitTimeSeconds int64, state *consumerState) (int, error)
 	HandleLambdaEvent(ctx context.Context, settings *Settings, snsEvent events.SNSEvent) error
+	HandleLambdaSQSEvent(ctx context.Context, settings *Settings, sqsEvent events.SQSEvent) (*SQSEventResponse, error)
 	PublishSNS(ctx context.Context, settings *Settings, messageTopic string, payload string, headers map[string]string) error
 }
 
@@ -47,124 +54,508 @@ func getSNSTopic(settings *Settings, messageTopic string) string {
 type awsClient struct {
 	sns snsiface.SNSAPI
 	sqs sqsiface.SQSAPI
+
+	// default visibility timeouts of queues, by queue URL
+	visibilityTimeoutsLock sync.Mutex
+	visibilityTimeouts     map[string]time.Duration
 }
 
 func (a *awsClient) processSQSMessage(ctx context.Context, settings *Settings,
-	queueMessage *sqs.Message, queueURL *string, queueName string, wg *sync.WaitGroup) {
+	queueMessage *sqs.Message, queueURL *string, delivery *messageDelivery, wg *sync.WaitGroup) {
+
 	defer wg.Done()
+	start := time.Now()
+	ack := newSQSAcknowledger(a.sqs, queueURL, queueMessage)
+	outcome := a.handleSQSMessage(ctx, settings, queueMessage, queueURL, ack, delivery)
+	// messages acknowledged by the callback are already deleted
+	if state, _ := ack.status(); (outcome == OutcomeSuccess || outcome == OutcomeExpired) && state == ackPending {
+		_, err := a.sqs.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+			QueueUrl:      queueURL,
+			ReceiptHandle: queueMessage.ReceiptHandle,
+		})
+		if err != nil {
+			settings.GetLogger(ctx).Error(err, "Failed to delete message", LoggingFields{
+				"message_sqs_id": *queueMessage.MessageId,
+			})
+		}
+	}
+	reportMetrics(ctx, settings, outcome, start)
+}
+
+// handleSQSMessage processes an SQS message. Messages failing permanently are sent to the dead-letter queue, and the
+// visibility of messages to be retried is changed as per the retry policy. Successful and expired messages aren't
+// deleted. Messages acknowledged or handed off by the callback are left alone. The delivery is completed with the
+// details of the message, and its partition ticket is released once the message is handled.
+func (a *awsClient) handleSQSMessage(ctx context.Context, settings *Settings, queueMessage *sqs.Message,
+	queueURL *string, ack *sqsAcknowledger, delivery *messageDelivery) MessageOutcome {
+
+	defer delivery.partition.release()
+	defer delivery.poll.done()
+
 	loggingFields := LoggingFields{
 		"message_sqs_id": *queueMessage.MessageId,
 	}
+	// the message as received is dead-lettered, while the hook and the callback get the unwrapped message
+	unwrapped, envelope, err := unwrapSNSEnvelope(ctx, settings, queueMessage)
 	sqsRequest := &SQSRequest{
 		Context:      ctx,
-		QueueMessage: queueMessage,
+		QueueMessage: unwrapped,
 	}
-	if settings.PreProcessHookSQS != nil {
-		if err := settings.PreProcessHookSQS(sqsRequest); err != nil {
-			settings.GetLogger(ctx).Error(err, "Failed to execute pre process hook for message", loggingFields)
-			return
+	if err == nil {
+		if settings.PreProcessHookSQS != nil {
+			err := callWithRecover(ctx, settings, loggingFields, func() error {
+				return settings.PreProcessHookSQS(sqsRequest)
+			})
+			if err != nil {
+				settings.GetLogger(ctx).Error(err, "Failed to execute pre process hook for message", loggingFields)
+				return OutcomeFailure
+			}
 		}
-	}
 
-	err := a.messageHandlerSQS(settings, sqsRequest)
-	switch err {
-	case nil:
-		_, err := a.sqs.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
-			QueueUrl:      queueURL,
-			ReceiptHandle: queueMessage.ReceiptHandle,
+		// the pre process hook may have replaced the request context
+		callbackRequest := *sqsRequest
+		callbackRequest.Context = ack.withContext(sqsRequest.Context)
+		delivery.receipt = *queueMessage.ReceiptHandle
+		delivery.throttle = true
+		delivery.transport = sqsTransportMetadata(settings, unwrapped, envelope)
+		err = callWithRecover(ctx, settings, loggingFields, func() error {
+			return a.messageHandlerSQS(settings, &callbackRequest, delivery)
 		})
+	}
+
+	switch state, handedOff := ack.status(); {
+	case handedOff:
 		if err != nil {
-			settings.GetLogger(ctx).Error(err, "Failed to delete message", loggingFields)
+			settings.GetLogger(ctx).Error(err, "Callback failed after handing off message", loggingFields)
 		}
-	case ErrRetry:
+		return OutcomeHandedOff
+	case state == ackAcked:
+		if err != nil {
+			settings.GetLogger(ctx).Error(err, "Callback failed after acknowledging message", loggingFields)
+			return OutcomeFailure
+		}
+		return OutcomeSuccess
+	case state == ackNacked:
+		return OutcomeRetry
+	}
+
+	outcome := OutcomeFailure
+	switch {
+	case err == nil:
+		return OutcomeSuccess
+	case isExpiredError(err):
+		settings.GetLogger(ctx).Info("Skipping expired message", loggingFields)
+		if settings.ExpiryPolicy == ExpiryDeadLetter {
+			err = a.sendToDeadLetterQueue(ctx, settings, queueMessage.Body, err, receiveCount(queueMessage))
+			if err != nil {
+				settings.GetLogger(ctx).Error(err, "Failed to dead-letter expired message", loggingFields)
+				return OutcomeFailure
+			}
+		}
+		return OutcomeExpired
+	case isPermanentError(settings, err):
+		settings.GetLogger(ctx).Error(err, "Dead-lettering due to permanent failure", loggingFields)
+		if err := a.deadLetterSQSMessage(ctx, settings, queueMessage, queueURL, err); err != nil {
+			settings.GetLogger(ctx).Error(err, "Failed to dead-letter message", loggingFields)
+			return OutcomeFailure
+		}
+		return OutcomeDeadLettered
+	case isTimeoutError(err):
+		outcome = OutcomeTimeout
+		settings.GetLogger(ctx).Warn(err, "Retrying due to callback timeout", loggingFields)
+	case isThrottledError(err):
+		outcome = OutcomeThrottled
+		settings.GetLogger(ctx).Debug("Deferring message over callback limits", loggingFields)
+	case isRetryError(err):
+		outcome = OutcomeRetry
 		settings.GetLogger(ctx).Debug("Retrying due to exception", loggingFields)
 	default:
 		settings.GetLogger(ctx).Error(err, "Retrying due to unknown exception", loggingFields)
 	}
+
+	if delay, ok := retryDelay(settings, queueMessage, err); ok {
+		if err := a.changeMessageVisibility(ctx, queueURL, queueMessage.ReceiptHandle, delay); err != nil {
+			settings.GetLogger(ctx).Error(err, "Failed to change message visibility", loggingFields)
+		}
+	}
+	return outcome
+}
+
+func (a *awsClient) changeMessageVisibility(ctx context.Context, queueURL *string, receiptHandle *string,
+	visibilityTimeout time.Duration) error {
+
+	_, err := a.sqs.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          queueURL,
+		ReceiptHandle:     receiptHandle,
+		VisibilityTimeout: aws.Int64(int64(visibilityTimeout / time.Second)),
+	})
+	return err
+}
+
+// sendToDeadLetterQueue sends a message body to the dead-letter queue, along with the failure reason
+func (a *awsClient) sendToDeadLetterQueue(ctx context.Context, settings *Settings, body *string, reason error,
+	receiveCount int) error {
+
+	dlqURL, err := a.getSQSQueueURL(ctx, getSQSDeadLetterQueueName(settings))
+	if err != nil {
+		return errors.Wrap(err, "failed to get SQS dead-letter queue URL")
+	}
+	_, err = a.sqs.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:          dlqURL,
+		MessageBody:       body,
+		MessageAttributes: deadLetterAttributes(reason, receiveCount),
+	})
+	return errors.Wrap(err, "failed to send message to dead-letter queue")
+}
+
+// deadLetterSQSMessage sends a message that failed permanently to the dead-letter queue, and deletes it from the
+// original queue
+func (a *awsClient) deadLetterSQSMessage(ctx context.Context, settings *Settings, queueMessage *sqs.Message,
+	queueURL *string, reason error) error {
+
+	err := a.sendToDeadLetterQueue(ctx, settings, queueMessage.Body, reason, receiveCount(queueMessage))
+	if err != nil {
+		return err
+	}
+	_, err = a.sqs.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      queueURL,
+		ReceiptHandle: queueMessage.ReceiptHandle,
+	})
+	return errors.Wrap(err, "failed to delete message")
 }
 
 func (a *awsClient) FetchAndProcessMessages(ctx context.Context,
-	settings *Settings, numMessages uint32, visibilityTimeoutS uint32) error {
+	settings *Settings, numMessages uint32, visibilityTimeoutS uint32, state *consumerState) error {
+
+	_, err := a.PollAndProcessMessages(ctx, settings, numMessages, visibilityTimeoutS, sqsWaitTimeoutSeconds, state)
+	return err
+}
+
+// PollAndProcessMessages works like FetchAndProcessMessages, but with a custom long poll duration (0 for a short
+// poll), and returns the number of messages received
+func (a *awsClient) PollAndProcessMessages(ctx context.Context, settings *Settings, numMessages uint32,
+	visibilityTimeoutS uint32, waitTimeSeconds int64, state *consumerState) (int, error) {
 
 	queueName := getSQSQueueName(settings)
 	queueURL, err := a.getSQSQueueURL(ctx, queueName)
 	if err != nil {
-		return errors.Wrap(err, "failed to get SQS Queue URL")
+		return 0, errors.Wrap(err, "failed to get SQS Queue URL")
 	}
 
 	input := &sqs.ReceiveMessageInput{
-		MaxNumberOfMessages: aws.Int64(int64(numMessages)),
-		QueueUrl:            queueURL,
-		WaitTimeSeconds:     aws.Int64(sqsWaitTimeoutSeconds),
+		AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+		MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+		MaxNumberOfMessages:   aws.Int64(int64(numMessages)),
+		QueueUrl:              queueURL,
+		WaitTimeSeconds:       aws.Int64(waitTimeSeconds),
 	}
+	visibilityTimeout := time.Duration(visibilityTimeoutS) * time.Second
 	if visibilityTimeoutS != 0 {
 		input.VisibilityTimeout = aws.Int64(int64(visibilityTimeoutS))
+	} else {
+		// callbacks must still finish before messages become visible again
+		visibilityTimeout = a.queueVisibilityTimeout(ctx, settings, queueURL)
+	}
+
+	receiveCtx := ctx
+	if state != nil {
+		// stop polling right away on shutdown, without canceling in-flight messages
+		var cancel context.CancelFunc
+		receiveCtx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-state.stopPolling:
+				cancel()
+			case <-receiveCtx.Done():
+			}
+		}()
 	}
 
 	wg := sync.WaitGroup{}
-	out, err := a.sqs.ReceiveMessageWithContext(ctx, input)
+	out, err := a.sqs.ReceiveMessageWithContext(receiveCtx, input)
 	if err != nil {
-		return errors.Wrap(err, "failed to receive SQS message")
+		if state != nil && state.stopped() && ctx.Err() == nil {
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, "failed to receive SQS message")
+	}
+	var sequencer *partitionSequencer
+	if settings.PartitionKey != nil {
+		sequencer = newPartitionSequencer(len(out.Messages))
 	}
+	received := time.Now()
+	poll := newPollTracker(len(out.Messages))
 	for i := range out.Messages {
+		partition := sequencer.ticket(i)
 		select {
 		case <-ctx.Done():
-			// Do nothing
+			partition.release()
+			poll.done()
 		default:
 			wg.Add(1)
-			go a.processSQSMessage(ctx, settings, out.Messages[i], queueURL, queueName, &wg)
+			queueMessage := out.Messages[i]
+			if state != nil {
+				state.track(*queueMessage.MessageId)
+			}
+			go func() {
+				if state != nil {
+					defer state.untrack(*queueMessage.MessageId)
+				}
+				delivery := &messageDelivery{
+					visibilityTimeout: visibilityTimeout,
+					received:          received,
+					partition:         partition,
+					poll:              poll,
+				}
+				a.processSQSMessage(ctx, settings, queueMessage, queueURL, delivery, &wg)
+			}()
 		}
 	}
-	wg.Wait()
+	if err := state.wait(&wg); err != nil {
+		return len(out.Messages), err
+	}
 	// if context was canceled, signal appropriately
-	return ctx.Err()
+	return len(out.Messages), ctx.Err()
 }
 
-func (a *awsClient) processSNSRecord(ctx context.Context, settings *Settings, request *LambdaRequest) error {
+func (a *awsClient) processSNSRecord(ctx context.Context, settings *Settings,
+	request *LambdaRequest) *LambdaRecordOutcome {
+
 	loggingFields := LoggingFields{
 		"message_sns_id": request.EventRecord.SNS.MessageID,
 	}
+	record := &LambdaRecordOutcome{
+		SNSMessageID: request.EventRecord.SNS.MessageID,
+		Outcome:      OutcomeFailure,
+	}
 
 	if settings.PreProcessHookLambda != nil {
-		if err := settings.PreProcessHookLambda(request); err != nil {
+		err := callWithRecover(ctx, settings, loggingFields, func() error {
+			return settings.PreProcessHookLambda(request)
+		})
+		if err != nil {
 			settings.GetLogger(ctx).Error(
 				err, "failed to execute pre process hook for lambda event", loggingFields)
-			return errors.Wrapf(err, "failed to execute pre process hook")
+			record.Err = errors.Wrapf(err, "failed to execute pre process hook")
+			return a.applyLambdaFailurePolicy(ctx, settings, request, record, loggingFields)
 		}
 	}
 
-	err := a.messageHandlerLambda(settings, request)
-	if err != nil {
-		settings.GetLogger(ctx).Error(err, "failed to process lambda event", loggingFields)
-		return err
+	record.Err = callWithRecover(ctx, settings, loggingFields, func() error {
+		return a.messageHandlerLambda(settings, request)
+	})
+	switch {
+	case record.Err == nil:
+		record.Outcome = OutcomeSuccess
+		return record
+	case isExpiredError(record.Err):
+		settings.GetLogger(ctx).Info("Skipping expired lambda event", loggingFields)
+		if settings.ExpiryPolicy == ExpiryDeadLetter {
+			if err := a.deadLetterSNSRecord(ctx, settings, request.EventRecord, record.Err); err != nil {
+				settings.GetLogger(ctx).Error(err, "Failed to dead-letter expired lambda event", loggingFields)
+				return record
+			}
+		}
+		record.Outcome = OutcomeExpired
+		return record
+	case isPermanentError(settings, record.Err):
+		// dead-lettered regardless of the failure policy, since retrying can't help
+		settings.GetLogger(ctx).Error(record.Err, "Dead-lettering lambda event due to permanent failure", loggingFields)
+		if err := a.deadLetterSNSRecord(ctx, settings, request.EventRecord, record.Err); err != nil {
+			settings.GetLogger(ctx).Error(err, "Failed to dead-letter lambda event", loggingFields)
+			return record
+		}
+		record.Outcome = OutcomeDeadLettered
+		return record
+	case isTimeoutError(record.Err):
+		// retried regardless of the failure policy
+		record.Outcome = OutcomeTimeout
+		settings.GetLogger(ctx).Warn(record.Err, "failed to process lambda event due to callback timeout", loggingFields)
+		return record
+	case isRetryError(record.Err):
+		// retried regardless of the failure policy
+		record.Outcome = OutcomeRetry
+		settings.GetLogger(ctx).Debug("Retrying lambda event", loggingFields)
+		return record
+	default:
+		settings.GetLogger(ctx).Error(record.Err, "failed to process lambda event", loggingFields)
+	}
+	return a.applyLambdaFailurePolicy(ctx, settings, request, record, loggingFields)
+}
+
+// applyLambdaFailurePolicy handles a failed record as per settings.LambdaFailurePolicy
+func (a *awsClient) applyLambdaFailurePolicy(ctx context.Context, settings *Settings, request *LambdaRequest,
+	record *LambdaRecordOutcome, loggingFields LoggingFields) *LambdaRecordOutcome {
+
+	switch settings.LambdaFailurePolicy {
+	case LambdaDeadLetter:
+		if err := a.deadLetterSNSRecord(ctx, settings, request.EventRecord, record.Err); err != nil {
+			settings.GetLogger(ctx).Error(err, "Failed to dead-letter lambda event", loggingFields)
+			return record
+		}
+		record.Outcome = OutcomeDeadLettered
+	case LambdaIgnore:
+		settings.GetLogger(ctx).Info("Ignoring failed lambda event", loggingFields)
+		record.Outcome = OutcomeIgnored
+	}
+	return record
+}
+
+// deadLetterSNSRecord sends an SNS record that failed processing to the dead-letter queue. Lambda consumers don't
+// have a queue to derive the dead-letter queue name from, so it must be set explicitly. SNS doesn't count deliveries,
+// so the receive count isn't recorded.
+func (a *awsClient) deadLetterSNSRecord(ctx context.Context, settings *Settings, eventRecord *events.SNSEventRecord,
+	reason error) error {
+
+	if settings.DeadLetterQueueName == "" {
+		return errLambdaDeadLetterQueueName
 	}
-	return nil
+	return a.sendToDeadLetterQueue(ctx, settings, aws.String(eventRecord.SNS.Message), reason, 0)
 }
 
 func (a *awsClient) HandleLambdaEvent(ctx context.Context, settings *Settings, snsEvent events.SNSEvent) error {
-	wg, childCtx := errgroup.WithContext(ctx)
+	report := &LambdaEventReport{
+		Records: make([]*LambdaRecordOutcome, len(snsEvent.Records)),
+	}
+	wg := sync.WaitGroup{}
 	for i := range snsEvent.Records {
 		req := &LambdaRequest{
-			Context:     childCtx,
+			Context:     ctx,
 			EventRecord: &snsEvent.Records[i],
 		}
 		select {
 		case <-ctx.Done():
-			// Do nothing
+			report.Records[i] = &LambdaRecordOutcome{
+				SNSMessageID: req.EventRecord.SNS.MessageID,
+				Outcome:      OutcomeFailure,
+				Err:          ctx.Err(),
+			}
 		default:
-			wg.Go(func() error {
-				return a.processSNSRecord(ctx, settings, req)
-			})
-
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				// records are processed independently, so one failed record doesn't interrupt the others
+				report.Records[i] = a.processSNSRecord(ctx, settings, req)
+			}(i)
 		}
 	}
+	wg.Wait()
 
-	err := wg.Wait()
+	if settings.LambdaEventReportHook != nil {
+		settings.LambdaEventReportHook(ctx, report)
+	}
 	if ctx.Err() != nil {
 		// if context was canceled, signal appropriately
 		return ctx.Err()
 	}
-	return err
+	return report.err()
+}
+
+// sqsQueueURL returns the URL of the queue with the given ARN. The endpoint depends on the partition of the ARN, e.g.
+// queues in China regions have a different domain.
+func sqsQueueURL(queueARN string) (*string, error) {
+	// arn:<partition>:sqs:<region>:<account id>:<queue name>
+	parts := strings.Split(queueARN, ":")
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sqs" {
+		return nil, errors.Errorf("invalid SQS queue ARN: %s", queueARN)
+	}
+	for _, partition := range endpoints.DefaultPartitions() {
+		if partition.ID() != parts[1] {
+			continue
+		}
+		endpoint, err := partition.EndpointFor(sqs.EndpointsID, parts[3])
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to resolve SQS endpoint for queue ARN: %s", queueARN)
+		}
+		return aws.String(fmt.Sprintf("%s/%s/%s", endpoint.URL, parts[4], parts[5])), nil
+	}
+	return nil, errors.Errorf("unknown partition in SQS queue ARN: %s", queueARN)
+}
+
+// sqsMessageFromEvent converts an SQS record delivered to Lambda to the equivalent SQS message
+func sqsMessageFromEvent(record *events.SQSMessage) *sqs.Message {
+	attributes := make(map[string]*string, len(record.Attributes))
+	for key, value := range record.Attributes {
+		attributes[key] = aws.String(value)
+	}
+	messageAttributes := make(map[string]*sqs.MessageAttributeValue, len(record.MessageAttributes))
+	for key, value := range record.MessageAttributes {
+		messageAttributes[key] = &sqs.MessageAttributeValue{
+			DataType:    aws.String(value.DataType),
+			StringValue: value.StringValue,
+			BinaryValue: value.BinaryValue,
+		}
+	}
+	return &sqs.Message{
+		MessageId:         aws.String(record.MessageId),
+		ReceiptHandle:     aws.String(record.ReceiptHandle),
+		Body:              aws.String(record.Body),
+		MD5OfBody:         aws.String(record.Md5OfBody),
+		Attributes:        attributes,
+		MessageAttributes: messageAttributes,
+	}
+}
+
+func (a *awsClient) HandleLambdaSQSEvent(ctx context.Context, settings *Settings,
+	sqsEvent events.SQSEvent) (*SQSEventResponse, error) {
+
+	failed := make([]bool, len(sqsEvent.Records))
+	var sequencer *partitionSequencer
+	if settings.PartitionKey != nil {
+		sequencer = newPartitionSequencer(len(sqsEvent.Records))
+	}
+	poll := newPollTracker(len(sqsEvent.Records))
+	wg := sync.WaitGroup{}
+	for i := range sqsEvent.Records {
+		record := &sqsEvent.Records[i]
+		partition := sequencer.ticket(i)
+		select {
+		case <-ctx.Done():
+			failed[i] = true
+			partition.release()
+			poll.done()
+			continue
+		default:
+		}
+		queueURL, err := sqsQueueURL(record.EventSourceARN)
+		if err != nil {
+			settings.GetLogger(ctx).Error(err, "Failed to process lambda event", LoggingFields{
+				"message_sqs_id": record.MessageId,
+			})
+			failed[i] = true
+			partition.release()
+			poll.done()
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start := time.Now()
+			// records that aren't reported as failures are deleted by Lambda, so messages nacked or handed off by
+			// the callback are reported as failures
+			queueMessage := sqsMessageFromEvent(record)
+			ack := newSQSAcknowledger(a.sqs, queueURL, queueMessage)
+			delivery := &messageDelivery{partition: partition, poll: poll}
+			outcome := a.handleSQSMessage(ctx, settings, queueMessage, queueURL, ack, delivery)
+			failed[i] = outcome != OutcomeSuccess && outcome != OutcomeDeadLettered && outcome != OutcomeExpired
+			reportMetrics(ctx, settings, outcome, start)
+		}(i)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		// if context was canceled, signal appropriately
+		return nil, ctx.Err()
+	}
+	response := &SQSEventResponse{BatchItemFailures: []SQSBatchItemFailure{}}
+	for i := range sqsEvent.Records {
+		if failed[i] {
+			response.BatchItemFailures = append(
+				response.BatchItemFailures, SQSBatchItemFailure{ItemIdentifier: sqsEvent.Records[i].MessageId})
+		}
+	}
+	return response, nil
 }
 
 // PublishSNS handles publishing to AWS SNS
@@ -203,8 +594,66 @@ func (a *awsClient) getSQSQueueURL(ctx context.Context, queueName string) (*stri
 	return out.QueueUrl, nil
 }
 
-func (a *awsClient) messageHandler(ctx context.Context, settings *Settings, messageBody string, receipt string,
-	additionalLoggingFields LoggingFields) error {
+// queueVisibilityTimeout returns the default visibility timeout of a queue, which is only looked up once. Returns 0
+// if it can't be looked up, e.g. without permission for sqs:GetQueueAttributes, so callbacks have no deadline.
+func (a *awsClient) queueVisibilityTimeout(ctx context.Context, settings *Settings, queueURL *string) time.Duration {
+	a.visibilityTimeoutsLock.Lock()
+	defer a.visibilityTimeoutsLock.Unlock()
+	if visibilityTimeout, ok := a.visibilityTimeouts[*queueURL]; ok {
+		return visibilityTimeout
+	}
+	visibilityTimeout, err := a.getSQSQueueVisibilityTimeout(ctx, queueURL)
+	if err != nil {
+		settings.GetLogger(ctx).Error(err, "Failed to get SQS queue visibility timeout, callbacks have no deadline",
+			LoggingFields{"queue_url": *queueURL})
+		if ctx.Err() != nil {
+			// try again on the next poll
+			return 0
+		}
+	}
+	if a.visibilityTimeouts == nil {
+		a.visibilityTimeouts = map[string]time.Duration{}
+	}
+	a.visibilityTimeouts[*queueURL] = visibilityTimeout
+	return visibilityTimeout
+}
+
+// getSQSQueueVisibilityTimeout returns the default visibility timeout of a queue
+func (a *awsClient) getSQSQueueVisibilityTimeout(ctx context.Context, queueURL *string) (time.Duration, error) {
+	out, err := a.sqs.GetQueueAttributesWithContext(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       queueURL,
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameVisibilityTimeout)},
+	})
+	if err != nil {
+		return 0, err
+	}
+	visibilityTimeoutS, err := strconv.Atoi(aws.StringValue(out.Attributes[sqs.QueueAttributeNameVisibilityTimeout]))
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid visibility timeout")
+	}
+	return time.Duration(visibilityTimeoutS) * time.Second, nil
+}
+
+// messageDelivery describes how a message was delivered to the consumer
+type messageDelivery struct {
+	// SQS receipt handle, empty for messages delivered by SNS
+	receipt string
+	// visibility timeout of the message, or 0 if it has none
+	visibilityTimeout time.Duration
+	// time the message was received at, which its visibility timeout counts from
+	received time.Time
+	// throttle applies callback limits to the message; only messages that can be deferred are throttled
+	throttle bool
+	// transport metadata exposed to callbacks, if any
+	transport *TransportMetadata
+	// partition ticket ordering the message after others with the same key, if any
+	partition *partitionTicket
+	// tracker of the messages received together with the message, if any
+	poll *pollTracker
+}
+
+func (a *awsClient) messageHandler(ctx context.Context, settings *Settings, messageBody string,
+	delivery *messageDelivery, additionalLoggingFields LoggingFields) error {
 	loggingFields := LoggingFields{
 		"message_body": messageBody,
 	}
@@ -223,7 +672,8 @@ func (a *awsClient) messageHandler(ctx context.Context, settings *Settings, mess
 		return errors.New("callbackRegistry is required")
 	}
 	message := Message{
-		callbackRegistry: settings.CallbackRegistry,
+		callbackRegistry:  settings.CallbackRegistry,
+		converterRegistry: settings.ConverterRegistry,
 	}
 	err := json.Unmarshal(jsonData, &message)
 	if err != nil {
@@ -231,37 +681,130 @@ func (a *awsClient) messageHandler(ctx context.Context, settings *Settings, mess
 		return errors.Wrapf(err, "invalid message, unable to unmarshal")
 	}
 
-	// Set validator
-	message.withValidator(settings.Validator)
+	if converter := message.upcaster(); converter != nil {
+		message.withValidator(settings.Validator)
+		upcast, err := message.convert(ctx, settings, converter)
+		if err != nil {
+			return err
+		}
+		message = *upcast
+	}
+	if delivery.transport != nil {
+		message.transport = *delivery.transport
+	}
 
-	err = message.validate()
-	if err != nil {
-		return err
+	if settings.replies.waiting(&message) {
+		// replies to requests of this process go to the request, instead of the callback or fallback policy
+		message.withValidator(settings.Validator)
+		if err := message.validate(); err != nil {
+			return Permanent(err)
+		}
+		if settings.replies.deliver(&message) {
+			settings.GetLogger(ctx).Debug("Delivered reply to pending request", additionalLoggingFields)
+			return nil
+		}
+	}
+
+	if _, ok := settings.CallbackRegistry.resolve(message.callbackKey()); ok ||
+		settings.CallbackRegistry.fallbackPolicy == FallbackRetry {
+
+		// Set validator
+		message.withValidator(settings.Validator)
+
+		err = message.validate()
+		if err != nil {
+			// invalid messages will never succeed
+			return Permanent(err)
+		}
+
+		err = message.validateCallback(settings)
+		if err != nil {
+			return err
+		}
+	} else {
+		switch settings.CallbackRegistry.fallbackPolicy {
+		case FallbackDiscard:
+			settings.GetLogger(ctx).Info("Discarding message without callback", loggingFields)
+			return nil
+		case FallbackDeadLetter:
+			return Permanent(errUnknownCallback)
+		case FallbackCallback:
+			if settings.CallbackRegistry.fallbackCallback == nil {
+				return errUnknownCallback
+			}
+			message.callback = chainMiddleware(settings.CallbackRegistry.fallbackCallback, settings.CallbackMiddleware...)
+		}
+	}
+
+	if delivery.partition != nil {
+		// wait for messages with the same key received earlier; the ticket is released by the caller
+		delivery.partition.wait(settings.PartitionKey(&message))
 	}
 
-	err = message.validateCallback(settings)
+	// the visibility timeout counts from when the message was received, including the time it waited
+	var waited time.Duration
+	if !delivery.received.IsZero() {
+		waited = time.Since(delivery.received)
+	}
+	timeout, err := callbackTimeout(settings, message.callbackKey(), delivery.visibilityTimeout, waited)
 	if err != nil {
 		return err
 	}
+	if err := handleExpired(ctx, settings, &message, additionalLoggingFields, timeout); err != nil {
+		return err
+	}
 
-	return message.execCallback(ctx, receipt)
+	return execIdempotent(ctx, settings, &message, additionalLoggingFields, timeout,
+		func(finish func(err error) error) error {
+			// duplicates don't count towards callback limits
+			release := func() {}
+			if delivery.throttle {
+				var err error
+				release, err = settings.CallbackRegistry.acquire(message.callbackKey())
+				if err != nil {
+					return finish(err)
+				}
+			}
+			deferred := newDeferredPublisher(&Publisher{awsClient: a, settings: settings})
+			return execWithTimeout(ctx, settings, additionalLoggingFields, timeout, func(ctx context.Context) error {
+				callbackCtx := delivery.poll.withContext(withPanicRecovery(deferred.withContext(ctx), settings))
+				return message.execCallback(callbackCtx, delivery.receipt)
+			}, func(err error) error {
+				// the in-flight slot and idempotency lease are held until the callback returns, even after it times
+				// out
+				release()
+				if err == nil && notDone(ctx) {
+					// the message is retried, or acknowledged later, so it's not marked as processed, and the
+					// messages it published are dropped
+					finish(errNotDone)
+					return nil
+				}
+				if err == nil {
+					// messages published by a failed callback are dropped, since they're published again on retry.
+					// The message is only marked as processed once they're sent, so a failure to publish them
+					// releases the lease, and the retry publishes them again.
+					err = deferred.flush(ctx)
+				}
+				return finish(err)
+			})
+		})
 }
 
-func (a *awsClient) messageHandlerSQS(settings *Settings, request *SQSRequest) error {
+func (a *awsClient) messageHandlerSQS(settings *Settings, request *SQSRequest, delivery *messageDelivery) error {
 	loggingFields := LoggingFields{
 		"message_sqs_id": *request.QueueMessage.MessageId,
 	}
-	return a.messageHandler(
-		request.Context, settings, *request.QueueMessage.Body, *request.QueueMessage.ReceiptHandle,
-		loggingFields,
-	)
+	return a.messageHandler(request.Context, settings, *request.QueueMessage.Body, delivery, loggingFields)
 }
 
 func (a *awsClient) messageHandlerLambda(settings *Settings, request *LambdaRequest) error {
 	loggingFields := LoggingFields{
 		"message_sns_id": request.EventRecord.SNS.MessageID,
 	}
-	return a.messageHandler(request.Context, settings, request.EventRecord.SNS.Message, "", loggingFields)
+	delivery := &messageDelivery{
+		transport: snsTransportMetadata(request.EventRecord),
+	}
+	return a.messageHandler(request.Context, settings, request.EventRecord.SNS.Message, delivery, loggingFields)
 }
 
 func newAWSClient(sessionCache *AWSSessionsCache, settings *Settings) iAmazonWebServicesClient {
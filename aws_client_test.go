@@ -12,6 +12,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -28,7 +29,6 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
-	"golang.org/x/sync/errgroup"
 )
 
 // FakeHedwigDataField is a fake data field for testing
@@ -52,11 +52,26 @@ func (fs *FakeSQS) GetQueueUrlWithContext(ctx aws.Context, in *sqs.GetQueueUrlIn
 	return args.Get(0).(*sqs.GetQueueUrlOutput), args.Error(1)
 }
 
+func (fs *FakeSQS) GetQueueAttributesWithContext(ctx aws.Context, in *sqs.GetQueueAttributesInput, opts ...request.Option) (*sqs.GetQueueAttributesOutput, error) {
+	args := fs.Called(ctx, in, opts)
+	return args.Get(0).(*sqs.GetQueueAttributesOutput), args.Error(1)
+}
+
 func (fs *FakeSQS) ReceiveMessageWithContext(ctx aws.Context, in *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
 	args := fs.Called(ctx, in, opts)
 	return args.Get(0).(*sqs.ReceiveMessageOutput), args.Error(1)
 }
 
+func (fs *FakeSQS) ChangeMessageVisibilityWithContext(ctx aws.Context, in *sqs.ChangeMessageVisibilityInput, opts ...request.Option) (*sqs.ChangeMessageVisibilityOutput, error) {
+	args := fs.Called(ctx, in, opts)
+	return args.Get(0).(*sqs.ChangeMessageVisibilityOutput), args.Error(1)
+}
+
+func (fs *FakeSQS) PurgeQueueWithContext(ctx aws.Context, in *sqs.PurgeQueueInput, opts ...request.Option) (*sqs.PurgeQueueOutput, error) {
+	args := fs.Called(ctx, in, opts)
+	return args.Get(0).(*sqs.PurgeQueueOutput), args.Error(1)
+}
+
 func (fs *FakeSQS) DeleteMessageWithContext(ctx aws.Context, in *sqs.DeleteMessageInput, opts ...request.Option) (*sqs.DeleteMessageOutput, error) {
 	args := fs.Called(ctx, in, opts)
 	return args.Get(0).(*sqs.DeleteMessageOutput), args.Error(1)
@@ -78,17 +93,32 @@ type FakeAWSClient struct {
 }
 
 func (fa *FakeAWSClient) FetchAndProcessMessages(ctx context.Context, settings *Settings, numMessages uint32,
-	visibilityTimeoutS uint32) error {
+	visibilityTimeoutS uint32, state *consumerState) error {
 
 	args := fa.Called(ctx, settings, numMessages, visibilityTimeoutS)
 	return args.Error(0)
 }
 
+func (fa *FakeAWSClient) PollAndProcessMessages(ctx context.Context, settings *Settings, numMessages uint32,
+	visibilityTimeoutS uint32, waitTimeSeconds int64, state *consumerState) (int, error) {
+
+	args := fa.Called(ctx, settings, numMessages, visibilityTimeoutS, waitTimeSeconds)
+	return args.Int(0), args.Error(1)
+}
+
 func (fa *FakeAWSClient) HandleLambdaEvent(ctx context.Context, settings *Settings, snsEvent events.SNSEvent) error {
 	args := fa.Called(ctx, snsEvent)
 	return args.Error(0)
 }
 
+func (fa *FakeAWSClient) HandleLambdaSQSEvent(ctx context.Context, settings *Settings,
+	sqsEvent events.SQSEvent) (*SQSEventResponse, error) {
+
+	args := fa.Called(ctx, sqsEvent)
+	response, _ := args.Get(0).(*SQSEventResponse)
+	return response, args.Error(1)
+}
+
 func (fa *FakeAWSClient) PublishSNS(ctx context.Context, settings *Settings, messageTopic string, payload string,
 	headers map[string]string) error {
 
@@ -216,10 +246,12 @@ func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessages() {
 	queueName := "HEDWIG-DEV-MYAPP"
 	queueURL := "https://sqs.us-east-1.amazonaws.com/686176732873/" + queueName
 	expectedReceiveMessageInput := &sqs.ReceiveMessageInput{
-		QueueUrl:            &queueURL,
-		MaxNumberOfMessages: aws.Int64(10),
-		VisibilityTimeout:   aws.Int64(10),
-		WaitTimeSeconds:     aws.Int64(sqsWaitTimeoutSeconds),
+		AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+		MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+		QueueUrl:              &queueURL,
+		MaxNumberOfMessages:   aws.Int64(10),
+		VisibilityTimeout:     aws.Int64(10),
+		WaitTimeSeconds:       aws.Int64(sqsWaitTimeoutSeconds),
 	}
 
 	suite.settings.PreProcessHookSQS = fakePreProcessHookSQS.PreProcessHookSQS
@@ -250,7 +282,7 @@ func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessages() {
 		suite.Require().NoError(err)
 
 		// Have to use Anything cause comparison fails for function pointers
-		fakeCallback.On("Callback", ctx, mock.Anything).Return(nil)
+		fakeCallback.On("Callback", mock.Anything, mock.Anything).Return(nil)
 
 		msgJSON, err := message.JSONString()
 		suite.Require().NoError(err)
@@ -283,7 +315,7 @@ func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessages() {
 		sqs: fakeSqs,
 	}
 	err := awsClient.FetchAndProcessMessages(
-		ctx, suite.settings, 10, 10,
+		ctx, suite.settings, 10, 10, nil,
 	)
 	suite.NoError(err)
 	fakeCallback.AssertExpectations(suite.T())
@@ -320,6 +352,101 @@ func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessages() {
 	}
 }
 
+func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesQueueVisibilityTimeout() {
+	ctx := context.Background()
+	fakeSqs := &FakeSQS{}
+	queueName := "HEDWIG-DEV-MYAPP"
+	queueURL := "https://sqs.us-east-1.amazonaws.com/686176732873/" + queueName
+
+	fakeSqs.On("GetQueueUrlWithContext", ctx, &sqs.GetQueueUrlInput{QueueName: &queueName}, mock.Anything).
+		Return(&sqs.GetQueueUrlOutput{QueueUrl: &queueURL}, nil)
+	fakeSqs.On("GetQueueAttributesWithContext", ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       &queueURL,
+		AttributeNames: []*string{aws.String(sqs.QueueAttributeNameVisibilityTimeout)},
+	}, mock.Anything).Return(&sqs.GetQueueAttributesOutput{
+		Attributes: map[string]*string{sqs.QueueAttributeNameVisibilityTimeout: aws.String("10")},
+	}, nil)
+
+	message, err := NewMessage(
+		suite.settings, "vehicle_created", "1.0", nil, &FakeHedwigDataField{VehicleID: "C_1234567890123456"})
+	suite.Require().NoError(err)
+	msgJSON, err := message.JSONString()
+	suite.Require().NoError(err)
+	queueMessage := &sqs.Message{
+		MessageId:     aws.String(uuid.NewV4().String()),
+		Body:          aws.String(msgJSON),
+		ReceiptHandle: aws.String(uuid.NewV4().String()),
+	}
+	fakeSqs.On("ReceiveMessageWithContext", ctx, mock.MatchedBy(func(input *sqs.ReceiveMessageInput) bool {
+		return input.VisibilityTimeout == nil
+	}), mock.Anything).Return(&sqs.ReceiveMessageOutput{Messages: []*sqs.Message{queueMessage}}, nil)
+	fakeSqs.On("DeleteMessageWithContext", ctx, mock.Anything, mock.Anything).Return(&sqs.DeleteMessageOutput{}, nil)
+
+	// callbacks are limited by the queue's visibility timeout, less the safety margin
+	suite.fakeCallback.On("Callback", mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		deadline, ok := args.Get(0).(context.Context).Deadline()
+		suite.True(ok)
+		suite.True(time.Until(deadline) <= 9*time.Second)
+	})
+
+	awsClient := &awsClient{
+		sqs: fakeSqs,
+	}
+	err = awsClient.FetchAndProcessMessages(ctx, suite.settings, 10, 0, nil)
+	suite.NoError(err)
+
+	// the visibility timeout of the queue is only looked up once
+	err = awsClient.FetchAndProcessMessages(ctx, suite.settings, 10, 0, nil)
+	suite.NoError(err)
+
+	suite.fakeCallback.AssertExpectations(suite.T())
+	fakeSqs.AssertExpectations(suite.T())
+	fakeSqs.AssertNumberOfCalls(suite.T(), "GetQueueAttributesWithContext", 1)
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesQueueVisibilityTimeoutError() {
+	ctx := context.Background()
+	fakeSqs := &FakeSQS{}
+	queueName := "HEDWIG-DEV-MYAPP"
+	queueURL := "https://sqs.us-east-1.amazonaws.com/686176732873/" + queueName
+
+	fakeSqs.On("GetQueueUrlWithContext", ctx, &sqs.GetQueueUrlInput{QueueName: &queueName}, mock.Anything).
+		Return(&sqs.GetQueueUrlOutput{QueueUrl: &queueURL}, nil)
+	fakeSqs.On("GetQueueAttributesWithContext", ctx, mock.Anything, mock.Anything).
+		Return((*sqs.GetQueueAttributesOutput)(nil), errors.New("AccessDenied"))
+
+	message, err := NewMessage(
+		suite.settings, "vehicle_created", "1.0", nil, &FakeHedwigDataField{VehicleID: "C_1234567890123456"})
+	suite.Require().NoError(err)
+	msgJSON, err := message.JSONString()
+	suite.Require().NoError(err)
+	queueMessage := &sqs.Message{
+		MessageId:     aws.String(uuid.NewV4().String()),
+		Body:          aws.String(msgJSON),
+		ReceiptHandle: aws.String(uuid.NewV4().String()),
+	}
+	fakeSqs.On("ReceiveMessageWithContext", ctx, mock.Anything, mock.Anything).
+		Return(&sqs.ReceiveMessageOutput{Messages: []*sqs.Message{queueMessage}}, nil)
+	fakeSqs.On("DeleteMessageWithContext", ctx, mock.Anything, mock.Anything).Return(&sqs.DeleteMessageOutput{}, nil)
+
+	// without permission to look up the visibility timeout, callbacks have no deadline
+	suite.fakeCallback.On("Callback", mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		_, ok := args.Get(0).(context.Context).Deadline()
+		suite.False(ok)
+	})
+
+	awsClient := &awsClient{
+		sqs: fakeSqs,
+	}
+	err = awsClient.FetchAndProcessMessages(ctx, suite.settings, 10, 0, nil)
+	suite.NoError(err)
+	err = awsClient.FetchAndProcessMessages(ctx, suite.settings, 10, 0, nil)
+	suite.NoError(err)
+
+	suite.fakeCallback.AssertExpectations(suite.T())
+	fakeSqs.AssertNumberOfCalls(suite.T(), "GetQueueAttributesWithContext", 1)
+}
+
 func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesHookError() {
 	ctx := context.Background()
 	fakeCallback := suite.fakeCallback
@@ -328,10 +455,12 @@ func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesHookError(
 	queueName := "HEDWIG-DEV-MYAPP"
 	queueURL := "https://sqs.us-east-1.amazonaws.com/686176732873/" + queueName
 	expectedReceiveMessageInput := &sqs.ReceiveMessageInput{
-		QueueUrl:            &queueURL,
-		MaxNumberOfMessages: aws.Int64(10),
-		VisibilityTimeout:   aws.Int64(10),
-		WaitTimeSeconds:     aws.Int64(sqsWaitTimeoutSeconds),
+		AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+		MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+		QueueUrl:              &queueURL,
+		MaxNumberOfMessages:   aws.Int64(10),
+		VisibilityTimeout:     aws.Int64(10),
+		WaitTimeSeconds:       aws.Int64(sqsWaitTimeoutSeconds),
 	}
 
 	suite.settings.PreProcessHookSQS = fakePreProcessHookSQS.PreProcessHookSQS
@@ -375,7 +504,7 @@ func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesHookError(
 		sqs: fakeSqs,
 	}
 	err := awsClient.FetchAndProcessMessages(
-		ctx, suite.settings, 10, 10,
+		ctx, suite.settings, 10, 10, nil,
 	)
 	suite.NoError(err)
 	fakeCallback.AssertExpectations(suite.T())
@@ -390,10 +519,12 @@ func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesNoHook() {
 	queueName := "HEDWIG-DEV-MYAPP"
 	queueURL := "https://sqs.us-east-1.amazonaws.com/686176732873/" + queueName
 	expectedReceiveMessageInput := &sqs.ReceiveMessageInput{
-		QueueUrl:            &queueURL,
-		MaxNumberOfMessages: aws.Int64(10),
-		VisibilityTimeout:   aws.Int64(10),
-		WaitTimeSeconds:     aws.Int64(sqsWaitTimeoutSeconds),
+		AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+		MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+		QueueUrl:              &queueURL,
+		MaxNumberOfMessages:   aws.Int64(10),
+		VisibilityTimeout:     aws.Int64(10),
+		WaitTimeSeconds:       aws.Int64(sqsWaitTimeoutSeconds),
 	}
 
 	queueInput := &sqs.GetQueueUrlInput{
@@ -414,7 +545,7 @@ func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesNoHook() {
 		suite.Require().NoError(err)
 
 		// Have to use Anything cause comparison fails for function pointers
-		fakeCallback.On("Callback", ctx, mock.Anything).Return(nil)
+		fakeCallback.On("Callback", mock.Anything, mock.Anything).Return(nil)
 
 		msgJSON, err := message.JSONString()
 		suite.Require().NoError(err)
@@ -443,7 +574,7 @@ func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesNoHook() {
 		sqs: fakeSqs,
 	}
 	err := awsClient.FetchAndProcessMessages(
-		ctx, suite.settings, 10, 10,
+		ctx, suite.settings, 10, 10, nil,
 	)
 	suite.NoError(err)
 
@@ -471,10 +602,12 @@ func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesNoDeleteOn
 	fakeSqs.On("GetQueueUrlWithContext", ctx, queueInput, mock.Anything).Return(output, nil)
 
 	expectedReceiveMessageInput := &sqs.ReceiveMessageInput{
-		QueueUrl:            &queueURL,
-		MaxNumberOfMessages: aws.Int64(10),
-		VisibilityTimeout:   aws.Int64(10),
-		WaitTimeSeconds:     aws.Int64(sqsWaitTimeoutSeconds),
+		AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+		MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+		QueueUrl:              &queueURL,
+		MaxNumberOfMessages:   aws.Int64(10),
+		VisibilityTimeout:     aws.Int64(10),
+		WaitTimeSeconds:       aws.Int64(sqsWaitTimeoutSeconds),
 	}
 
 	data := FakeHedwigDataField{
@@ -492,7 +625,7 @@ func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesNoDeleteOn
 	suite.Require().NoError(err)
 
 	// Have to use Anything cause comparison fails for function pointers
-	fakeCallback.On("Callback", ctx, mock.Anything).Return(errors.New("my bad"))
+	fakeCallback.On("Callback", mock.Anything, mock.Anything).Return(errors.New("my bad"))
 
 	msgJSON, err := message.JSONString()
 	suite.Require().NoError(err)
@@ -512,7 +645,7 @@ func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesNoDeleteOn
 	awsClient := &awsClient{
 		sqs: fakeSqs,
 	}
-	err = awsClient.FetchAndProcessMessages(ctx, suite.settings, 10, 10)
+	err = awsClient.FetchAndProcessMessages(ctx, suite.settings, 10, 10, nil)
 	// no error is returned here, but we log the error
 	suite.NoError(err)
 
@@ -542,6 +675,495 @@ func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesNoDeleteOn
 	suite.NotNil(msg.callback)
 }
 
+func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesRetryPolicy() {
+	ctx := context.Background()
+
+	logger := &fakeLogger{}
+	suite.settings.GetLogger = func(_ context.Context) Logger { return logger }
+	suite.settings.RetryPolicy = NewExponentialBackoffRetryPolicy(10*time.Second, time.Hour)
+
+	fakeCallback := suite.fakeCallback
+	fakeSqs := &FakeSQS{}
+	queueName := "HEDWIG-DEV-MYAPP"
+	queueURL := "https://sqs.us-east-1.amazonaws.com/686176732873/" + queueName
+
+	queueInput := &sqs.GetQueueUrlInput{
+		QueueName: &queueName,
+	}
+	output := &sqs.GetQueueUrlOutput{
+		QueueUrl: &queueURL,
+	}
+	fakeSqs.On("GetQueueUrlWithContext", ctx, queueInput, mock.Anything).Return(output, nil)
+
+	data := FakeHedwigDataField{
+		VehicleID: "C_1234567890123456",
+	}
+	message, err := NewMessage(suite.settings, "vehicle_created", "1.0", nil, &data)
+	suite.Require().NoError(err)
+
+	fakeCallback.On("Callback", mock.Anything, mock.Anything).Return(errors.New("my bad"))
+
+	msgJSON, err := message.JSONString()
+	suite.Require().NoError(err)
+
+	queueMessage := &sqs.Message{
+		Attributes: map[string]*string{
+			sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("3"),
+		},
+		MessageId:     aws.String(uuid.NewV4().String()),
+		Body:          aws.String(msgJSON),
+		ReceiptHandle: aws.String(uuid.NewV4().String()),
+	}
+	receiveMessageOutput := &sqs.ReceiveMessageOutput{
+		Messages: []*sqs.Message{queueMessage},
+	}
+	fakeSqs.On("ReceiveMessageWithContext", ctx, mock.Anything, mock.Anything).Return(receiveMessageOutput, nil)
+
+	expectedChangeVisibilityInput := &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          &queueURL,
+		ReceiptHandle:     queueMessage.ReceiptHandle,
+		VisibilityTimeout: aws.Int64(40),
+	}
+	fakeSqs.On("ChangeMessageVisibilityWithContext", ctx, expectedChangeVisibilityInput, mock.Anything).
+		Return(&sqs.ChangeMessageVisibilityOutput{}, nil)
+
+	awsClient := &awsClient{
+		sqs: fakeSqs,
+	}
+	err = awsClient.FetchAndProcessMessages(ctx, suite.settings, 10, 10, nil)
+	suite.NoError(err)
+
+	suite.Equal(1, len(logger.logs))
+	suite.Equal("Retrying due to unknown exception", logger.logs[0].message)
+
+	fakeCallback.AssertExpectations(suite.T())
+	fakeSqs.AssertExpectations(suite.T())
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesThrottled() {
+	ctx := context.Background()
+
+	logger := &fakeLogger{}
+	suite.settings.GetLogger = func(_ context.Context) Logger { return logger }
+	metrics := []*MessageMetrics{}
+	suite.settings.MetricsHook = func(_ context.Context, m *MessageMetrics) { metrics = append(metrics, m) }
+
+	cbk := CallbackKey{MessageType: "vehicle_created", MessageMajorVersion: 1}
+	suite.settings.CallbackRegistry.SetCallbackLimits(cbk, &CallbackLimits{MaxInFlight: 1})
+	// another message is being processed
+	release, err := suite.settings.CallbackRegistry.acquire(cbk)
+	suite.Require().NoError(err)
+	defer release()
+
+	fakeCallback := suite.fakeCallback
+	fakeSqs := &FakeSQS{}
+	queueName := "HEDWIG-DEV-MYAPP"
+	queueURL := "https://sqs.us-east-1.amazonaws.com/686176732873/" + queueName
+
+	queueInput := &sqs.GetQueueUrlInput{
+		QueueName: &queueName,
+	}
+	output := &sqs.GetQueueUrlOutput{
+		QueueUrl: &queueURL,
+	}
+	fakeSqs.On("GetQueueUrlWithContext", ctx, queueInput, mock.Anything).Return(output, nil)
+
+	data := FakeHedwigDataField{
+		VehicleID: "C_1234567890123456",
+	}
+	message, err := NewMessage(suite.settings, "vehicle_created", "1.0", nil, &data)
+	suite.Require().NoError(err)
+
+	msgJSON, err := message.JSONString()
+	suite.Require().NoError(err)
+
+	queueMessage := &sqs.Message{
+		MessageId:     aws.String(uuid.NewV4().String()),
+		Body:          aws.String(msgJSON),
+		ReceiptHandle: aws.String(uuid.NewV4().String()),
+	}
+	receiveMessageOutput := &sqs.ReceiveMessageOutput{
+		Messages: []*sqs.Message{queueMessage},
+	}
+	fakeSqs.On("ReceiveMessageWithContext", ctx, mock.Anything, mock.Anything).Return(receiveMessageOutput, nil)
+
+	expectedChangeVisibilityInput := &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          &queueURL,
+		ReceiptHandle:     queueMessage.ReceiptHandle,
+		VisibilityTimeout: aws.Int64(1),
+	}
+	fakeSqs.On("ChangeMessageVisibilityWithContext", ctx, expectedChangeVisibilityInput, mock.Anything).
+		Return(&sqs.ChangeMessageVisibilityOutput{}, nil)
+
+	awsClient := &awsClient{
+		sqs: fakeSqs,
+	}
+	err = awsClient.FetchAndProcessMessages(ctx, suite.settings, 10, 10, nil)
+	suite.NoError(err)
+
+	suite.Equal(1, len(logger.logs))
+	suite.Equal("debug", logger.logs[0].level)
+	suite.Require().Equal(1, len(metrics))
+	suite.Equal(OutcomeThrottled, metrics[0].Outcome)
+
+	fakeCallback.AssertNotCalled(suite.T(), "Callback", mock.Anything, mock.Anything)
+	fakeSqs.AssertExpectations(suite.T())
+}
+
+func (suite *AWSClientTestSuite) setupSQSMessage(fakeSqs *FakeSQS, ctx context.Context) *sqs.Message {
+	queueName := "HEDWIG-DEV-MYAPP"
+	fakeSqs.On("GetQueueUrlWithContext", ctx, &sqs.GetQueueUrlInput{QueueName: &queueName}, mock.Anything).
+		Return(&sqs.GetQueueUrlOutput{QueueUrl: aws.String(testQueueURL)}, nil)
+
+	data := FakeHedwigDataField{
+		VehicleID: "C_1234567890123456",
+	}
+	message, err := NewMessage(suite.settings, "vehicle_created", "1.0", nil, &data)
+	suite.Require().NoError(err)
+	msgJSON, err := message.JSONString()
+	suite.Require().NoError(err)
+
+	queueMessage := &sqs.Message{
+		MessageId:     aws.String(uuid.NewV4().String()),
+		Body:          aws.String(msgJSON),
+		ReceiptHandle: aws.String(uuid.NewV4().String()),
+	}
+	fakeSqs.On("ReceiveMessageWithContext", ctx, mock.Anything, mock.Anything).
+		Return(&sqs.ReceiveMessageOutput{Messages: []*sqs.Message{queueMessage}}, nil)
+	return queueMessage
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesAckEarly() {
+	ctx := context.Background()
+	fakeSqs := &FakeSQS{}
+	queueMessage := suite.setupSQSMessage(fakeSqs, ctx)
+	logger := &fakeLogger{}
+	suite.settings.GetLogger = func(_ context.Context) Logger { return logger }
+
+	suite.fakeCallback.On("Callback", mock.Anything, mock.Anything).Return(errors.New("my bad")).Run(
+		func(args mock.Arguments) {
+			suite.NoError(Acknowledger(args.Get(0).(context.Context)).Ack(ctx))
+		})
+	// deleted only once, by the callback
+	fakeSqs.On("DeleteMessageWithContext", ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(testQueueURL),
+		ReceiptHandle: queueMessage.ReceiptHandle,
+	}, mock.Anything).Return(&sqs.DeleteMessageOutput{}, nil).Once()
+
+	awsClient := &awsClient{
+		sqs: fakeSqs,
+	}
+	err := awsClient.FetchAndProcessMessages(ctx, suite.settings, 10, 10, nil)
+	suite.NoError(err)
+
+	// not retried
+	suite.Require().Equal(1, len(logger.logs))
+	suite.Equal("Callback failed after acknowledging message", logger.logs[0].message)
+	suite.fakeCallback.AssertExpectations(suite.T())
+	fakeSqs.AssertExpectations(suite.T())
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesHandOff() {
+	ctx := context.Background()
+	fakeSqs := &FakeSQS{}
+	suite.setupSQSMessage(fakeSqs, ctx)
+	metrics := []*MessageMetrics{}
+	suite.settings.MetricsHook = func(_ context.Context, m *MessageMetrics) { metrics = append(metrics, m) }
+
+	var ack IAcknowledger
+	suite.fakeCallback.On("Callback", mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		ack = Acknowledger(args.Get(0).(context.Context))
+		ack.HandOff()
+	})
+
+	awsClient := &awsClient{
+		sqs: fakeSqs,
+	}
+	err := awsClient.FetchAndProcessMessages(ctx, suite.settings, 10, 10, nil)
+	suite.NoError(err)
+
+	suite.NotNil(ack)
+	suite.Require().Equal(1, len(metrics))
+	suite.Equal(OutcomeHandedOff, metrics[0].Outcome)
+	fakeSqs.AssertNotCalled(suite.T(), "DeleteMessageWithContext", mock.Anything, mock.Anything, mock.Anything)
+	suite.fakeCallback.AssertExpectations(suite.T())
+	fakeSqs.AssertExpectations(suite.T())
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesRetryAfter() {
+	ctx := context.Background()
+
+	logger := &fakeLogger{}
+	suite.settings.GetLogger = func(_ context.Context) Logger { return logger }
+
+	fakeCallback := suite.fakeCallback
+	fakeSqs := &FakeSQS{}
+	queueName := "HEDWIG-DEV-MYAPP"
+	queueURL := "https://sqs.us-east-1.amazonaws.com/686176732873/" + queueName
+
+	queueInput := &sqs.GetQueueUrlInput{
+		QueueName: &queueName,
+	}
+	output := &sqs.GetQueueUrlOutput{
+		QueueUrl: &queueURL,
+	}
+	fakeSqs.On("GetQueueUrlWithContext", ctx, queueInput, mock.Anything).Return(output, nil)
+
+	data := FakeHedwigDataField{
+		VehicleID: "C_1234567890123456",
+	}
+	message, err := NewMessage(suite.settings, "vehicle_created", "1.0", nil, &data)
+	suite.Require().NoError(err)
+
+	fakeCallback.On("Callback", mock.Anything, mock.Anything).Return(RetryAfter(5 * time.Minute))
+
+	msgJSON, err := message.JSONString()
+	suite.Require().NoError(err)
+
+	queueMessage := &sqs.Message{
+		MessageId:     aws.String(uuid.NewV4().String()),
+		Body:          aws.String(msgJSON),
+		ReceiptHandle: aws.String(uuid.NewV4().String()),
+	}
+	receiveMessageOutput := &sqs.ReceiveMessageOutput{
+		Messages: []*sqs.Message{queueMessage},
+	}
+	fakeSqs.On("ReceiveMessageWithContext", ctx, mock.Anything, mock.Anything).Return(receiveMessageOutput, nil)
+
+	expectedChangeVisibilityInput := &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          &queueURL,
+		ReceiptHandle:     queueMessage.ReceiptHandle,
+		VisibilityTimeout: aws.Int64(300),
+	}
+	fakeSqs.On("ChangeMessageVisibilityWithContext", ctx, expectedChangeVisibilityInput, mock.Anything).
+		Return(&sqs.ChangeMessageVisibilityOutput{}, nil)
+
+	awsClient := &awsClient{
+		sqs: fakeSqs,
+	}
+	err = awsClient.FetchAndProcessMessages(ctx, suite.settings, 10, 10, nil)
+	suite.NoError(err)
+
+	suite.Equal(1, len(logger.logs))
+	suite.Equal("debug", logger.logs[0].level)
+
+	fakeCallback.AssertExpectations(suite.T())
+	fakeSqs.AssertExpectations(suite.T())
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesExpired() {
+	ctx := context.Background()
+	fakeSqs := &FakeSQS{}
+	queueMessage := suite.setupSQSMessage(fakeSqs, ctx)
+	var metrics []*MessageMetrics
+	suite.settings.MetricsHook = func(_ context.Context, m *MessageMetrics) { metrics = append(metrics, m) }
+	suite.settings.CallbackRegistry.SetMaxAge(
+		CallbackKey{MessageType: "vehicle_created", MessageMajorVersion: 1}, time.Nanosecond)
+
+	fakeSqs.On("DeleteMessageWithContext", ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(testQueueURL),
+		ReceiptHandle: queueMessage.ReceiptHandle,
+	}, mock.Anything).Return(&sqs.DeleteMessageOutput{}, nil)
+
+	awsClient := &awsClient{
+		sqs: fakeSqs,
+	}
+	err := awsClient.FetchAndProcessMessages(ctx, suite.settings, 10, 10, nil)
+	suite.NoError(err)
+
+	suite.Require().Equal(1, len(metrics))
+	suite.Equal(OutcomeExpired, metrics[0].Outcome)
+	suite.fakeCallback.AssertNotCalled(suite.T(), "Callback", mock.Anything, mock.Anything)
+	fakeSqs.AssertExpectations(suite.T())
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesExpiredDeadLetter() {
+	ctx := context.Background()
+	fakeSqs := &FakeSQS{}
+	queueMessage := suite.setupSQSMessage(fakeSqs, ctx)
+	suite.settings.ExpiryPolicy = ExpiryDeadLetter
+	suite.settings.CallbackRegistry.SetMaxAge(
+		CallbackKey{MessageType: "vehicle_created", MessageMajorVersion: 1}, time.Nanosecond)
+
+	dlqName := "HEDWIG-DEV-MYAPP-DLQ"
+	dlqURL := "https://sqs.us-east-1.amazonaws.com/686176732873/" + dlqName
+	fakeSqs.On("GetQueueUrlWithContext", ctx, &sqs.GetQueueUrlInput{QueueName: &dlqName}, mock.Anything).
+		Return(&sqs.GetQueueUrlOutput{QueueUrl: &dlqURL}, nil)
+	fakeSqs.On("SendMessageWithContext", ctx, mock.MatchedBy(func(input *sqs.SendMessageInput) bool {
+		reason := *input.MessageAttributes[DeadLetterReasonAttribute].StringValue
+		return *input.QueueUrl == dlqURL && *input.MessageBody == *queueMessage.Body &&
+			strings.HasPrefix(reason, "message expired at ")
+	}), mock.Anything).Return(&sqs.SendMessageOutput{}, nil)
+	fakeSqs.On("DeleteMessageWithContext", ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(testQueueURL),
+		ReceiptHandle: queueMessage.ReceiptHandle,
+	}, mock.Anything).Return(&sqs.DeleteMessageOutput{}, nil).Once()
+
+	awsClient := &awsClient{
+		sqs: fakeSqs,
+	}
+	err := awsClient.FetchAndProcessMessages(ctx, suite.settings, 10, 10, nil)
+	suite.NoError(err)
+
+	suite.fakeCallback.AssertNotCalled(suite.T(), "Callback", mock.Anything, mock.Anything)
+	fakeSqs.AssertExpectations(suite.T())
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesDeadLetter() {
+	ctx := context.Background()
+
+	logger := &fakeLogger{}
+	suite.settings.GetLogger = func(_ context.Context) Logger { return logger }
+	var metrics []*MessageMetrics
+	suite.settings.MetricsHook = func(_ context.Context, m *MessageMetrics) { metrics = append(metrics, m) }
+
+	fakeCallback := suite.fakeCallback
+	fakeSqs := &FakeSQS{}
+	queueName := "HEDWIG-DEV-MYAPP"
+	queueURL := "https://sqs.us-east-1.amazonaws.com/686176732873/" + queueName
+	dlqName := "HEDWIG-DEV-MYAPP-DLQ"
+	dlqURL := "https://sqs.us-east-1.amazonaws.com/686176732873/" + dlqName
+
+	fakeSqs.On("GetQueueUrlWithContext", ctx, &sqs.GetQueueUrlInput{QueueName: &queueName}, mock.Anything).
+		Return(&sqs.GetQueueUrlOutput{QueueUrl: &queueURL}, nil)
+	fakeSqs.On("GetQueueUrlWithContext", ctx, &sqs.GetQueueUrlInput{QueueName: &dlqName}, mock.Anything).
+		Return(&sqs.GetQueueUrlOutput{QueueUrl: &dlqURL}, nil)
+
+	data := FakeHedwigDataField{
+		VehicleID: "C_1234567890123456",
+	}
+	message, err := NewMessage(suite.settings, "vehicle_created", "1.0", nil, &data)
+	suite.Require().NoError(err)
+
+	fakeCallback.On("Callback", mock.Anything, mock.Anything).Return(Permanent(errors.New("my bad")))
+
+	msgJSON, err := message.JSONString()
+	suite.Require().NoError(err)
+
+	queueMessage := &sqs.Message{
+		Attributes: map[string]*string{
+			sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("2"),
+		},
+		MessageId:     aws.String(uuid.NewV4().String()),
+		Body:          aws.String(msgJSON),
+		ReceiptHandle: aws.String(uuid.NewV4().String()),
+	}
+	receiveMessageOutput := &sqs.ReceiveMessageOutput{
+		Messages: []*sqs.Message{queueMessage},
+	}
+	fakeSqs.On("ReceiveMessageWithContext", ctx, mock.Anything, mock.Anything).Return(receiveMessageOutput, nil)
+
+	expectedSendMessageInput := &sqs.SendMessageInput{
+		QueueUrl:          &dlqURL,
+		MessageBody:       queueMessage.Body,
+		MessageAttributes: deadLetterAttributes(errors.New("my bad"), 2),
+	}
+	fakeSqs.On("SendMessageWithContext", ctx, expectedSendMessageInput, mock.Anything).
+		Return(&sqs.SendMessageOutput{}, nil)
+	expectedDeleteMessageInput := &sqs.DeleteMessageInput{
+		QueueUrl:      &queueURL,
+		ReceiptHandle: queueMessage.ReceiptHandle,
+	}
+	fakeSqs.On("DeleteMessageWithContext", ctx, expectedDeleteMessageInput, mock.Anything).
+		Return(&sqs.DeleteMessageOutput{}, nil)
+
+	awsClient := &awsClient{
+		sqs: fakeSqs,
+	}
+	err = awsClient.FetchAndProcessMessages(ctx, suite.settings, 10, 10, nil)
+	suite.NoError(err)
+
+	suite.Equal(1, len(logger.logs))
+	suite.Equal("Dead-lettering due to permanent failure", logger.logs[0].message)
+	suite.Require().Equal(1, len(metrics))
+	suite.Equal("DEV-MYAPP", metrics[0].QueueName)
+	suite.Equal(OutcomeDeadLettered, metrics[0].Outcome)
+
+	fakeCallback.AssertExpectations(suite.T())
+	fakeSqs.AssertExpectations(suite.T())
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesStopPolling() {
+	ctx := context.Background()
+	fakeSqs := &FakeSQS{}
+	queueName := "HEDWIG-DEV-MYAPP"
+	queueURL := "https://sqs.us-east-1.amazonaws.com/686176732873/" + queueName
+
+	fakeSqs.On("GetQueueUrlWithContext", ctx, &sqs.GetQueueUrlInput{QueueName: &queueName}, mock.Anything).
+		Return(&sqs.GetQueueUrlOutput{QueueUrl: &queueURL}, nil)
+	fakeSqs.On("ReceiveMessageWithContext", mock.Anything, mock.Anything, mock.Anything).
+		Return((*sqs.ReceiveMessageOutput)(nil), errors.New("RequestCanceled")).
+		Run(func(args mock.Arguments) {
+			<-args.Get(0).(context.Context).Done()
+		})
+
+	state := newConsumerState()
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		state.stop()
+	}()
+
+	awsClient := &awsClient{
+		sqs: fakeSqs,
+	}
+	err := awsClient.FetchAndProcessMessages(ctx, suite.settings, 10, 10, state)
+	suite.NoError(err)
+
+	suite.fakeCallback.AssertExpectations(suite.T())
+	fakeSqs.AssertExpectations(suite.T())
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_FetchAndProcessMessagesCallbackPanic() {
+	ctx := context.Background()
+
+	logger := &fakeLogger{}
+	suite.settings.GetLogger = func(_ context.Context) Logger { return logger }
+
+	fakeCallback := suite.fakeCallback
+	fakeSqs := &FakeSQS{}
+	queueName := "HEDWIG-DEV-MYAPP"
+	queueURL := "https://sqs.us-east-1.amazonaws.com/686176732873/" + queueName
+
+	fakeSqs.On("GetQueueUrlWithContext", ctx, &sqs.GetQueueUrlInput{QueueName: &queueName}, mock.Anything).
+		Return(&sqs.GetQueueUrlOutput{QueueUrl: &queueURL}, nil)
+
+	data := FakeHedwigDataField{
+		VehicleID: "C_1234567890123456",
+	}
+	message, err := NewMessage(suite.settings, "vehicle_created", "1.0", nil, &data)
+	suite.Require().NoError(err)
+
+	fakeCallback.On("Callback", mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		panic("oops")
+	})
+
+	msgJSON, err := message.JSONString()
+	suite.Require().NoError(err)
+
+	queueMessage := &sqs.Message{
+		MessageId:     aws.String(uuid.NewV4().String()),
+		Body:          aws.String(msgJSON),
+		ReceiptHandle: aws.String(uuid.NewV4().String()),
+	}
+	fakeSqs.On("ReceiveMessageWithContext", ctx, mock.Anything, mock.Anything).
+		Return(&sqs.ReceiveMessageOutput{Messages: []*sqs.Message{queueMessage}}, nil)
+
+	awsClient := &awsClient{
+		sqs: fakeSqs,
+	}
+	err = awsClient.FetchAndProcessMessages(ctx, suite.settings, 10, 10, nil)
+	suite.NoError(err)
+
+	suite.Require().Equal(2, len(logger.logs))
+	suite.Equal("Recovered from panic while processing message", logger.logs[0].message)
+	suite.Equal(*queueMessage.MessageId, logger.logs[0].fields["message_sqs_id"])
+	suite.Equal("Retrying due to unknown exception", logger.logs[1].message)
+	suite.IsType(&PanicError{}, logger.logs[1].err)
+
+	fakeCallback.AssertExpectations(suite.T())
+	fakeSqs.AssertExpectations(suite.T())
+}
+
 func (suite *AWSClientTestSuite) TestAWSClient_HandleLambdaEvent() {
 	ctx := context.Background()
 	awsClient := &awsClient{}
@@ -551,7 +1173,6 @@ func (suite *AWSClientTestSuite) TestAWSClient_HandleLambdaEvent() {
 
 	suite.settings.PreProcessHookLambda = fakePreProcessHookLambda.PreProcessHookLambda
 
-	_, childCtx := errgroup.WithContext(ctx)
 	snsRecords := make([]events.SNSEventRecord, 2)
 	expectedMessages := make([]*Message, 2)
 	for i := 0; i < 2; i++ {
@@ -583,7 +1204,7 @@ func (suite *AWSClientTestSuite) TestAWSClient_HandleLambdaEvent() {
 			},
 		}
 		fakePreProcessHookLambda.On("PreProcessHookLambda", &LambdaRequest{
-			Context:     childCtx,
+			Context:     ctx,
 			EventRecord: &snsRecords[i],
 		}).Return(nil)
 	}
@@ -627,6 +1248,340 @@ func (suite *AWSClientTestSuite) TestAWSClient_HandleLambdaEvent() {
 	}
 }
 
+func (suite *AWSClientTestSuite) TestAWSClient_HandleLambdaSQSEvent() {
+	ctx := context.Background()
+	fakeSqs := &FakeSQS{}
+	awsClient := &awsClient{
+		sqs: fakeSqs,
+	}
+	logger := &fakeLogger{}
+	suite.settings.GetLogger = func(_ context.Context) Logger { return logger }
+	suite.settings.RetryPolicy = func(int) time.Duration { return time.Minute }
+
+	fakeCallback := suite.fakeCallback
+	isVehicle := func(vehicleID string) interface{} {
+		return mock.MatchedBy(func(message *Message) bool {
+			return message.Data.(*FakeHedwigDataField).VehicleID == vehicleID
+		})
+	}
+	fakeCallback.On("Callback", mock.Anything, isVehicle("C_1234567890123450")).Return(nil)
+	fakeCallback.On("Callback", mock.Anything, isVehicle("C_1234567890123451")).Return(errors.New("my bad"))
+
+	sqsRecords := make([]events.SQSMessage, 2)
+	for i := range sqsRecords {
+		data := FakeHedwigDataField{
+			VehicleID: fmt.Sprintf("C_123456789012345%d", i),
+		}
+		message, err := NewMessage(suite.settings, "vehicle_created", "1.0", nil, &data)
+		suite.Require().NoError(err)
+		msgJSON, err := message.JSONString()
+		suite.Require().NoError(err)
+
+		sqsRecords[i] = events.SQSMessage{
+			MessageId:      uuid.NewV4().String(),
+			ReceiptHandle:  uuid.NewV4().String(),
+			Body:           msgJSON,
+			Attributes:     map[string]string{"ApproximateReceiveCount": "1"},
+			EventSourceARN: "arn:aws:sqs:us-east-1:686176732873:HEDWIG-DEV-MYAPP",
+			EventSource:    "aws:sqs",
+		}
+	}
+
+	expectedChangeVisibilityInput := &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String("https://sqs.us-east-1.amazonaws.com/686176732873/HEDWIG-DEV-MYAPP"),
+		ReceiptHandle:     aws.String(sqsRecords[1].ReceiptHandle),
+		VisibilityTimeout: aws.Int64(60),
+	}
+	fakeSqs.On("ChangeMessageVisibilityWithContext", ctx, expectedChangeVisibilityInput, mock.Anything).
+		Return(&sqs.ChangeMessageVisibilityOutput{}, nil)
+
+	response, err := awsClient.HandleLambdaSQSEvent(ctx, suite.settings, events.SQSEvent{Records: sqsRecords})
+	suite.NoError(err)
+	suite.Equal(&SQSEventResponse{
+		BatchItemFailures: []SQSBatchItemFailure{{ItemIdentifier: sqsRecords[1].MessageId}},
+	}, response)
+
+	fakeCallback.AssertExpectations(suite.T())
+	fakeSqs.AssertExpectations(suite.T())
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_HandleLambdaSQSEventInvalidARN() {
+	ctx := context.Background()
+	awsClient := &awsClient{}
+	logger := &fakeLogger{}
+	suite.settings.GetLogger = func(_ context.Context) Logger { return logger }
+
+	sqsEvent := events.SQSEvent{
+		Records: []events.SQSMessage{{MessageId: "123", EventSourceARN: "arn:aws:sns:us-east-1:686176732873:foo"}},
+	}
+	response, err := awsClient.HandleLambdaSQSEvent(ctx, suite.settings, sqsEvent)
+	suite.NoError(err)
+	suite.Equal(&SQSEventResponse{BatchItemFailures: []SQSBatchItemFailure{{ItemIdentifier: "123"}}}, response)
+	suite.Equal(1, len(logger.logs))
+}
+
+func (suite *AWSClientTestSuite) TestSQSQueueURL() {
+	queueURL, err := sqsQueueURL("arn:aws:sqs:us-east-1:686176732873:HEDWIG-DEV-MYAPP")
+	suite.NoError(err)
+	suite.Equal("https://sqs.us-east-1.amazonaws.com/686176732873/HEDWIG-DEV-MYAPP", *queueURL)
+
+	queueURL, err = sqsQueueURL("arn:aws-cn:sqs:cn-north-1:686176732873:HEDWIG-DEV-MYAPP")
+	suite.NoError(err)
+	suite.Equal("https://sqs.cn-north-1.amazonaws.com.cn/686176732873/HEDWIG-DEV-MYAPP", *queueURL)
+
+	queueURL, err = sqsQueueURL("arn:aws-us-gov:sqs:us-gov-west-1:686176732873:HEDWIG-DEV-MYAPP")
+	suite.NoError(err)
+	suite.Equal("https://sqs.us-gov-west-1.amazonaws.com/686176732873/HEDWIG-DEV-MYAPP", *queueURL)
+
+	_, err = sqsQueueURL("HEDWIG-DEV-MYAPP")
+	suite.EqualError(err, "invalid SQS queue ARN: HEDWIG-DEV-MYAPP")
+
+	_, err = sqsQueueURL("arn:aws-mars:sqs:mars-1:686176732873:HEDWIG-DEV-MYAPP")
+	suite.EqualError(err, "unknown partition in SQS queue ARN: arn:aws-mars:sqs:mars-1:686176732873:HEDWIG-DEV-MYAPP")
+}
+
+func (suite *AWSClientTestSuite) lambdaEventWithPoisonRecord() events.SNSEvent {
+	isVehicle := func(vehicleID string) interface{} {
+		return mock.MatchedBy(func(message *Message) bool {
+			return message.Data.(*FakeHedwigDataField).VehicleID == vehicleID
+		})
+	}
+	suite.fakeCallback.On("Callback", mock.Anything, isVehicle("C_1234567890123450")).Return(nil)
+	suite.fakeCallback.On("Callback", mock.Anything, isVehicle("C_1234567890123451")).Return(errors.New("my bad"))
+
+	snsRecords := make([]events.SNSEventRecord, 2)
+	for i := range snsRecords {
+		data := FakeHedwigDataField{
+			VehicleID: fmt.Sprintf("C_123456789012345%d", i),
+		}
+		message, err := NewMessage(suite.settings, "vehicle_created", "1.0", nil, &data)
+		suite.Require().NoError(err)
+		msgJSON, err := message.JSONString()
+		suite.Require().NoError(err)
+
+		snsRecords[i] = events.SNSEventRecord{
+			SNS: events.SNSEntity{
+				MessageID: uuid.NewV4().String(),
+				Message:   msgJSON,
+			},
+		}
+	}
+	return events.SNSEvent{Records: snsRecords}
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_HandleLambdaEventReport() {
+	ctx := context.Background()
+	awsClient := &awsClient{}
+	logger := &fakeLogger{}
+	suite.settings.GetLogger = func(_ context.Context) Logger { return logger }
+	var report *LambdaEventReport
+	suite.settings.LambdaEventReportHook = func(_ context.Context, r *LambdaEventReport) { report = r }
+
+	snsEvent := suite.lambdaEventWithPoisonRecord()
+
+	err := awsClient.HandleLambdaEvent(ctx, suite.settings, snsEvent)
+	suite.EqualError(err, "my bad")
+
+	suite.Require().NotNil(report)
+	suite.Require().Equal(2, len(report.Records))
+	suite.Equal(&LambdaRecordOutcome{
+		SNSMessageID: snsEvent.Records[0].SNS.MessageID,
+		Outcome:      OutcomeSuccess,
+	}, report.Records[0])
+	suite.Equal(snsEvent.Records[1].SNS.MessageID, report.Records[1].SNSMessageID)
+	suite.Equal(OutcomeFailure, report.Records[1].Outcome)
+	suite.EqualError(report.Records[1].Err, "my bad")
+	suite.fakeCallback.AssertExpectations(suite.T())
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_HandleLambdaEventRetry() {
+	data := FakeHedwigDataField{
+		VehicleID: "C_1234567890123450",
+	}
+	message, err := NewMessage(suite.settings, "vehicle_created", "1.0", nil, &data)
+	suite.Require().NoError(err)
+	msgJSON, err := message.JSONString()
+	suite.Require().NoError(err)
+	suite.fakeCallback.On("Callback", mock.Anything, mock.Anything).Return(ErrRetry)
+
+	// retries fail the invocation, whatever the failure policy
+	for _, policy := range []LambdaFailurePolicy{LambdaFailInvocation, LambdaDeadLetter, LambdaIgnore} {
+		ctx := context.Background()
+		awsClient := &awsClient{}
+		logger := &fakeLogger{}
+		suite.settings.GetLogger = func(_ context.Context) Logger { return logger }
+		suite.settings.LambdaFailurePolicy = policy
+		var report *LambdaEventReport
+		suite.settings.LambdaEventReportHook = func(_ context.Context, r *LambdaEventReport) { report = r }
+
+		snsEvent := events.SNSEvent{
+			Records: []events.SNSEventRecord{{SNS: events.SNSEntity{MessageID: "123", Message: msgJSON}}},
+		}
+		err = awsClient.HandleLambdaEvent(ctx, suite.settings, snsEvent)
+		suite.Equal(ErrRetry, err)
+
+		suite.Require().NotNil(report)
+		suite.Equal(OutcomeRetry, report.Records[0].Outcome)
+		suite.Require().Equal(1, len(logger.logs))
+		suite.Equal("debug", logger.logs[0].level)
+	}
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_HandleLambdaEventTimeout() {
+	data := FakeHedwigDataField{
+		VehicleID: "C_1234567890123450",
+	}
+	message, err := NewMessage(suite.settings, "vehicle_created", "1.0", nil, &data)
+	suite.Require().NoError(err)
+	msgJSON, err := message.JSONString()
+	suite.Require().NoError(err)
+	suite.settings.CallbackTimeout = time.Millisecond
+	suite.settings.GetLogger = func(_ context.Context) Logger { return &fakeLogger{} }
+	suite.settings.CallbackRegistry.RegisterCallback(
+		CallbackKey{MessageType: "vehicle_created", MessageMajorVersion: 1},
+		func(ctx context.Context, _ *Message) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+		func() interface{} { return new(FakeHedwigDataField) })
+
+	// timeouts fail the invocation, whatever the failure policy
+	for _, policy := range []LambdaFailurePolicy{LambdaFailInvocation, LambdaDeadLetter, LambdaIgnore} {
+		ctx := context.Background()
+		awsClient := &awsClient{}
+		suite.settings.LambdaFailurePolicy = policy
+
+		snsEvent := events.SNSEvent{
+			Records: []events.SNSEventRecord{{SNS: events.SNSEntity{MessageID: "123", Message: msgJSON}}},
+		}
+		err = awsClient.HandleLambdaEvent(ctx, suite.settings, snsEvent)
+		suite.True(isTimeoutError(err))
+	}
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_HandleLambdaEventDeadLetterPolicy() {
+	ctx := context.Background()
+	fakeSqs := &FakeSQS{}
+	awsClient := &awsClient{
+		sqs: fakeSqs,
+	}
+	logger := &fakeLogger{}
+	suite.settings.GetLogger = func(_ context.Context) Logger { return logger }
+	suite.settings.DeadLetterQueueName = "DEV-MYAPP-DLQ"
+	suite.settings.LambdaFailurePolicy = LambdaDeadLetter
+	var report *LambdaEventReport
+	suite.settings.LambdaEventReportHook = func(_ context.Context, r *LambdaEventReport) { report = r }
+
+	snsEvent := suite.lambdaEventWithPoisonRecord()
+
+	dlqName := "HEDWIG-DEV-MYAPP-DLQ"
+	dlqURL := "https://sqs.us-east-1.amazonaws.com/686176732873/" + dlqName
+	fakeSqs.On("GetQueueUrlWithContext", ctx, &sqs.GetQueueUrlInput{QueueName: &dlqName}, mock.Anything).
+		Return(&sqs.GetQueueUrlOutput{QueueUrl: &dlqURL}, nil)
+	fakeSqs.On("SendMessageWithContext", ctx, &sqs.SendMessageInput{
+		QueueUrl:          &dlqURL,
+		MessageBody:       aws.String(snsEvent.Records[1].SNS.Message),
+		MessageAttributes: deadLetterAttributes(errors.New("my bad"), 0),
+	}, mock.Anything).Return(&sqs.SendMessageOutput{}, nil)
+
+	err := awsClient.HandleLambdaEvent(ctx, suite.settings, snsEvent)
+	suite.NoError(err)
+
+	suite.Require().NotNil(report)
+	suite.Equal(OutcomeSuccess, report.Records[0].Outcome)
+	suite.Equal(OutcomeDeadLettered, report.Records[1].Outcome)
+	suite.EqualError(report.Records[1].Err, "my bad")
+	suite.fakeCallback.AssertExpectations(suite.T())
+	fakeSqs.AssertExpectations(suite.T())
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_HandleLambdaEventPermanentError() {
+	ctx := context.Background()
+	fakeSqs := &FakeSQS{}
+	awsClient := &awsClient{
+		sqs: fakeSqs,
+	}
+	logger := &fakeLogger{}
+	suite.settings.GetLogger = func(_ context.Context) Logger { return logger }
+	suite.settings.DeadLetterQueueName = "DEV-MYAPP-DLQ"
+	var report *LambdaEventReport
+	suite.settings.LambdaEventReportHook = func(_ context.Context, r *LambdaEventReport) { report = r }
+	msgJSON := suite.unknownMessageJSON()
+	suite.settings.CallbackRegistry.SetFallbackPolicy(FallbackDeadLetter)
+
+	dlqName := "HEDWIG-DEV-MYAPP-DLQ"
+	dlqURL := "https://sqs.us-east-1.amazonaws.com/686176732873/" + dlqName
+	fakeSqs.On("GetQueueUrlWithContext", ctx, &sqs.GetQueueUrlInput{QueueName: &dlqName}, mock.Anything).
+		Return(&sqs.GetQueueUrlOutput{QueueUrl: &dlqURL}, nil)
+	fakeSqs.On("SendMessageWithContext", ctx, &sqs.SendMessageInput{
+		QueueUrl:          &dlqURL,
+		MessageBody:       aws.String(msgJSON),
+		MessageAttributes: deadLetterAttributes(errUnknownCallback, 0),
+	}, mock.Anything).Return(&sqs.SendMessageOutput{}, nil)
+
+	// permanent failures are dead-lettered, even though the invocation would fail otherwise
+	snsEvent := events.SNSEvent{
+		Records: []events.SNSEventRecord{{SNS: events.SNSEntity{MessageID: "123", Message: msgJSON}}},
+	}
+	err := awsClient.HandleLambdaEvent(ctx, suite.settings, snsEvent)
+	suite.NoError(err)
+
+	suite.Require().NotNil(report)
+	suite.Equal(OutcomeDeadLettered, report.Records[0].Outcome)
+	fakeSqs.AssertExpectations(suite.T())
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_HandleLambdaEventDeadLetterQueueNameRequired() {
+	ctx := context.Background()
+	fakeSqs := &FakeSQS{}
+	awsClient := &awsClient{
+		sqs: fakeSqs,
+	}
+	logger := &fakeLogger{}
+	suite.settings.GetLogger = func(_ context.Context) Logger { return logger }
+	suite.settings.QueueName = "DEV-MYAPP"
+	suite.settings.LambdaFailurePolicy = LambdaDeadLetter
+	var report *LambdaEventReport
+	suite.settings.LambdaEventReportHook = func(_ context.Context, r *LambdaEventReport) { report = r }
+
+	snsEvent := suite.lambdaEventWithPoisonRecord()
+
+	// the queue name isn't used to derive the dead-letter queue of lambda consumers
+	err := awsClient.HandleLambdaEvent(ctx, suite.settings, snsEvent)
+	suite.EqualError(err, "my bad")
+
+	suite.Require().NotNil(report)
+	suite.Equal(OutcomeFailure, report.Records[1].Outcome)
+	fakeSqs.AssertNotCalled(suite.T(), "SendMessageWithContext", mock.Anything, mock.Anything, mock.Anything)
+	var deadLetterErr error
+	for _, log := range logger.logs {
+		if log.message == "Failed to dead-letter lambda event" {
+			deadLetterErr = log.err
+		}
+	}
+	suite.Equal(errLambdaDeadLetterQueueName, deadLetterErr)
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_HandleLambdaEventIgnorePolicy() {
+	ctx := context.Background()
+	awsClient := &awsClient{}
+	logger := &fakeLogger{}
+	suite.settings.GetLogger = func(_ context.Context) Logger { return logger }
+	suite.settings.LambdaFailurePolicy = LambdaIgnore
+	var report *LambdaEventReport
+	suite.settings.LambdaEventReportHook = func(_ context.Context, r *LambdaEventReport) { report = r }
+
+	snsEvent := suite.lambdaEventWithPoisonRecord()
+
+	err := awsClient.HandleLambdaEvent(ctx, suite.settings, snsEvent)
+	suite.NoError(err)
+
+	suite.Require().NotNil(report)
+	suite.Equal(OutcomeSuccess, report.Records[0].Outcome)
+	suite.Equal(OutcomeIgnored, report.Records[1].Outcome)
+	suite.fakeCallback.AssertExpectations(suite.T())
+}
+
 func (suite *AWSClientTestSuite) TestAWSClient_HandleLambdaEventHookError() {
 	ctx := context.Background()
 	awsClient := &awsClient{}
@@ -651,9 +1606,8 @@ func (suite *AWSClientTestSuite) TestAWSClient_HandleLambdaEventHookError() {
 			Message:   msgJSON,
 		},
 	}
-	_, childCtx := errgroup.WithContext(ctx)
 	fakePreProcessHookLambda.On("PreProcessHookLambda", &LambdaRequest{
-		Context:     childCtx,
+		Context:     ctx,
 		EventRecord: &snsRecord,
 	}).Return(errors.New("fail"))
 
@@ -670,6 +1624,27 @@ func (suite *AWSClientTestSuite) TestAWSClient_HandleLambdaEventHookError() {
 	fakePreProcessHookLambda.AssertExpectations(suite.T())
 }
 
+func (suite *AWSClientTestSuite) TestAWSClient_HandleLambdaEventHookPanic() {
+	ctx := context.Background()
+	awsClient := &awsClient{}
+	logger := &fakeLogger{}
+	suite.settings.GetLogger = func(_ context.Context) Logger { return logger }
+	suite.settings.PreProcessHookLambda = func(*LambdaRequest) error {
+		panic("oops")
+	}
+
+	snsEvent := events.SNSEvent{
+		Records: []events.SNSEventRecord{{SNS: events.SNSEntity{MessageID: "123", Message: "{}"}}},
+	}
+	err := awsClient.HandleLambdaEvent(ctx, suite.settings, snsEvent)
+	suite.IsType(&PanicError{}, errors.Cause(err))
+
+	suite.Require().Equal(2, len(logger.logs))
+	suite.Equal("Recovered from panic while processing message", logger.logs[0].message)
+	suite.Equal("123", logger.logs[0].fields["message_sns_id"])
+	suite.fakeCallback.AssertExpectations(suite.T())
+}
+
 func (suite *AWSClientTestSuite) TestAWSClient_HandleLambdaEventContextCancel() {
 	ctx, cancel := context.WithCancel(context.Background())
 	awsClient := &awsClient{}
@@ -990,14 +1965,15 @@ func (suite *AWSClientTestSuite) TestAWSClient_messageHandler() {
 	receipt := uuid.NewV4().String()
 	message.Metadata.Receipt = receipt
 
-	fakeCallback.On("Callback", ctx, mock.Anything).Return(nil)
+	fakeCallback.On("Callback", mock.AnythingOfType("*context.valueCtx"), mock.Anything).Return(nil)
 
 	var messageBodyMap map[string]interface{}
 	err = json.Unmarshal([]byte(msgJSON), &messageBodyMap)
 	suite.Require().NoError(err)
 	fakePreDeserializeHook.On("PreDeserializeHook", &ctx, &msgJSON).Return(nil)
 
-	err = awsClient.messageHandler(ctx, suite.settings, msgJSON, receipt, nil)
+	err = awsClient.messageHandler(ctx, suite.settings, msgJSON,
+		&messageDelivery{receipt: receipt, throttle: true}, nil)
 	assertions.Nil(err)
 
 	fakeCallback.AssertExpectations(suite.T())
@@ -1037,7 +2013,8 @@ func (suite *AWSClientTestSuite) TestAWSClient_messageHandlerHookError() {
 	fakePreDeserializeHook.On("PreDeserializeHook", &ctx, &msgJSON).Return(expectedError)
 
 	receipt := uuid.NewV4().String()
-	err = awsClient.messageHandler(ctx, suite.settings, msgJSON, receipt, nil)
+	err = awsClient.messageHandler(ctx, suite.settings, msgJSON,
+		&messageDelivery{receipt: receipt, throttle: true}, nil)
 	assertions.EqualError(errors.Cause(err), "Fake error!")
 
 	fakeCallback.AssertExpectations(suite.T())
@@ -1065,9 +2042,10 @@ func (suite *AWSClientTestSuite) TestAWSClient_messageHandlerNoHook() {
 	receipt := uuid.NewV4().String()
 	message.Metadata.Receipt = receipt
 
-	fakeCallback.On("Callback", ctx, mock.Anything).Return(nil)
+	fakeCallback.On("Callback", mock.AnythingOfType("*context.valueCtx"), mock.Anything).Return(nil)
 
-	err = awsClient.messageHandler(ctx, suite.settings, msgJSON, receipt, nil)
+	err = awsClient.messageHandler(ctx, suite.settings, msgJSON,
+		&messageDelivery{receipt: receipt, throttle: true}, nil)
 	assertions.Nil(err)
 
 	fakeCallback.AssertExpectations(suite.T())
@@ -1095,7 +2073,8 @@ func (suite *AWSClientTestSuite) TestAWSClient_messageHandlerNoCallbackRegistry(
 	receipt := uuid.NewV4().String()
 	message.Metadata.Receipt = receipt
 
-	err = awsClient.messageHandler(ctx, suite.settings, msgJSON, receipt, nil)
+	err = awsClient.messageHandler(ctx, suite.settings, msgJSON,
+		&messageDelivery{receipt: receipt, throttle: true}, nil)
 	assertions.Contains(err.Error(), "callbackRegistry is required")
 
 	fakeCallback.AssertExpectations(suite.T())
@@ -1117,7 +2096,8 @@ func (suite *AWSClientTestSuite) TestAWSClient_messageHandlerFailsOnValidationFa
 
 	receipt := uuid.NewV4().String()
 
-	err = awsClient.messageHandler(ctx, suite.settings, msgJSON, receipt, nil)
+	err = awsClient.messageHandler(ctx, suite.settings, msgJSON,
+		&messageDelivery{receipt: receipt, throttle: true}, nil)
 	suite.Contains(err.Error(), "validate")
 
 	suite.True(fakeCallback.AssertNotCalled(suite.T(), "Callback"))
@@ -1143,7 +2123,7 @@ func (suite *AWSClientTestSuite) TestAWSClient_messageHandlerFailsOnCallbackFail
 	err = message.validateCallback(suite.settings)
 	suite.Require().NoError(err)
 
-	fakeCallback.On("Callback", ctx, mock.Anything).Return(errors.New("my bad"))
+	fakeCallback.On("Callback", mock.AnythingOfType("*context.valueCtx"), mock.Anything).Return(errors.New("my bad"))
 
 	msgJSON, err := message.JSONString()
 	suite.Require().NoError(err)
@@ -1151,7 +2131,8 @@ func (suite *AWSClientTestSuite) TestAWSClient_messageHandlerFailsOnCallbackFail
 	receipt := uuid.NewV4().String()
 	message.Metadata.Receipt = receipt
 
-	err = awsClient.messageHandler(ctx, suite.settings, msgJSON, receipt, nil)
+	err = awsClient.messageHandler(ctx, suite.settings, msgJSON,
+		&messageDelivery{receipt: receipt, throttle: true}, nil)
 	suite.EqualError(err, "my bad")
 
 	fakeCallback.AssertExpectations(suite.T())
@@ -1173,12 +2154,199 @@ func (suite *AWSClientTestSuite) TestAWSClient_messageHandlerFailsOnCallbackFail
 	suite.NotNil(msg.callback)
 }
 
+func (suite *AWSClientTestSuite) unknownMessageJSON() string {
+	data := FakeHedwigDataField{
+		VehicleID: "C_1234567890123456",
+	}
+	message, err := NewMessage(suite.settings, "vehicle_created", "1.0", nil, &data)
+	suite.Require().NoError(err)
+	msgJSON, err := message.JSONString()
+	suite.Require().NoError(err)
+
+	// consumer doesn't know about this message type
+	suite.settings.CallbackRegistry = NewCallbackRegistry()
+	return msgJSON
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_messageHandlerTimeoutHoldsInFlightSlot() {
+	ctx := context.Background()
+	awsClient := awsClient{}
+	suite.settings.GetLogger = func(_ context.Context) Logger { return &fakeLogger{} }
+	suite.settings.CallbackTimeout = time.Millisecond
+	cbk := CallbackKey{MessageType: "vehicle_created", MessageMajorVersion: 1}
+	suite.settings.CallbackRegistry.SetCallbackLimits(cbk, &CallbackLimits{MaxInFlight: 1})
+
+	message, err := NewMessage(
+		suite.settings, "vehicle_created", "1.0", nil, &FakeHedwigDataField{VehicleID: "C_1234567890123456"})
+	suite.Require().NoError(err)
+	msgJSON, err := message.JSONString()
+	suite.Require().NoError(err)
+
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	suite.fakeCallback.On("Callback", mock.Anything, mock.Anything).Return(nil).Run(func(mock.Arguments) {
+		<-release
+		close(finished)
+	})
+
+	err = awsClient.messageHandler(ctx, suite.settings, msgJSON, &messageDelivery{throttle: true}, nil)
+	suite.True(isTimeoutError(err))
+
+	// the callback is still running, so it still counts towards MaxInFlight
+	_, err = suite.settings.CallbackRegistry.acquire(cbk)
+	suite.True(isThrottledError(err))
+
+	close(release)
+	<-finished
+	// the slot is released right after the callback returns
+	for i := 0; ; i++ {
+		releaseSlot, err := suite.settings.CallbackRegistry.acquire(cbk)
+		if err == nil {
+			releaseSlot()
+			break
+		}
+		suite.Require().True(i < 1000, "in-flight slot wasn't released")
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_messageHandlerUnknownMessage() {
+	ctx := context.Background()
+	awsClient := awsClient{}
+	msgJSON := suite.unknownMessageJSON()
+
+	err := awsClient.messageHandler(ctx, suite.settings, msgJSON, &messageDelivery{throttle: true}, nil)
+	suite.EqualError(err, "invalid message, unable to unmarshal: message data factory is not defined for message")
+	suite.False(isPermanentError(suite.settings, err))
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_messageHandlerFallbackDiscard() {
+	ctx := context.Background()
+	awsClient := awsClient{}
+	logger := &fakeLogger{}
+	suite.settings.GetLogger = func(_ context.Context) Logger { return logger }
+	msgJSON := suite.unknownMessageJSON()
+	suite.settings.CallbackRegistry.SetFallbackPolicy(FallbackDiscard)
+
+	err := awsClient.messageHandler(ctx, suite.settings, msgJSON, &messageDelivery{throttle: true}, nil)
+	suite.NoError(err)
+	suite.Require().Equal(1, len(logger.logs))
+	suite.Equal("Discarding message without callback", logger.logs[0].message)
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_messageHandlerFallbackDeadLetter() {
+	ctx := context.Background()
+	awsClient := awsClient{}
+	msgJSON := suite.unknownMessageJSON()
+	suite.settings.CallbackRegistry.SetFallbackPolicy(FallbackDeadLetter)
+
+	err := awsClient.messageHandler(ctx, suite.settings, msgJSON, &messageDelivery{throttle: true}, nil)
+	suite.EqualError(err, "callback function is not defined for message")
+	suite.True(isPermanentError(suite.settings, err))
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_messageHandlerFallbackCallback() {
+	ctx := context.Background()
+	awsClient := awsClient{}
+	msgJSON := suite.unknownMessageJSON()
+	suite.settings.CallbackRegistry.RegisterFallbackCallback(suite.fakeCallback.Callback)
+	suite.fakeCallback.On("Callback", mock.AnythingOfType("*context.valueCtx"), mock.Anything).Return(nil)
+
+	err := awsClient.messageHandler(ctx, suite.settings, msgJSON, &messageDelivery{throttle: true}, nil)
+	suite.NoError(err)
+
+	suite.fakeCallback.AssertExpectations(suite.T())
+	msg := suite.fakeCallback.Calls[0].Arguments.Get(1).(*Message)
+	suite.Equal("vehicle_created", msg.dataType)
+	suite.JSONEq(`{"vehicle_id": "C_1234567890123456"}`, string(msg.Data.(json.RawMessage)))
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_messageHandlerAnyMajorVersion() {
+	ctx := context.Background()
+	awsClient := awsClient{}
+	msgJSON := suite.unknownMessageJSON()
+	suite.settings.CallbackRegistry.RegisterCallback(
+		CallbackKey{MessageType: "vehicle_created", MessageMajorVersion: AnyMajorVersion},
+		suite.fakeCallback.Callback, func() interface{} { return new(FakeHedwigDataField) })
+	suite.fakeCallback.On("Callback", mock.AnythingOfType("*context.valueCtx"), mock.Anything).Return(nil)
+
+	err := awsClient.messageHandler(ctx, suite.settings, msgJSON, &messageDelivery{throttle: true}, nil)
+	suite.NoError(err)
+
+	suite.fakeCallback.AssertExpectations(suite.T())
+	msg := suite.fakeCallback.Calls[0].Arguments.Get(1).(*Message)
+	suite.Equal("C_1234567890123456", msg.Data.(*FakeHedwigDataField).VehicleID)
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_messageHandlerUpcast() {
+	ctx := context.Background()
+	awsClient := awsClient{}
+
+	data := &fakeTripCreatedV1{VehicleID: "C_1234567890123456", UserID: "U_1234567890123456"}
+	message, err := NewMessage(suite.settings, "trip_created", "1.1", nil, data)
+	suite.Require().NoError(err)
+	msgJSON, err := message.JSONString()
+	suite.Require().NoError(err)
+
+	suite.settings.ConverterRegistry = newTestConverterRegistry(suite.T())
+	suite.settings.CallbackRegistry.RegisterCallback(
+		CallbackKey{MessageType: "trip_created", MessageMajorVersion: 2},
+		suite.fakeCallback.Callback, func() interface{} { return new(fakeTripCreatedV2) })
+	suite.fakeCallback.On("Callback", mock.AnythingOfType("*context.valueCtx"), mock.Anything).Return(nil)
+
+	err = awsClient.messageHandler(ctx, suite.settings, msgJSON, &messageDelivery{throttle: true}, nil)
+	suite.NoError(err)
+
+	suite.fakeCallback.AssertExpectations(suite.T())
+	msg := suite.fakeCallback.Calls[0].Arguments.Get(1).(*Message)
+	suite.Equal(message.ID, msg.ID)
+	suite.Equal("2.0", msg.DataSchemaVersion.Original())
+	suite.Equal(&fakeTripCreatedV2{
+		VehicleID: data.VehicleID,
+		UserID:    data.UserID,
+		VIN:       "00000000000000000",
+	}, msg.Data)
+}
+
+func (suite *AWSClientTestSuite) TestAWSClient_messageHandlerUpcastInvalid() {
+	ctx := context.Background()
+	awsClient := awsClient{}
+
+	// the message is missing the user id required by the v1 schema
+	data := &fakeTripCreatedV1{VehicleID: "C_1234567890123456"}
+	message, err := NewMessage(suite.settings, "trip_created", "1.1", nil, data)
+	suite.Require().NoError(err)
+	msgJSON, err := message.JSONString()
+	suite.Require().NoError(err)
+
+	converted := false
+	suite.settings.ConverterRegistry = NewConverterRegistry()
+	err = suite.settings.ConverterRegistry.RegisterConverter("trip_created", 1, "2.0",
+		func() interface{} { return new(fakeTripCreatedV1) },
+		func(_ context.Context, data interface{}) (interface{}, error) {
+			converted = true
+			v1 := data.(*fakeTripCreatedV1)
+			return &fakeTripCreatedV2{VehicleID: v1.VehicleID, UserID: "U_1234567890123456"}, nil
+		})
+	suite.Require().NoError(err)
+	suite.settings.CallbackRegistry.RegisterCallback(
+		CallbackKey{MessageType: "trip_created", MessageMajorVersion: 2},
+		suite.fakeCallback.Callback, func() interface{} { return new(fakeTripCreatedV2) })
+
+	err = awsClient.messageHandler(ctx, suite.settings, msgJSON, &messageDelivery{throttle: true}, nil)
+	suite.Contains(err.Error(), "message failed validation before conversion")
+	suite.True(isPermanentError(suite.settings, err))
+	suite.False(converted)
+	suite.fakeCallback.AssertNotCalled(suite.T(), "Callback", mock.Anything, mock.Anything)
+}
+
 func (suite *AWSClientTestSuite) TestAWSClient_messageHandlerFailsOnBadJSON() {
 	ctx := context.Background()
 	awsClient := awsClient{}
 	receipt := uuid.NewV4().String()
 	messageJSON := "bad json-"
-	err := awsClient.messageHandler(ctx, suite.settings, string(messageJSON), receipt, nil)
+	err := awsClient.messageHandler(ctx, suite.settings, string(messageJSON),
+		&messageDelivery{receipt: receipt, throttle: true}, nil)
 	suite.NotNil(err)
 }
 
@@ -0,0 +1,233 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultBatchMaxSize = 10
+	defaultBatchMaxWait = time.Second
+)
+
+// BatchResult is the outcome of a batch callback
+type BatchResult struct {
+	// Err fails every message of the batch
+	Err error
+
+	// Errors holds the error for each message of the batch, in the same order as the messages. A nil slice means
+	// every message succeeded, unless Err is set.
+	Errors []error
+}
+
+// errorAt returns the error for the i-th message of a batch of n messages
+func (r *BatchResult) errorAt(i int, n int) error {
+	switch {
+	case r.Err != nil:
+		return r.Err
+	case r.Errors == nil:
+		return nil
+	case len(r.Errors) != n:
+		return errors.Errorf("batch callback returned %d results for %d messages", len(r.Errors), n)
+	}
+	return r.Errors[i]
+}
+
+// BatchCallbackFunction is the function signature for a hedwig callback function that processes several messages
+// at once
+type BatchCallbackFunction func(context.Context, []*Message) BatchResult
+
+// BatchLimits determines how messages are accumulated into batches. Limits are enforced per consumer process.
+type BatchLimits struct {
+	// Maximum number of messages in a batch. Defaults to 10.
+	MaxSize int
+
+	// Maximum time to wait for a batch to fill up, counting from its first message. Defaults to 1 second. Queue
+	// consumers don't wait once every message received with the batch is waiting in a batch, since the next messages
+	// are only received after these are processed.
+	MaxWait time.Duration
+}
+
+// pendingBatch is a batch of messages waiting for the batch callback
+type pendingBatch struct {
+	ctx           context.Context
+	messages      []*Message
+	timer         *time.Timer
+	recoverPanics bool
+	result        BatchResult
+	done          chan struct{}
+}
+
+// pollTracker counts the messages received together that are still being processed, and aren't waiting in a batch.
+// The next poll waits for every message of a poll, so batches can't fill up with messages that weren't received yet,
+// and are flushed as soon as every message still being processed is waiting in one.
+type pollTracker struct {
+	lock     sync.Mutex
+	active   int
+	batchers map[*callbackBatcher]bool
+}
+
+func newPollTracker(size int) *pollTracker {
+	return &pollTracker{active: size, batchers: map[*callbackBatcher]bool{}}
+}
+
+func (t *pollTracker) withContext(ctx context.Context) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, pollTrackerKey, t)
+}
+
+// trackerFromContext returns the tracker of the poll the message being processed was received with, if any
+func trackerFromContext(ctx context.Context) *pollTracker {
+	tracker, _ := ctx.Value(pollTrackerKey).(*pollTracker)
+	return tracker
+}
+
+// done is called once a message of the poll is processed
+func (t *pollTracker) done() {
+	t.update(-1, nil)
+}
+
+// wait is called when a message of the poll is submitted to the batcher
+func (t *pollTracker) wait(batcher *callbackBatcher) {
+	t.update(-1, batcher)
+}
+
+// resume is called when a message of the poll is done waiting for its batch
+func (t *pollTracker) resume() {
+	t.update(1, nil)
+}
+
+func (t *pollTracker) update(delta int, batcher *callbackBatcher) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	t.active += delta
+	if batcher != nil {
+		t.batchers[batcher] = true
+	}
+	var flush []*callbackBatcher
+	if t.active == 0 {
+		for batcher := range t.batchers {
+			flush = append(flush, batcher)
+		}
+		t.batchers = map[*callbackBatcher]bool{}
+	}
+	t.lock.Unlock()
+	for _, batcher := range flush {
+		batcher.flushPending()
+	}
+}
+
+// callbackBatcher accumulates messages processed concurrently into batches for a batch callback
+type callbackBatcher struct {
+	lock     sync.Mutex
+	callback BatchCallbackFunction
+	limits   BatchLimits
+	pending  *pendingBatch
+}
+
+func newCallbackBatcher(cbf BatchCallbackFunction, limits *BatchLimits) *callbackBatcher {
+	b := &callbackBatcher{callback: cbf}
+	if limits != nil {
+		b.limits = *limits
+	}
+	if b.limits.MaxSize <= 0 {
+		b.limits.MaxSize = defaultBatchMaxSize
+	}
+	if b.limits.MaxWait <= 0 {
+		b.limits.MaxWait = defaultBatchMaxWait
+	}
+	return b
+}
+
+// submit adds a message to the pending batch, and waits for the batch callback to process it. It's a
+// CallbackFunction, so messages go through middleware, timeouts and acknowledgement individually.
+func (b *callbackBatcher) submit(ctx context.Context, message *Message) error {
+	b.lock.Lock()
+	batch := b.pending
+	if batch == nil {
+		// the batch callback runs with the context of the first message, without its acknowledgement handle,
+		// message, deferred publisher and poll, which only apply to that message
+		batchCtx := context.WithValue(context.WithValue(ctx, acknowledgerKey, nil), messageKey, nil)
+		batchCtx = context.WithValue(context.WithValue(batchCtx, deferredPublisherKey, nil), pollTrackerKey, nil)
+		batch = &pendingBatch{
+			ctx:           batchCtx,
+			recoverPanics: recoverPanics(ctx),
+			done:          make(chan struct{}),
+		}
+		batch.timer = time.AfterFunc(b.limits.MaxWait, func() { b.flush(batch) })
+		b.pending = batch
+	}
+	i := len(batch.messages)
+	batch.messages = append(batch.messages, message)
+	full := len(batch.messages) >= b.limits.MaxSize
+	if full {
+		batch.timer.Stop()
+		b.pending = nil
+	}
+	b.lock.Unlock()
+
+	tracker := trackerFromContext(ctx)
+	tracker.wait(b)
+	defer tracker.resume()
+	if full {
+		b.exec(batch)
+	}
+	select {
+	case <-batch.done:
+		return batch.result.errorAt(i, len(batch.messages))
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flushPending runs the batch callback for the pending batch, if any
+func (b *callbackBatcher) flushPending() {
+	b.lock.Lock()
+	batch := b.pending
+	b.lock.Unlock()
+	if batch != nil {
+		batch.timer.Stop()
+		b.flush(batch)
+	}
+}
+
+// flush runs the batch callback for a batch that isn't full
+func (b *callbackBatcher) flush(batch *pendingBatch) {
+	b.lock.Lock()
+	if b.pending != batch {
+		// already full, or flushed
+		b.lock.Unlock()
+		return
+	}
+	b.pending = nil
+	b.lock.Unlock()
+	b.exec(batch)
+}
+
+func (b *callbackBatcher) exec(batch *pendingBatch) {
+	defer close(batch.done)
+	if batch.recoverPanics {
+		defer func() {
+			// the batch may run on a timer goroutine, where a panic can't be recovered by the consumer
+			if r := recover(); r != nil {
+				batch.result = BatchResult{Err: &PanicError{Value: r, Stack: debug.Stack()}}
+			}
+		}()
+	}
+	batch.result = b.callback(batch.ctx, batch.messages)
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// submitAll submits messages concurrently, and returns the error for each message
+func submitAll(ctx context.Context, batcher *callbackBatcher, messages []*Message) []error {
+	errs := make([]error, len(messages))
+	wg := sync.WaitGroup{}
+	for i := range messages {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = batcher.submit(ctx, messages[i])
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func newTestBatchMessages(n int) []*Message {
+	messages := make([]*Message, n)
+	for i := range messages {
+		messages[i] = &Message{ID: string(rune('a' + i))}
+	}
+	return messages
+}
+
+func TestCallbackBatcher_MaxSize(t *testing.T) {
+	ctx := context.Background()
+	lock := sync.Mutex{}
+	var batches [][]*Message
+	batcher := newCallbackBatcher(func(ctx context.Context, messages []*Message) BatchResult {
+		assert.Nil(t, Acknowledger(ctx))
+		lock.Lock()
+		defer lock.Unlock()
+		batches = append(batches, messages)
+		return BatchResult{}
+	}, &BatchLimits{MaxSize: 2, MaxWait: time.Hour})
+
+	errs := submitAll(ctx, batcher, newTestBatchMessages(4))
+	assert.Equal(t, []error{nil, nil, nil, nil}, errs)
+	require.Len(t, batches, 2)
+	assert.Len(t, batches[0], 2)
+	assert.Len(t, batches[1], 2)
+}
+
+func TestCallbackBatcher_MaxWait(t *testing.T) {
+	ctx := context.Background()
+	calls := 0
+	batcher := newCallbackBatcher(func(ctx context.Context, messages []*Message) BatchResult {
+		calls++
+		assert.Len(t, messages, 3)
+		return BatchResult{}
+	}, &BatchLimits{MaxSize: 10, MaxWait: 50 * time.Millisecond})
+
+	errs := submitAll(ctx, batcher, newTestBatchMessages(3))
+	assert.Equal(t, []error{nil, nil, nil}, errs)
+	assert.Equal(t, 1, calls)
+}
+
+func TestCallbackBatcher_PerMessageErrors(t *testing.T) {
+	ctx := context.Background()
+	batcher := newCallbackBatcher(func(ctx context.Context, messages []*Message) BatchResult {
+		result := BatchResult{Errors: make([]error, len(messages))}
+		for i, message := range messages {
+			if message.ID == "b" {
+				result.Errors[i] = ErrRetry
+			}
+		}
+		return result
+	}, &BatchLimits{MaxSize: 3})
+
+	messages := newTestBatchMessages(3)
+	errs := submitAll(ctx, batcher, messages)
+	assert.NoError(t, errs[0])
+	assert.Equal(t, ErrRetry, errs[1])
+	assert.NoError(t, errs[2])
+}
+
+func TestCallbackBatcher_Err(t *testing.T) {
+	ctx := context.Background()
+	batcher := newCallbackBatcher(func(ctx context.Context, messages []*Message) BatchResult {
+		return BatchResult{Err: errors.New("warehouse unavailable")}
+	}, &BatchLimits{MaxSize: 2})
+
+	errs := submitAll(ctx, batcher, newTestBatchMessages(2))
+	assert.EqualError(t, errs[0], "warehouse unavailable")
+	assert.EqualError(t, errs[1], "warehouse unavailable")
+}
+
+func TestCallbackBatcher_ResultSizeMismatch(t *testing.T) {
+	ctx := context.Background()
+	batcher := newCallbackBatcher(func(ctx context.Context, messages []*Message) BatchResult {
+		return BatchResult{Errors: []error{nil}}
+	}, &BatchLimits{MaxSize: 2})
+
+	errs := submitAll(ctx, batcher, newTestBatchMessages(2))
+	assert.EqualError(t, errs[0], "batch callback returned 1 results for 2 messages")
+	assert.EqualError(t, errs[1], "batch callback returned 1 results for 2 messages")
+}
+
+func TestCallbackBatcher_Panic(t *testing.T) {
+	ctx := context.Background()
+	batcher := newCallbackBatcher(func(ctx context.Context, messages []*Message) BatchResult {
+		panic("oops")
+	}, &BatchLimits{MaxSize: 10, MaxWait: time.Millisecond})
+
+	err := batcher.submit(ctx, &Message{})
+	require.IsType(t, &PanicError{}, err)
+	assert.Equal(t, "oops", err.(*PanicError).Value)
+}
+
+func TestCallbackBatcher_PanicRecoveryDisabled(t *testing.T) {
+	ctx := withPanicRecovery(context.Background(), &Settings{DisablePanicRecovery: true})
+	batcher := newCallbackBatcher(func(ctx context.Context, messages []*Message) BatchResult {
+		panic("batch panic")
+	}, &BatchLimits{MaxSize: 1, MaxWait: time.Hour})
+
+	assert.Panics(t, func() { _ = batcher.submit(ctx, newTestBatchMessages(1)[0]) })
+}
+
+func TestCallbackBatcher_PollFlush(t *testing.T) {
+	lock := sync.Mutex{}
+	var batches [][]*Message
+	batcher := newCallbackBatcher(func(ctx context.Context, messages []*Message) BatchResult {
+		assert.Nil(t, trackerFromContext(ctx))
+		lock.Lock()
+		defer lock.Unlock()
+		batches = append(batches, messages)
+		return BatchResult{}
+	}, &BatchLimits{MaxSize: 10, MaxWait: time.Hour})
+
+	// one message of the poll finishes without submitting, the others are flushed without waiting for MaxWait
+	poll := newPollTracker(3)
+	ctx := poll.withContext(context.Background())
+	poll.done()
+	errs := submitAll(ctx, batcher, newTestBatchMessages(2))
+	assert.Equal(t, []error{nil, nil}, errs)
+	require.Len(t, batches, 1)
+	assert.Len(t, batches[0], 2)
+}
+
+func TestCallbackBatcher_PollFlushOnDone(t *testing.T) {
+	calls := 0
+	batcher := newCallbackBatcher(func(ctx context.Context, messages []*Message) BatchResult {
+		calls++
+		assert.Len(t, messages, 1)
+		return BatchResult{}
+	}, &BatchLimits{MaxSize: 10, MaxWait: time.Hour})
+
+	// the batch is flushed once the last message of the poll still being processed finishes
+	poll := newPollTracker(2)
+	ctx := poll.withContext(context.Background())
+	errs := make(chan error)
+	go func() { errs <- batcher.submit(ctx, newTestBatchMessages(1)[0]) }()
+	time.Sleep(10 * time.Millisecond)
+	poll.done()
+	select {
+	case err := <-errs:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("batch wasn't flushed")
+	}
+	assert.Equal(t, 1, calls)
+}
+
+func TestCallbackBatcher_ContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	batcher := newCallbackBatcher(func(ctx context.Context, messages []*Message) BatchResult {
+		return BatchResult{}
+	}, &BatchLimits{MaxSize: 10, MaxWait: time.Hour})
+
+	assert.Equal(t, context.Canceled, batcher.submit(ctx, &Message{}))
+}
+
+func TestCallbackRegistry_RegisterBatchCallback(t *testing.T) {
+	registry := NewCallbackRegistry()
+	cbk := CallbackKey{MessageType: "trip_created", MessageMajorVersion: 1}
+	var received []*Message
+	registry.RegisterBatchCallback(cbk, func(ctx context.Context, messages []*Message) BatchResult {
+		received = messages
+		return BatchResult{}
+	}, nil, &BatchLimits{MaxSize: 1})
+
+	callback, err := registry.getCallbackFunction(cbk)
+	require.NoError(t, err)
+	message := &Message{ID: "123"}
+	assert.NoError(t, callback(context.Background(), message))
+	assert.Equal(t, []*Message{message}, received)
+}
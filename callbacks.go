@@ -10,6 +10,7 @@ package hedwig
 import (
 	"context"
 	"errors"
+	"time"
 )
 
 // CallbackKey is a key identifying a hedwig callback
@@ -20,6 +21,27 @@ type CallbackKey struct {
 	MessageMajorVersion int
 }
 
+// AnyMajorVersion may be used as CallbackKey.MessageMajorVersion to register a callback for every major version of a
+// message type. Callbacks registered for a specific major version take precedence.
+const AnyMajorVersion = -1
+
+// FallbackPolicy determines how messages without a registered callback are handled
+type FallbackPolicy int
+
+const (
+	// FallbackRetry fails the message, so it's retried until it's dead-lettered by SQS redrive
+	FallbackRetry FallbackPolicy = iota
+	// FallbackDiscard logs and acknowledges the message
+	FallbackDiscard
+	// FallbackDeadLetter sends the message to the dead-letter queue right away
+	FallbackDeadLetter
+	// FallbackCallback calls the fallback callback. Message data is a json.RawMessage, and isn't validated.
+	FallbackCallback
+)
+
+// errUnknownCallback is returned when no callback is registered for a message
+var errUnknownCallback = errors.New("callback function is not defined for message")
+
 // CallbackFunction is the function signature for a hedwig callback function
 type CallbackFunction func(context.Context, *Message) error
 
@@ -28,37 +50,133 @@ type NewData func() interface{}
 
 // CallbackRegistry maps hedwig messages to callback functions and callback datas
 type CallbackRegistry struct {
-	datas     map[CallbackKey]NewData
-	functions map[CallbackKey]CallbackFunction
+	datas      map[CallbackKey]NewData
+	functions  map[CallbackKey]CallbackFunction
+	middleware map[CallbackKey][]CallbackMiddleware
+	timeouts   map[CallbackKey]time.Duration
+	limiters   map[CallbackKey]*callbackLimiter
+	maxAges    map[CallbackKey]time.Duration
+
+	fallbackPolicy   FallbackPolicy
+	fallbackCallback CallbackFunction
 }
 
 // NewCallbackRegistry creates a callback registry
 func NewCallbackRegistry() *CallbackRegistry {
 	return &CallbackRegistry{
-		datas:     map[CallbackKey]NewData{},
-		functions: map[CallbackKey]CallbackFunction{},
+		datas:      map[CallbackKey]NewData{},
+		functions:  map[CallbackKey]CallbackFunction{},
+		middleware: map[CallbackKey][]CallbackMiddleware{},
+		timeouts:   map[CallbackKey]time.Duration{},
+		limiters:   map[CallbackKey]*callbackLimiter{},
+		maxAges:    map[CallbackKey]time.Duration{},
 	}
 }
 
 // RegisterCallback registers the given callback function to the given message type and message major version.
-// Required for consumers. An error will be returned if an incoming message is missing a callback.
+// Required for consumers. Use AnyMajorVersion to register the callback for every major version. Incoming messages
+// missing a callback are handled as per the fallback policy.
 func (cr *CallbackRegistry) RegisterCallback(cbk CallbackKey, cbf CallbackFunction, newData NewData) {
 	cr.functions[cbk] = cbf
 	cr.datas[cbk] = newData
 }
 
+// RegisterBatchCallback registers the given batch callback function to the given message type and message major
+// version. Messages processed concurrently are accumulated into batches as per the given limits, or the defaults
+// if nil, and each message succeeds or fails individually as per the batch result. Middleware, timeouts, idempotency
+// and callback limits apply to each message.
+func (cr *CallbackRegistry) RegisterBatchCallback(cbk CallbackKey, cbf BatchCallbackFunction, newData NewData,
+	limits *BatchLimits) {
+
+	cr.RegisterCallback(cbk, newCallbackBatcher(cbf, limits).submit, newData)
+}
+
+// RegisterMiddleware adds middleware around the callback function for the given message type and message major
+// version. Middleware registered in settings wrap around these.
+func (cr *CallbackRegistry) RegisterMiddleware(cbk CallbackKey, middleware ...CallbackMiddleware) {
+	cr.middleware[cbk] = append(cr.middleware[cbk], middleware...)
+}
+
+// SetCallbackTimeout sets the time the callback for the given message type and message major version is allowed
+// to run for, overriding settings.CallbackTimeout.
+func (cr *CallbackRegistry) SetCallbackTimeout(cbk CallbackKey, timeout time.Duration) {
+	cr.timeouts[cbk] = timeout
+}
+
+// SetMaxAge sets the age, counting from the message timestamp, after which messages for the given message type and
+// message major version expire. Expired messages are handled as per settings.ExpiryPolicy instead of reaching the
+// callback. Messages with a shorter TTL header expire earlier.
+func (cr *CallbackRegistry) SetMaxAge(cbk CallbackKey, maxAge time.Duration) {
+	cr.maxAges[cbk] = maxAge
+}
+
+// SetCallbackLimits limits how fast messages for the given message type and message major version are processed.
+// Messages over the limits are deferred by changing their visibility timeout, so they don't hold up other messages.
+// Deferred messages count towards the queue's max receive count. Limits are only enforced by SQS consumers.
+func (cr *CallbackRegistry) SetCallbackLimits(cbk CallbackKey, limits *CallbackLimits) {
+	cr.limiters[cbk] = newCallbackLimiter(limits)
+}
+
+// acquire admits a message for the given callback, if it's under the callback limits. The returned function must
+// be called once the message is processed.
+func (cr *CallbackRegistry) acquire(cbk CallbackKey) (func(), error) {
+	cbk, _ = cr.resolve(cbk)
+	limiter, ok := cr.limiters[cbk]
+	if !ok {
+		return func() {}, nil
+	}
+	return limiter.acquire(time.Now())
+}
+
+// SetFallbackPolicy sets how messages without a registered callback are handled. Defaults to FallbackRetry.
+func (cr *CallbackRegistry) SetFallbackPolicy(policy FallbackPolicy) {
+	cr.fallbackPolicy = policy
+}
+
+// RegisterFallbackCallback registers the callback function called for messages without a registered callback, and
+// sets the fallback policy to FallbackCallback. Message data is passed as a json.RawMessage.
+func (cr *CallbackRegistry) RegisterFallbackCallback(cbf CallbackFunction) {
+	cr.fallbackCallback = cbf
+	cr.fallbackPolicy = FallbackCallback
+}
+
+// resolve returns the key the callback for a message is registered with, which may be for any major version
+func (cr *CallbackRegistry) resolve(cbk CallbackKey) (CallbackKey, bool) {
+	if _, ok := cr.functions[cbk]; ok {
+		return cbk, true
+	}
+	anyVersion := CallbackKey{MessageType: cbk.MessageType, MessageMajorVersion: AnyMajorVersion}
+	if _, ok := cr.functions[anyVersion]; ok {
+		return anyVersion, true
+	}
+	return cbk, false
+}
+
 func (cr *CallbackRegistry) getCallbackFunction(cbk CallbackKey) (CallbackFunction, error) {
-	fn, ok := cr.functions[cbk]
+	cbk, ok := cr.resolve(cbk)
 	if !ok {
-		return nil, errors.New("callback function is not defined for message")
+		return nil, errUnknownCallback
 	}
-	return fn, nil
+	return chainMiddleware(cr.functions[cbk], cr.middleware[cbk]...), nil
 }
 
 func (cr *CallbackRegistry) getMessageDataFactory(cbk CallbackKey) (NewData, error) {
+	cbk, _ = cr.resolve(cbk)
 	d, ok := cr.datas[cbk]
 	if !ok {
 		return nil, errors.New("message data factory is not defined for message")
 	}
 	return d, nil
 }
+
+func (cr *CallbackRegistry) getMaxAge(cbk CallbackKey) (time.Duration, bool) {
+	cbk, _ = cr.resolve(cbk)
+	maxAge, ok := cr.maxAges[cbk]
+	return maxAge, ok
+}
+
+func (cr *CallbackRegistry) getCallbackTimeout(cbk CallbackKey) (time.Duration, bool) {
+	cbk, _ = cr.resolve(cbk)
+	timeout, ok := cr.timeouts[cbk]
+	return timeout, ok
+}
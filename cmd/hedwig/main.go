@@ -0,0 +1,178 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+// Command hedwig provides tools to operate hedwig queues.
+//
+// Usage:
+//
+//	hedwig dlq list -queue DEV-MYAPP [-type vehicle_created] [-publisher myapp] [-after 2019-01-01T00:00:00Z] \
+//	    [-before 2019-01-02T00:00:00Z] [-header request_id=abc] [-max 100]
+//	hedwig dlq inspect -queue DEV-MYAPP -id <sqs message id>
+//	hedwig dlq requeue -queue DEV-MYAPP [filters...] [-max 100] [-rate 10] [-dry-run]
+//	hedwig dlq purge -queue DEV-MYAPP -yes
+//
+// AWS credentials and region are read from the standard AWS environment variables.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Automatic/hedwig-go"
+)
+
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	return fmt.Sprintf("%v", map[string]string(h))
+}
+
+func (h headerFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid header, expected key=value: %s", value)
+	}
+	h[parts[0]] = parts[1]
+	return nil
+}
+
+type timeFlag struct {
+	time.Time
+}
+
+func (t *timeFlag) String() string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (t *timeFlag) Set(value string) error {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return err
+	}
+	t.Time = parsed
+	return nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: hedwig dlq <list|inspect|requeue|purge> [flags]")
+	os.Exit(2)
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	os.Exit(1)
+}
+
+func printJSON(v interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		fail(err)
+	}
+}
+
+func main() {
+	if len(os.Args) < 3 || os.Args[1] != "dlq" {
+		usage()
+	}
+	command := os.Args[2]
+
+	flags := flag.NewFlagSet("hedwig dlq "+command, flag.ExitOnError)
+	queue := flags.String("queue", "", "hedwig queue name, excluding the HEDWIG- prefix")
+	dlq := flags.String("dlq", "", "dead-letter queue name, excluding the HEDWIG- prefix (default <queue>-DLQ)")
+	region := flags.String("region", os.Getenv("AWS_REGION"), "AWS region")
+	messageType := flags.String("type", "", "only match messages of this type")
+	publisher := flags.String("publisher", "", "only match messages from this publisher")
+	headers := headerFlags{}
+	flags.Var(headers, "header", "only match messages with this header, as key=value (may be repeated)")
+	var after, before timeFlag
+	flags.Var(&after, "after", "only match messages published at or after this time (RFC 3339)")
+	flags.Var(&before, "before", "only match messages published before this time (RFC 3339)")
+	maxMessages := flags.Int("max", 0, "maximum number of messages (default all)")
+	id := flags.String("id", "", "SQS message id to inspect")
+	rate := flags.Float64("rate", 0, "maximum number of messages requeued per second (default unlimited)")
+	dryRun := flags.Bool("dry-run", false, "only print the messages that would be requeued")
+	yes := flags.Bool("yes", false, "confirm purging the dead-letter queue")
+	if err := flags.Parse(os.Args[3:]); err != nil {
+		fail(err)
+	}
+	if *queue == "" {
+		fail(fmt.Errorf("-queue is required"))
+	}
+
+	settings := &hedwig.Settings{
+		AWSRegion:           *region,
+		AWSAccessKey:        os.Getenv("AWS_ACCESS_KEY_ID"),
+		AWSSecretKey:        os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		AWSSessionToken:     os.Getenv("AWS_SESSION_TOKEN"),
+		DeadLetterQueueName: *dlq,
+		QueueName:           *queue,
+	}
+	deadLetterQueue := hedwig.NewDeadLetterQueue(hedwig.NewAWSSessionsCache(), settings)
+
+	filter := &hedwig.DeadLetterFilter{
+		MessageType: *messageType,
+		Publisher:   *publisher,
+		After:       after.Time,
+		Before:      before.Time,
+		Headers:     headers,
+	}
+	ctx := context.Background()
+
+	switch command {
+	case "list":
+		messages, err := deadLetterQueue.List(ctx, filter, *maxMessages)
+		if err != nil {
+			fail(err)
+		}
+		printJSON(messages)
+	case "inspect":
+		if *id == "" {
+			fail(fmt.Errorf("-id is required"))
+		}
+		message, err := deadLetterQueue.Inspect(ctx, *id)
+		if err != nil {
+			fail(err)
+		}
+		printJSON(message)
+	case "requeue":
+		messages, err := deadLetterQueue.Requeue(ctx, &hedwig.RequeueRequest{
+			Filter:      filter,
+			MaxMessages: *maxMessages,
+			RateLimit:   *rate,
+			DryRun:      *dryRun,
+		})
+		for _, message := range messages {
+			fmt.Println(message.SQSMessageID)
+		}
+		if *dryRun {
+			fmt.Fprintf(os.Stderr, "%d message(s) would be requeued\n", len(messages))
+		} else {
+			fmt.Fprintf(os.Stderr, "%d message(s) requeued\n", len(messages))
+		}
+		if err != nil {
+			fail(err)
+		}
+	case "purge":
+		if !*yes {
+			fail(fmt.Errorf("-yes is required to purge the dead-letter queue"))
+		}
+		if err := deadLetterQueue.Purge(ctx); err != nil {
+			fail(err)
+		}
+	default:
+		usage()
+	}
+}
@@ -17,7 +17,7 @@ import (
 // ListenRequest represents a request to listen for messages
 type ListenRequest struct {
 	NumMessages        uint32 // default 1
-	VisibilityTimeoutS uint32 // defaults to queue configuration
+	VisibilityTimeoutS uint32 // defaults to queue configuration; if set, also limits callback run time
 	LoopCount          uint32 // defaults to infinite loops
 }
 
@@ -30,13 +30,24 @@ type IQueueConsumer interface {
 	// 2. Set a deadline on the context of less than 10 seconds - returns after processing current messages.
 	// 3. Run for limited number of loops by setting LoopCount on the request - returns after running loop a finite
 	// number of times
+	// 4. Call Shutdown - returns after in-flight messages are processed.
 	ListenForMessages(ctx context.Context, request *ListenRequest) error
+
+	// Shutdown gracefully stops the listener. Polling for new messages stops right away, and in-flight messages
+	// are given until the context deadline to finish processing (settings.ShutdownTimeout if the context has no
+	// deadline). Returns an AbandonedMessagesError listing messages that didn't finish in time.
+	Shutdown(ctx context.Context) error
 }
 
 // ILambdaConsumer represents a lambda event consumer
 type ILambdaConsumer interface {
 	// HandleLambdaInput processes hedwig messages for the provided message types for Lambda apps
 	HandleLambdaEvent(ctx context.Context, snsEvent events.SNSEvent) error
+
+	// HandleLambdaSQSEvent processes hedwig messages delivered to Lambda by an SQS event source. Failed records are
+	// reported in the response, so only those are retried. This requires ReportBatchItemFailures to be enabled on
+	// the event source mapping.
+	HandleLambdaSQSEvent(ctx context.Context, sqsEvent events.SQSEvent) (*SQSEventResponse, error)
 }
 
 const sqsWaitTimeoutSeconds int64 = 20
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+
+	"github.com/Masterminds/semver"
+	"github.com/pkg/errors"
+)
+
+// ConvertFunction converts message data from one major version of a message type to another
+type ConvertFunction func(ctx context.Context, data interface{}) (interface{}, error)
+
+type converterKey struct {
+	messageType      string
+	fromMajorVersion int
+	toMajorVersion   int
+}
+
+type converter struct {
+	toVersion string
+	newData   NewData
+	fn        ConvertFunction
+}
+
+// ConverterRegistry maps hedwig messages to functions converting them between major versions
+type ConverterRegistry struct {
+	converters map[converterKey]*converter
+}
+
+// NewConverterRegistry creates a converter registry
+func NewConverterRegistry() *ConverterRegistry {
+	return &ConverterRegistry{
+		converters: map[converterKey]*converter{},
+	}
+}
+
+// RegisterConverter registers the function converting data of the given message type from the given major version
+// to the given version, e.g. "2.0". newData returns a pointer to the data struct of the source major version; it's
+// used to deserialize messages that are upcast by consumers.
+//
+// Consumers without a callback for a message's major version convert it to a major version that has a callback.
+// Publishers may convert messages to publish them on legacy topics, using Message.Convert.
+func (cr *ConverterRegistry) RegisterConverter(messageType string, fromMajorVersion int, toVersion string,
+	newData NewData, fn ConvertFunction) error {
+
+	version, err := semver.NewVersion(toVersion)
+	if err != nil {
+		return errors.Wrapf(err, "invalid version: %s", toVersion)
+	}
+	key := converterKey{
+		messageType:      messageType,
+		fromMajorVersion: fromMajorVersion,
+		toMajorVersion:   int(version.Major()),
+	}
+	cr.converters[key] = &converter{
+		toVersion: toVersion,
+		newData:   newData,
+		fn:        fn,
+	}
+	return nil
+}
+
+// upcaster returns the converter from the major version of the message to the highest newer major version that has
+// a registered callback, including AnyMajorVersion callbacks, or nil if there is none
+func (cr *ConverterRegistry) upcaster(callbackRegistry *CallbackRegistry, cbk CallbackKey) *converter {
+	if cr == nil || callbackRegistry == nil {
+		return nil
+	}
+	var best *converter
+	bestVersion := -1
+	for key, converter := range cr.converters {
+		if key.messageType != cbk.MessageType || key.fromMajorVersion != cbk.MessageMajorVersion ||
+			key.toMajorVersion <= key.fromMajorVersion {
+			continue
+		}
+		target := CallbackKey{MessageType: key.messageType, MessageMajorVersion: key.toMajorVersion}
+		if _, ok := callbackRegistry.resolve(target); ok && key.toMajorVersion > bestVersion {
+			best, bestVersion = converter, key.toMajorVersion
+		}
+	}
+	return best
+}
+
+// convert returns a copy of the message converted by the given converter. Both the original and the converted
+// message are validated, each against the schema of its own version.
+func (m *Message) convert(ctx context.Context, settings *Settings, converter *converter) (*Message, error) {
+	if err := m.validate(); err != nil {
+		return nil, Permanent(errors.Wrap(err, "message failed validation before conversion"))
+	}
+	data, err := converter.fn(ctx, m.Data)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to convert message")
+	}
+
+	headers := make(map[string]string, len(m.Metadata.Headers))
+	for k, v := range m.Metadata.Headers {
+		headers[k] = v
+	}
+	metadata := *m.Metadata
+	metadata.Headers = headers
+
+	converted, err := newMessageWithID(settings, m.ID, m.dataType, converter.toVersion, &metadata, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := converted.validate(); err != nil {
+		return nil, Permanent(errors.Wrap(err, "message failed validation after conversion"))
+	}
+	return converted, nil
+}
+
+// Convert returns a copy of the message converted to the given major version, using the converters in
+// settings.ConverterRegistry. This may be used to publish messages on legacy topics. Both the original and the
+// converted message are validated.
+func (m *Message) Convert(ctx context.Context, settings *Settings, majorVersion int) (*Message, error) {
+	if settings.ConverterRegistry == nil {
+		return nil, errors.New("converter registry is required")
+	}
+	key := converterKey{
+		messageType:      m.dataType,
+		fromMajorVersion: int(m.DataSchemaVersion.Major()),
+		toMajorVersion:   majorVersion,
+	}
+	converter, ok := settings.ConverterRegistry.converters[key]
+	if !ok {
+		return nil, errors.Errorf(
+			"converter is not defined for %s from v%d to v%d", key.messageType, key.fromMajorVersion, majorVersion)
+	}
+	return m.convert(ctx, settings, converter)
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeTripCreatedV1 struct {
+	VehicleID string `json:"vehicle_id"`
+	UserID    string `json:"user_id"`
+}
+
+type fakeTripCreatedV2 struct {
+	VehicleID string `json:"vehicle_id"`
+	UserID    string `json:"user_id"`
+	VIN       string `json:"vin"`
+}
+
+func newTestConverterRegistry(t *testing.T) *ConverterRegistry {
+	registry := NewConverterRegistry()
+	err := registry.RegisterConverter("trip_created", 1, "2.0",
+		func() interface{} { return new(fakeTripCreatedV1) },
+		func(_ context.Context, data interface{}) (interface{}, error) {
+			v1 := data.(*fakeTripCreatedV1)
+			return &fakeTripCreatedV2{VehicleID: v1.VehicleID, UserID: v1.UserID, VIN: "00000000000000000"}, nil
+		})
+	require.NoError(t, err)
+	err = registry.RegisterConverter("trip_created", 2, "1.1",
+		func() interface{} { return new(fakeTripCreatedV2) },
+		func(_ context.Context, data interface{}) (interface{}, error) {
+			v2 := data.(*fakeTripCreatedV2)
+			return &fakeTripCreatedV1{VehicleID: v2.VehicleID, UserID: v2.UserID}, nil
+		})
+	require.NoError(t, err)
+	return registry
+}
+
+func TestRegisterConverterInvalidVersion(t *testing.T) {
+	registry := NewConverterRegistry()
+	err := registry.RegisterConverter("trip_created", 1, "two", nil, nil)
+	assert.EqualError(t, err, "invalid version: two: Invalid Semantic Version")
+}
+
+func TestMessageConvert(t *testing.T) {
+	ctx := context.Background()
+	settings := createTestSettings()
+	settings.ConverterRegistry = newTestConverterRegistry(t)
+
+	data := &fakeTripCreatedV2{VehicleID: "C_1234567890123456", UserID: "U_1234567890123456", VIN: "1FTEW1EG5GFA12345"}
+	message, err := NewMessage(settings, "trip_created", "2.0", map[string]string{"request_id": "abc"}, data)
+	require.NoError(t, err)
+
+	converted, err := message.Convert(ctx, settings, 1)
+	require.NoError(t, err)
+	assert.Equal(t, message.ID, converted.ID)
+	assert.Equal(t, "https://hedwig.automatic.com/schema#/schemas/trip_created/1.1", converted.Schema)
+	assert.Equal(t, &fakeTripCreatedV1{VehicleID: data.VehicleID, UserID: data.UserID}, converted.Data)
+	assert.Equal(t, message.Metadata.Headers, converted.Metadata.Headers)
+
+	// original message is untouched
+	converted.Metadata.Headers["request_id"] = "def"
+	assert.Equal(t, "abc", message.Metadata.Headers["request_id"])
+	assert.Equal(t, "https://hedwig.automatic.com/schema#/schemas/trip_created/2.0", message.Schema)
+
+	_, err = message.Convert(ctx, settings, 3)
+	assert.EqualError(t, err, "converter is not defined for trip_created from v2 to v3")
+}
+
+func TestMessageConvertValidation(t *testing.T) {
+	ctx := context.Background()
+	settings := createTestSettings()
+	settings.ConverterRegistry = newTestConverterRegistry(t)
+
+	// invalid source message, which isn't passed to the converter
+	message, err := NewMessage(settings, "trip_created", "2.0", nil, &fakeTripCreatedV2{VehicleID: "C_1234567890123456"})
+	require.NoError(t, err)
+	_, err = message.Convert(ctx, settings, 1)
+	assert.Contains(t, err.Error(), "message failed validation before conversion")
+	assert.True(t, isPermanentError(settings, err))
+
+	// invalid converted message
+	err = settings.ConverterRegistry.RegisterConverter("trip_created", 1, "2.0", nil,
+		func(_ context.Context, data interface{}) (interface{}, error) {
+			return &fakeTripCreatedV2{}, nil
+		})
+	require.NoError(t, err)
+	message, err = NewMessage(settings, "trip_created", "1.0", nil,
+		&fakeTripCreatedV1{VehicleID: "C_1234567890123456", UserID: "U_1234567890123456"})
+	require.NoError(t, err)
+	_, err = message.Convert(ctx, settings, 2)
+	assert.Contains(t, err.Error(), "message failed validation after conversion")
+	assert.True(t, isPermanentError(settings, err))
+
+	// converter error
+	err = settings.ConverterRegistry.RegisterConverter("trip_created", 1, "2.0", nil,
+		func(_ context.Context, data interface{}) (interface{}, error) {
+			return nil, errors.New("my bad")
+		})
+	require.NoError(t, err)
+	_, err = message.Convert(ctx, settings, 2)
+	assert.EqualError(t, err, "failed to convert message: my bad")
+}
+
+func TestConverterRegistryUpcaster(t *testing.T) {
+	converters := newTestConverterRegistry(t)
+	callbacks := NewCallbackRegistry()
+	cbk := CallbackKey{MessageType: "trip_created", MessageMajorVersion: 1}
+
+	assert.Nil(t, converters.upcaster(callbacks, cbk))
+
+	callbacks.RegisterCallback(CallbackKey{MessageType: "trip_created", MessageMajorVersion: 2}, nil, nil)
+	converter := converters.upcaster(callbacks, cbk)
+	require.NotNil(t, converter)
+	assert.Equal(t, "2.0", converter.toVersion)
+
+	var nilRegistry *ConverterRegistry
+	assert.Nil(t, nilRegistry.upcaster(callbacks, cbk))
+}
+
+func TestConverterRegistryUpcasterAnyMajorVersion(t *testing.T) {
+	converters := newTestConverterRegistry(t)
+	callbacks := NewCallbackRegistry()
+	callbacks.RegisterCallback(CallbackKey{MessageType: "trip_created", MessageMajorVersion: AnyMajorVersion}, nil, nil)
+
+	converter := converters.upcaster(callbacks, CallbackKey{MessageType: "trip_created", MessageMajorVersion: 1})
+	require.NotNil(t, converter)
+	assert.Equal(t, "2.0", converter.toVersion)
+
+	// converters to older major versions are never used for incoming messages
+	assert.Nil(t, converters.upcaster(callbacks, CallbackKey{MessageType: "trip_created", MessageMajorVersion: 2}))
+}
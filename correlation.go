@@ -0,0 +1,61 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+)
+
+const (
+	// CorrelationIDHeader is the message header identifying a chain of messages, across services. Messages published
+	// from a callback inherit the correlation id of the message being processed, or its id if it has none. Replies
+	// are matched to their request by correlation id.
+	CorrelationIDHeader = "correlation_id"
+
+	// CausationIDHeader is the message header holding the id of the message that caused a message to be published.
+	// Messages published from a callback default to the id of the message being processed.
+	CausationIDHeader = "causation_id"
+)
+
+// withMessage returns a context carrying the message being processed, so messages published from the callback
+// inherit its correlation id
+func withMessage(ctx context.Context, message *Message) context.Context {
+	return context.WithValue(ctx, messageKey, message)
+}
+
+// consumedMessage returns the message being processed by the callback the context was passed to, if any
+func consumedMessage(ctx context.Context) *Message {
+	message, _ := ctx.Value(messageKey).(*Message)
+	return message
+}
+
+// correlationID returns the correlation id of a message, which is its own id for the first message in a chain
+func (m *Message) correlationID() string {
+	if correlationID, ok := m.Metadata.Headers[CorrelationIDHeader]; ok {
+		return correlationID
+	}
+	return m.ID
+}
+
+// inheritHeaders sets the correlation and causation id headers of a message published from a callback, unless
+// they're already set
+func (m *Message) inheritHeaders(ctx context.Context) {
+	parent := consumedMessage(ctx)
+	if parent == nil {
+		return
+	}
+	if m.Metadata.Headers == nil {
+		m.Metadata.Headers = map[string]string{}
+	}
+	if _, ok := m.Metadata.Headers[CorrelationIDHeader]; !ok {
+		m.Metadata.Headers[CorrelationIDHeader] = parent.correlationID()
+	}
+	if _, ok := m.Metadata.Headers[CausationIDHeader]; !ok {
+		m.Metadata.Headers[CausationIDHeader] = parent.ID
+	}
+}
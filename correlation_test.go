@@ -0,0 +1,82 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCorrelationMessage(t *testing.T, settings *Settings, headers map[string]string) *Message {
+	message, err := NewMessage(
+		settings, "vehicle_created", "1.0", headers, &FakeHedwigDataField{VehicleID: "C_1234567890123456"})
+	require.NoError(t, err)
+	return message
+}
+
+func TestMessage_inheritHeaders(t *testing.T) {
+	settings := createTestSettings()
+	parent := newTestCorrelationMessage(t, settings, nil)
+	ctx := withMessage(context.Background(), parent)
+
+	message := newTestCorrelationMessage(t, settings, nil)
+	message.inheritHeaders(ctx)
+	assert.Equal(t, map[string]string{
+		CorrelationIDHeader: parent.ID,
+		CausationIDHeader:   parent.ID,
+	}, message.Metadata.Headers)
+
+	// correlation id is carried along the chain
+	child := newTestCorrelationMessage(t, settings, nil)
+	child.inheritHeaders(withMessage(context.Background(), message))
+	assert.Equal(t, map[string]string{
+		CorrelationIDHeader: parent.ID,
+		CausationIDHeader:   message.ID,
+	}, child.Metadata.Headers)
+}
+
+func TestMessage_inheritHeadersExplicit(t *testing.T) {
+	settings := createTestSettings()
+	parent := newTestCorrelationMessage(t, settings, nil)
+	ctx := withMessage(context.Background(), parent)
+
+	headers := map[string]string{CorrelationIDHeader: "abc", CausationIDHeader: "def"}
+	message := newTestCorrelationMessage(t, settings, headers)
+	message.inheritHeaders(ctx)
+	assert.Equal(t, map[string]string{CorrelationIDHeader: "abc", CausationIDHeader: "def"}, message.Metadata.Headers)
+}
+
+func TestMessage_inheritHeadersNoParent(t *testing.T) {
+	settings := createTestSettings()
+	message := newTestCorrelationMessage(t, settings, nil)
+	message.inheritHeaders(context.Background())
+	assert.Nil(t, message.Metadata.Headers)
+}
+
+func TestPublisher_PublishFromCallback(t *testing.T) {
+	settings := createTestSettings()
+	settings.MessageRouting = map[MessageRouteKey]string{
+		{MessageType: "vehicle_created", MessageMajorVersion: 1}: "dev-vehicle-created",
+	}
+	awsClient := &FakeAWSClient{}
+	publisher := &Publisher{awsClient: awsClient, settings: settings}
+
+	parent := newTestCorrelationMessage(t, settings, map[string]string{CorrelationIDHeader: "abc"})
+	awsClient.On("PublishSNS", mock.Anything, settings, "dev-vehicle-created", mock.Anything,
+		map[string]string{CorrelationIDHeader: "abc", CausationIDHeader: parent.ID}).Return(nil)
+
+	parent.callback = func(ctx context.Context, _ *Message) error {
+		return publisher.Publish(ctx, newTestCorrelationMessage(t, settings, nil))
+	}
+	assert.NoError(t, parent.execCallback(context.Background(), ""))
+	awsClient.AssertExpectations(t)
+}
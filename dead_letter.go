@@ -0,0 +1,109 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+)
+
+// SQS message attributes set on dead-lettered messages
+const (
+	DeadLetterReasonAttribute       = "hedwig_failure_reason"
+	DeadLetterReceiveCountAttribute = "hedwig_receive_count"
+)
+
+// errLambdaDeadLetterQueueName is returned when an SNS lambda consumer dead-letters a record without
+// settings.DeadLetterQueueName
+var errLambdaDeadLetterQueueName = errors.New("settings.DeadLetterQueueName is required to dead-letter lambda events")
+
+// maxDeadLetterReasonLength limits the size of the failure reason attached to a dead-lettered message
+const maxDeadLetterReasonLength = 1024
+
+// PermanentErrorClassifier is called with the error returned by a failed message, and returns true if the failure
+// is permanent, i.e. retrying the message will never succeed.
+type PermanentErrorClassifier func(err error) bool
+
+// PermanentError indicates that a message failed processing and will never succeed. Such messages are sent to the
+// dead-letter queue right away instead of being retried.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// Permanent wraps an error to mark it as a permanent failure
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+type causer interface {
+	Cause() error
+}
+
+// isPermanentError returns true if the error, or any error it wraps, is a permanent failure
+func isPermanentError(settings *Settings, err error) bool {
+	for e := err; e != nil; {
+		if _, ok := e.(*PermanentError); ok {
+			return true
+		}
+		cause, ok := e.(causer)
+		if !ok {
+			break
+		}
+		e = cause.Cause()
+	}
+	if settings.PermanentErrorClassifier != nil {
+		return settings.PermanentErrorClassifier(err)
+	}
+	return false
+}
+
+func getSQSDeadLetterQueueName(settings *Settings) string {
+	if settings.DeadLetterQueueName != "" {
+		return fmt.Sprintf("HEDWIG-%s", settings.DeadLetterQueueName)
+	}
+	return fmt.Sprintf("HEDWIG-%s-DLQ", settings.QueueName)
+}
+
+// deadLetterAttributes returns the SQS message attributes describing a message failure. The receive count is left
+// out if it isn't known, i.e. 0.
+func deadLetterAttributes(reason error, receiveCount int) map[string]*sqs.MessageAttributeValue {
+	reasonStr := reason.Error()
+	if len(reasonStr) > maxDeadLetterReasonLength {
+		// don't cut a multi-byte character in half
+		end := maxDeadLetterReasonLength
+		for end > 0 && !utf8.RuneStart(reasonStr[end]) {
+			end--
+		}
+		reasonStr = reasonStr[:end]
+	}
+	attributes := map[string]*sqs.MessageAttributeValue{
+		DeadLetterReasonAttribute: {
+			DataType:    aws.String("String"),
+			StringValue: aws.String(reasonStr),
+		},
+	}
+	if receiveCount > 0 {
+		attributes[DeadLetterReceiveCountAttribute] = &sqs.MessageAttributeValue{
+			DataType:    aws.String("Number"),
+			StringValue: aws.String(strconv.Itoa(receiveCount)),
+		}
+	}
+	return attributes
+}
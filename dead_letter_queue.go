@@ -0,0 +1,364 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/pkg/errors"
+)
+
+const (
+	// dlqScanVisibilityTimeoutS is how long messages are hidden while the dead-letter queue is being scanned
+	dlqScanVisibilityTimeoutS int64 = 300
+	// dlqScanWaitTimeoutSeconds is the long poll duration while scanning; kept short since an empty response ends
+	// the scan
+	dlqScanWaitTimeoutSeconds int64 = 1
+	// dlqMaxNumberOfMessages is the maximum batch size allowed by SQS
+	dlqMaxNumberOfMessages int64 = 10
+)
+
+// errStopScan may be returned from a scan function to end the scan early
+var errStopScan = errors.New("stop scan")
+
+// DeadLetterFilter selects messages in a dead-letter queue. Zero valued fields match all messages.
+type DeadLetterFilter struct {
+	// Message type, e.g. "trip_created"
+	MessageType string
+	// Publisher name
+	Publisher string
+	// Only match messages published at or after this time
+	After time.Time
+	// Only match messages published before this time
+	Before time.Time
+	// Only match messages with all of these header values
+	Headers map[string]string
+}
+
+func (f *DeadLetterFilter) matches(message *DeadLetterMessage) bool {
+	if f == nil {
+		return true
+	}
+	if f.MessageType != "" && f.MessageType != message.MessageType {
+		return false
+	}
+	if f.Publisher != "" && f.Publisher != message.Publisher {
+		return false
+	}
+	if !f.After.IsZero() && message.Timestamp.Before(f.After) {
+		return false
+	}
+	if !f.Before.IsZero() && !message.Timestamp.Before(f.Before) {
+		return false
+	}
+	for k, v := range f.Headers {
+		if message.Headers[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// DeadLetterMessage is a message in a dead-letter queue
+type DeadLetterMessage struct {
+	// SQS message id
+	SQSMessageID string `json:"sqs_message_id"`
+	// Raw message body
+	Body string `json:"body"`
+
+	// Hedwig message fields, only set if the body is a valid Hedwig message
+	ID          string            `json:"id,omitempty"`
+	Schema      string            `json:"schema,omitempty"`
+	MessageType string            `json:"message_type,omitempty"`
+	Publisher   string            `json:"publisher,omitempty"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Headers     map[string]string `json:"headers,omitempty"`
+
+	// Failure reason, if the message was dead-lettered by hedwig
+	FailureReason string `json:"failure_reason,omitempty"`
+	// Number of times the message was received before being dead-lettered
+	ReceiveCount int `json:"receive_count"`
+
+	queueMessage *sqs.Message
+}
+
+func newDeadLetterMessage(queueMessage *sqs.Message) *DeadLetterMessage {
+	message := &DeadLetterMessage{
+		SQSMessageID: aws.StringValue(queueMessage.MessageId),
+		Body:         aws.StringValue(queueMessage.Body),
+		ReceiveCount: receiveCount(queueMessage),
+		queueMessage: queueMessage,
+	}
+	if attr, ok := queueMessage.MessageAttributes[DeadLetterReasonAttribute]; ok {
+		message.FailureReason = aws.StringValue(attr.StringValue)
+	}
+	if attr, ok := queueMessage.MessageAttributes[DeadLetterReceiveCountAttribute]; ok {
+		if count, err := strconv.Atoi(aws.StringValue(attr.StringValue)); err == nil {
+			message.ReceiveCount = count
+		}
+	}
+
+	// Data is left alone since it can't be deserialized without a callback registry
+	parsed := struct {
+		ID       string   `json:"id"`
+		Schema   string   `json:"schema"`
+		Metadata metadata `json:"metadata"`
+	}{}
+	if err := json.Unmarshal([]byte(message.Body), &parsed); err != nil {
+		return message
+	}
+	message.ID = parsed.ID
+	message.Schema = parsed.Schema
+	message.Publisher = parsed.Metadata.Publisher
+	message.Timestamp = time.Time(parsed.Metadata.Timestamp)
+	message.Headers = parsed.Metadata.Headers
+	if groupMatches := schemaRe.FindStringSubmatch(parsed.Schema); len(groupMatches) == 3 {
+		message.MessageType = groupMatches[1]
+	}
+	return message
+}
+
+// RequeueRequest represents a request to move messages from the dead-letter queue back to the hedwig queue
+type RequeueRequest struct {
+	// Only requeue messages matching this filter
+	Filter *DeadLetterFilter
+	// Maximum number of messages to requeue
+	MaxMessages int // optional; defaults to all matching messages
+	// Maximum number of messages requeued per second
+	RateLimit float64 // optional; defaults to unlimited
+	// Only report the messages that would be requeued
+	DryRun bool
+}
+
+// IDeadLetterQueue manages messages in the dead-letter queue of a hedwig queue
+type IDeadLetterQueue interface {
+	// List returns up to maxMessages messages matching the filter, without removing them from the queue.
+	// If maxMessages is 0, all matching messages are returned.
+	List(ctx context.Context, filter *DeadLetterFilter, maxMessages int) ([]*DeadLetterMessage, error)
+
+	// Inspect returns the message with the given SQS message id
+	Inspect(ctx context.Context, sqsMessageID string) (*DeadLetterMessage, error)
+
+	// Requeue moves matching messages back to the hedwig queue, and returns the messages that were requeued
+	Requeue(ctx context.Context, request *RequeueRequest) ([]*DeadLetterMessage, error)
+
+	// Purge deletes all messages in the dead-letter queue
+	Purge(ctx context.Context) error
+}
+
+type deadLetterQueue struct {
+	sqs      sqsiface.SQSAPI
+	settings *Settings
+}
+
+func (d *deadLetterQueue) getQueueURL(ctx context.Context, queueName string) (*string, error) {
+	out, err := d.sqs.GetQueueUrlWithContext(ctx, &sqs.GetQueueUrlInput{
+		QueueName: &queueName,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get SQS Queue URL for %s", queueName)
+	}
+	return out.QueueUrl, nil
+}
+
+// scan receives every message in the dead-letter queue once, and calls fn for each message matching the filter.
+// Messages are kept invisible for the duration of the scan so they're only seen once. fn returns true if it consumed
+// (i.e. deleted) the message; all other messages are made visible again at the end of the scan.
+func (d *deadLetterQueue) scan(ctx context.Context, filter *DeadLetterFilter,
+	fn func(dlqURL *string, message *DeadLetterMessage) (bool, error)) error {
+
+	dlqURL, err := d.getQueueURL(ctx, getSQSDeadLetterQueueName(d.settings))
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	var unconsumed []*sqs.Message
+	defer func() {
+		for _, queueMessage := range unconsumed {
+			// use a fresh context so messages are released even if the scan was canceled
+			_, err := d.sqs.ChangeMessageVisibilityWithContext(context.Background(), &sqs.ChangeMessageVisibilityInput{
+				QueueUrl:          dlqURL,
+				ReceiptHandle:     queueMessage.ReceiptHandle,
+				VisibilityTimeout: aws.Int64(0),
+			})
+			if err != nil {
+				d.settings.GetLogger(ctx).Error(err, "Failed to release dead-letter message", LoggingFields{
+					"message_sqs_id": aws.StringValue(queueMessage.MessageId),
+				})
+			}
+		}
+	}()
+
+	for {
+		out, err := d.sqs.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			AttributeNames:        []*string{aws.String(sqs.QueueAttributeNameAll)},
+			MaxNumberOfMessages:   aws.Int64(dlqMaxNumberOfMessages),
+			MessageAttributeNames: []*string{aws.String(sqs.QueueAttributeNameAll)},
+			QueueUrl:              dlqURL,
+			VisibilityTimeout:     aws.Int64(dlqScanVisibilityTimeoutS),
+			WaitTimeSeconds:       aws.Int64(dlqScanWaitTimeoutSeconds),
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to receive SQS message")
+		}
+
+		newMessages := 0
+		for i, queueMessage := range out.Messages {
+			if seen[aws.StringValue(queueMessage.MessageId)] {
+				// visibility expired during a slow scan
+				unconsumed = append(unconsumed, queueMessage)
+				continue
+			}
+			seen[aws.StringValue(queueMessage.MessageId)] = true
+			newMessages++
+
+			message := newDeadLetterMessage(queueMessage)
+			consumed := false
+			if filter.matches(message) {
+				consumed, err = fn(dlqURL, message)
+			}
+			if !consumed {
+				unconsumed = append(unconsumed, queueMessage)
+			}
+			if err != nil {
+				unconsumed = append(unconsumed, out.Messages[i+1:]...)
+				if err == errStopScan {
+					return nil
+				}
+				return err
+			}
+		}
+		if newMessages == 0 {
+			return nil
+		}
+	}
+}
+
+// List returns up to maxMessages messages matching the filter, without removing them from the queue
+func (d *deadLetterQueue) List(ctx context.Context, filter *DeadLetterFilter,
+	maxMessages int) ([]*DeadLetterMessage, error) {
+
+	var messages []*DeadLetterMessage
+	err := d.scan(ctx, filter, func(_ *string, message *DeadLetterMessage) (bool, error) {
+		messages = append(messages, message)
+		if maxMessages != 0 && len(messages) >= maxMessages {
+			return false, errStopScan
+		}
+		return false, nil
+	})
+	return messages, err
+}
+
+// Inspect returns the message with the given SQS message id
+func (d *deadLetterQueue) Inspect(ctx context.Context, sqsMessageID string) (*DeadLetterMessage, error) {
+	var found *DeadLetterMessage
+	err := d.scan(ctx, nil, func(_ *string, message *DeadLetterMessage) (bool, error) {
+		if message.SQSMessageID != sqsMessageID {
+			return false, nil
+		}
+		found = message
+		return false, errStopScan
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, errors.Errorf("message not found: %s", sqsMessageID)
+	}
+	return found, nil
+}
+
+// Requeue moves matching messages back to the hedwig queue, and returns the messages that were requeued
+func (d *deadLetterQueue) Requeue(ctx context.Context, request *RequeueRequest) ([]*DeadLetterMessage, error) {
+	queueURL, err := d.getQueueURL(ctx, getSQSQueueName(d.settings))
+	if err != nil {
+		return nil, err
+	}
+
+	var interval time.Duration
+	if request.RateLimit > 0 {
+		interval = time.Duration(float64(time.Second) / request.RateLimit)
+	}
+	var lastSent time.Time
+
+	var requeued []*DeadLetterMessage
+	err = d.scan(ctx, request.Filter, func(dlqURL *string, message *DeadLetterMessage) (bool, error) {
+		if request.MaxMessages != 0 && len(requeued) >= request.MaxMessages {
+			return false, errStopScan
+		}
+		if request.DryRun {
+			requeued = append(requeued, message)
+			return false, nil
+		}
+
+		if wait := interval - time.Since(lastSent); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return false, ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+		lastSent = time.Now()
+
+		attributes := map[string]*sqs.MessageAttributeValue{}
+		for k, v := range message.queueMessage.MessageAttributes {
+			if k != DeadLetterReasonAttribute && k != DeadLetterReceiveCountAttribute {
+				attributes[k] = v
+			}
+		}
+		_, err := d.sqs.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+			QueueUrl:          queueURL,
+			MessageBody:       message.queueMessage.Body,
+			MessageAttributes: attributes,
+		})
+		if err != nil {
+			return false, errors.Wrap(err, "failed to requeue message")
+		}
+		_, err = d.sqs.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+			QueueUrl:      dlqURL,
+			ReceiptHandle: message.queueMessage.ReceiptHandle,
+		})
+		if err != nil {
+			// message was already requeued, so a failed delete only results in a duplicate
+			d.settings.GetLogger(ctx).Error(err, "Failed to delete requeued message", LoggingFields{
+				"message_sqs_id": message.SQSMessageID,
+			})
+		}
+		requeued = append(requeued, message)
+		return true, nil
+	})
+	return requeued, err
+}
+
+// Purge deletes all messages in the dead-letter queue
+func (d *deadLetterQueue) Purge(ctx context.Context) error {
+	dlqURL, err := d.getQueueURL(ctx, getSQSDeadLetterQueueName(d.settings))
+	if err != nil {
+		return err
+	}
+	_, err = d.sqs.PurgeQueueWithContext(ctx, &sqs.PurgeQueueInput{
+		QueueUrl: dlqURL,
+	})
+	return errors.Wrap(err, "failed to purge dead-letter queue")
+}
+
+// NewDeadLetterQueue creates a new object used to manage the dead-letter queue of a hedwig queue
+func NewDeadLetterQueue(sessionCache *AWSSessionsCache, settings *Settings) IDeadLetterQueue {
+	settings.initDefaults()
+	return &deadLetterQueue{
+		sqs:      sqs.New(sessionCache.GetSession(settings)),
+		settings: settings,
+	}
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type DeadLetterQueueTestSuite struct {
+	suite.Suite
+	settings      *Settings
+	fakeSqs       *FakeSQS
+	dlq           *deadLetterQueue
+	queueURL      string
+	dlqURL        string
+	queueMessages []*sqs.Message
+}
+
+func (suite *DeadLetterQueueTestSuite) SetupTest() {
+	suite.settings = createTestSettings()
+	suite.settings.CallbackRegistry.RegisterCallback(
+		CallbackKey{MessageType: "vehicle_created", MessageMajorVersion: 1},
+		func(context.Context, *Message) error { return nil },
+		func() interface{} { return new(FakeHedwigDataField) },
+	)
+	suite.fakeSqs = &FakeSQS{}
+	suite.dlq = &deadLetterQueue{
+		sqs:      suite.fakeSqs,
+		settings: suite.settings,
+	}
+	dlqName := "HEDWIG-DEV-MYAPP-DLQ"
+	suite.queueURL = "https://sqs.us-east-1.amazonaws.com/686176732873/HEDWIG-DEV-MYAPP"
+	suite.dlqURL = "https://sqs.us-east-1.amazonaws.com/686176732873/" + dlqName
+
+	suite.fakeSqs.On("GetQueueUrlWithContext", mock.Anything, &sqs.GetQueueUrlInput{QueueName: &dlqName}, mock.Anything).
+		Return(&sqs.GetQueueUrlOutput{QueueUrl: &suite.dlqURL}, nil)
+
+	suite.queueMessages = nil
+	for i, publisher := range []string{"myapp", "otherapp"} {
+		message, err := NewMessage(
+			suite.settings, "vehicle_created", "1.0", map[string]string{"request_id": "abc"},
+			&FakeHedwigDataField{VehicleID: "C_1234567890123456"})
+		suite.Require().NoError(err)
+		message.Metadata.Publisher = publisher
+		message.Metadata.Timestamp = JSONTime(time.Unix(int64(i+1)*3600, 0))
+		msgJSON, err := message.JSONString()
+		suite.Require().NoError(err)
+
+		suite.queueMessages = append(suite.queueMessages, &sqs.Message{
+			MessageId:         aws.String(uuid.NewV4().String()),
+			Body:              aws.String(msgJSON),
+			ReceiptHandle:     aws.String(uuid.NewV4().String()),
+			MessageAttributes: deadLetterAttributes(errors.New("my bad"), 5),
+		})
+	}
+	suite.fakeSqs.On("ReceiveMessageWithContext", mock.Anything, mock.Anything, mock.Anything).
+		Return(&sqs.ReceiveMessageOutput{Messages: suite.queueMessages}, nil).Once()
+	suite.fakeSqs.On("ReceiveMessageWithContext", mock.Anything, mock.Anything, mock.Anything).
+		Return(&sqs.ReceiveMessageOutput{}, nil)
+}
+
+func (suite *DeadLetterQueueTestSuite) expectRelease(queueMessage *sqs.Message) {
+	suite.fakeSqs.On("ChangeMessageVisibilityWithContext", mock.Anything, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          &suite.dlqURL,
+		ReceiptHandle:     queueMessage.ReceiptHandle,
+		VisibilityTimeout: aws.Int64(0),
+	}, mock.Anything).Return(&sqs.ChangeMessageVisibilityOutput{}, nil)
+}
+
+func (suite *DeadLetterQueueTestSuite) TestList() {
+	for _, queueMessage := range suite.queueMessages {
+		suite.expectRelease(queueMessage)
+	}
+
+	messages, err := suite.dlq.List(context.Background(), &DeadLetterFilter{Publisher: "otherapp"}, 0)
+	suite.NoError(err)
+	suite.Require().Len(messages, 1)
+	suite.Equal(*suite.queueMessages[1].MessageId, messages[0].SQSMessageID)
+	suite.Equal("vehicle_created", messages[0].MessageType)
+	suite.Equal("otherapp", messages[0].Publisher)
+	suite.Equal(time.Unix(7200, 0), messages[0].Timestamp)
+	suite.Equal("my bad", messages[0].FailureReason)
+	suite.Equal(5, messages[0].ReceiveCount)
+
+	suite.fakeSqs.AssertExpectations(suite.T())
+}
+
+func (suite *DeadLetterQueueTestSuite) TestListFilters() {
+	for _, queueMessage := range suite.queueMessages {
+		suite.expectRelease(queueMessage)
+	}
+
+	filter := &DeadLetterFilter{
+		MessageType: "vehicle_created",
+		After:       time.Unix(3600, 0),
+		Before:      time.Unix(7200, 0),
+		Headers:     map[string]string{"request_id": "abc"},
+	}
+	messages, err := suite.dlq.List(context.Background(), filter, 0)
+	suite.NoError(err)
+	suite.Require().Len(messages, 1)
+	suite.Equal(*suite.queueMessages[0].MessageId, messages[0].SQSMessageID)
+
+	suite.fakeSqs.AssertExpectations(suite.T())
+}
+
+func (suite *DeadLetterQueueTestSuite) TestInspect() {
+	for _, queueMessage := range suite.queueMessages {
+		suite.expectRelease(queueMessage)
+	}
+
+	message, err := suite.dlq.Inspect(context.Background(), *suite.queueMessages[0].MessageId)
+	suite.NoError(err)
+	suite.Equal(*suite.queueMessages[0].Body, message.Body)
+
+	suite.fakeSqs.AssertExpectations(suite.T())
+}
+
+func (suite *DeadLetterQueueTestSuite) TestRequeueDryRun() {
+	for _, queueMessage := range suite.queueMessages {
+		suite.expectRelease(queueMessage)
+	}
+
+	queueName := "HEDWIG-DEV-MYAPP"
+	suite.fakeSqs.On("GetQueueUrlWithContext", mock.Anything, &sqs.GetQueueUrlInput{QueueName: &queueName}, mock.Anything).
+		Return(&sqs.GetQueueUrlOutput{QueueUrl: &suite.queueURL}, nil)
+
+	messages, err := suite.dlq.Requeue(context.Background(), &RequeueRequest{DryRun: true})
+	suite.NoError(err)
+	suite.Len(messages, 2)
+
+	suite.fakeSqs.AssertExpectations(suite.T())
+	suite.fakeSqs.AssertNotCalled(suite.T(), "SendMessageWithContext", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func (suite *DeadLetterQueueTestSuite) TestRequeue() {
+	queueName := "HEDWIG-DEV-MYAPP"
+	suite.fakeSqs.On("GetQueueUrlWithContext", mock.Anything, &sqs.GetQueueUrlInput{QueueName: &queueName}, mock.Anything).
+		Return(&sqs.GetQueueUrlOutput{QueueUrl: &suite.queueURL}, nil)
+	suite.expectRelease(suite.queueMessages[1])
+	suite.fakeSqs.On("SendMessageWithContext", mock.Anything, &sqs.SendMessageInput{
+		QueueUrl:          &suite.queueURL,
+		MessageBody:       suite.queueMessages[0].Body,
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{},
+	}, mock.Anything).Return(&sqs.SendMessageOutput{}, nil)
+	suite.fakeSqs.On("DeleteMessageWithContext", mock.Anything, &sqs.DeleteMessageInput{
+		QueueUrl:      &suite.dlqURL,
+		ReceiptHandle: suite.queueMessages[0].ReceiptHandle,
+	}, mock.Anything).Return(&sqs.DeleteMessageOutput{}, nil)
+
+	messages, err := suite.dlq.Requeue(context.Background(), &RequeueRequest{
+		Filter:    &DeadLetterFilter{Publisher: "myapp"},
+		RateLimit: 10,
+	})
+	suite.NoError(err)
+	suite.Require().Len(messages, 1)
+	suite.Equal(*suite.queueMessages[0].MessageId, messages[0].SQSMessageID)
+
+	suite.fakeSqs.AssertExpectations(suite.T())
+}
+
+func (suite *DeadLetterQueueTestSuite) TestPurge() {
+	suite.fakeSqs.On("PurgeQueueWithContext", mock.Anything, &sqs.PurgeQueueInput{QueueUrl: &suite.dlqURL}, mock.Anything).
+		Return(&sqs.PurgeQueueOutput{}, nil)
+
+	err := suite.dlq.Purge(context.Background())
+	suite.NoError(err)
+	suite.fakeSqs.AssertCalled(suite.T(), "PurgeQueueWithContext", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestDeadLetterQueueTestSuite(t *testing.T) {
+	suite.Run(t, new(DeadLetterQueueTestSuite))
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPermanent(t *testing.T) {
+	assert.Nil(t, Permanent(nil))
+
+	err := Permanent(errors.New("my bad"))
+	assert.EqualError(t, err, "my bad")
+}
+
+func TestIsPermanentError(t *testing.T) {
+	settings := createTestSettings()
+
+	assert.True(t, isPermanentError(settings, Permanent(errors.New("my bad"))))
+	assert.True(t, isPermanentError(settings, errors.Wrap(Permanent(errors.New("my bad")), "wrapped")))
+	assert.False(t, isPermanentError(settings, errors.New("my bad")))
+	assert.False(t, isPermanentError(settings, ErrRetry))
+
+	settings.PermanentErrorClassifier = func(err error) bool {
+		return errors.Cause(err).Error() == "my bad"
+	}
+	assert.True(t, isPermanentError(settings, errors.New("my bad")))
+	assert.False(t, isPermanentError(settings, errors.New("try again")))
+}
+
+func TestGetSQSDeadLetterQueueName(t *testing.T) {
+	settings := &Settings{
+		QueueName: "DEV-MYAPP",
+	}
+	assert.Equal(t, "HEDWIG-DEV-MYAPP-DLQ", getSQSDeadLetterQueueName(settings))
+
+	settings.DeadLetterQueueName = "DEV-MYAPP-FAILURES"
+	assert.Equal(t, "HEDWIG-DEV-MYAPP-FAILURES", getSQSDeadLetterQueueName(settings))
+}
+
+func TestDeadLetterAttributes(t *testing.T) {
+	attributes := deadLetterAttributes(errors.New("my bad"), 3)
+	assert.Equal(t, "my bad", *attributes[DeadLetterReasonAttribute].StringValue)
+	assert.Equal(t, "3", *attributes[DeadLetterReceiveCountAttribute].StringValue)
+
+	attributes = deadLetterAttributes(errors.New(strings.Repeat("x", 5000)), 1)
+	assert.Len(t, *attributes[DeadLetterReasonAttribute].StringValue, maxDeadLetterReasonLength)
+
+	// the reason is cut before a character that doesn't fit
+	attributes = deadLetterAttributes(errors.New(strings.Repeat("x", maxDeadLetterReasonLength-1)+"é"), 1)
+	reason := *attributes[DeadLetterReasonAttribute].StringValue
+	assert.Equal(t, strings.Repeat("x", maxDeadLetterReasonLength-1), reason)
+}
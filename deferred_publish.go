@@ -0,0 +1,83 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// errDeferredRequest is returned for requests made using a deferred publisher, since their reply can't be waited for
+var errDeferredRequest = errors.New("requests can't be deferred")
+
+// deferredPublisher buffers messages published by a callback, and publishes them once the callback succeeds
+type deferredPublisher struct {
+	lock      sync.Mutex
+	publisher *Publisher
+	messages  []*Message
+}
+
+func newDeferredPublisher(publisher *Publisher) *deferredPublisher {
+	return &deferredPublisher{publisher: publisher}
+}
+
+func (d *deferredPublisher) withContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, deferredPublisherKey, d)
+}
+
+// DeferredPublisher returns a publisher for use by the callback the context was passed to. Messages published with
+// it are only sent once the callback returns successfully, and are dropped if the callback fails, or nacks or hands
+// off the message, so retries don't publish duplicates. Returns nil outside of callbacks, and for batch callbacks.
+func DeferredPublisher(ctx context.Context) IPublisher {
+	if d, ok := ctx.Value(deferredPublisherKey).(*deferredPublisher); ok {
+		return d
+	}
+	return nil
+}
+
+// Publish buffers a message until the callback returns successfully
+func (d *deferredPublisher) Publish(ctx context.Context, message *Message) error {
+	// the context of the callback is gone by the time messages are sent
+	message.inheritHeaders(ctx)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.messages = append(d.messages, message)
+	return nil
+}
+
+// Request fails, since the reply would only be published after the callback returns
+func (d *deferredPublisher) Request(ctx context.Context, message *Message) (*Message, error) {
+	return nil, errDeferredRequest
+}
+
+// Reply buffers the reply to a request until the callback returns successfully
+func (d *deferredPublisher) Reply(ctx context.Context, request *Message, data interface{}) error {
+	reply, err := newReply(d.publisher.settings, request, data)
+	if err != nil {
+		return err
+	}
+	return d.Publish(ctx, reply)
+}
+
+// flush publishes the buffered messages, stopping at the first failure. It's called before the message being processed
+// is marked as processed, so messages that fail to publish are retried along with it, and messages published before
+// them may be sent more than once.
+func (d *deferredPublisher) flush(ctx context.Context) error {
+	d.lock.Lock()
+	messages := d.messages
+	d.messages = nil
+	d.lock.Unlock()
+	for _, message := range messages {
+		if err := d.publisher.Publish(ctx, message); err != nil {
+			return errors.Wrap(err, "failed to publish deferred message")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeferredPublisher_NotInCallback(t *testing.T) {
+	assert.Nil(t, DeferredPublisher(context.Background()))
+}
+
+func TestDeferredPublisher(t *testing.T) {
+	ctx := context.Background()
+	awsClient := &FakeAWSClient{}
+	publisher, settings := newTestRequestPublisher(awsClient)
+	deferred := newDeferredPublisher(publisher)
+	ctx = deferred.withContext(ctx)
+	assert.Equal(t, deferred, DeferredPublisher(ctx))
+
+	message := newTestCorrelationMessage(t, settings, nil)
+	assert.NoError(t, DeferredPublisher(ctx).Publish(ctx, message))
+	request := newTestRequest(t, settings)
+	request.Metadata.Headers[CorrelationIDHeader] = "abc"
+	assert.NoError(t, DeferredPublisher(ctx).Reply(ctx, request, &FakeHedwigDataField{VehicleID: "C_1234567890123456"}))
+	_, err := DeferredPublisher(ctx).Request(ctx, request)
+	assert.Equal(t, errDeferredRequest, err)
+
+	// nothing is published until the buffer is flushed
+	awsClient.AssertNotCalled(t, "PublishSNS", mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything)
+
+	awsClient.On("PublishSNS", ctx, settings, "dev-vehicle-created-v1", mock.Anything, mock.Anything).Return(nil).
+		Twice()
+	assert.NoError(t, deferred.flush(ctx))
+	awsClient.AssertExpectations(t)
+
+	// flushed messages aren't published again
+	assert.NoError(t, deferred.flush(ctx))
+	awsClient.AssertExpectations(t)
+}
+
+func TestDeferredPublisher_FlushError(t *testing.T) {
+	ctx := context.Background()
+	awsClient := &FakeAWSClient{}
+	publisher, settings := newTestRequestPublisher(awsClient)
+	deferred := newDeferredPublisher(publisher)
+
+	require.NoError(t, deferred.Publish(ctx, newTestCorrelationMessage(t, settings, nil)))
+	awsClient.On("PublishSNS", ctx, settings, "dev-vehicle-created-v1", mock.Anything, mock.Anything).
+		Return(errors.New("no internet"))
+
+	assert.EqualError(t, deferred.flush(ctx), "failed to publish deferred message: no internet")
+}
+
+func newTestDeferredPublishSettings(t *testing.T, callbackErr error) (*Settings, string) {
+	settings := createTestSettings()
+	settings.MessageRouting = map[MessageRouteKey]string{
+		{MessageType: "vehicle_created", MessageMajorVersion: 1}: "dev-vehicle-created-v1",
+	}
+	settings.CallbackRegistry.RegisterCallback(
+		CallbackKey{MessageType: "vehicle_created", MessageMajorVersion: 1},
+		func(ctx context.Context, message *Message) error {
+			published := newTestCorrelationMessage(t, settings, nil)
+			require.NoError(t, DeferredPublisher(ctx).Publish(ctx, published))
+			return callbackErr
+		},
+		func() interface{} { return new(FakeHedwigDataField) })
+
+	message := newTestCorrelationMessage(t, settings, nil)
+	messageJSON, err := message.JSONString()
+	require.NoError(t, err)
+	return settings, messageJSON
+}
+
+func TestAWSClient_messageHandlerDeferredPublish(t *testing.T) {
+	ctx := context.Background()
+	settings, messageJSON := newTestDeferredPublishSettings(t, nil)
+	fakeSns := &FakeSns{}
+	fakeSns.On("PublishWithContext", ctx, mock.Anything).Return((*sns.PublishOutput)(nil), nil)
+	awsClient := &awsClient{sns: fakeSns}
+
+	err := awsClient.messageHandler(ctx, settings, messageJSON, &messageDelivery{throttle: true}, nil)
+	assert.NoError(t, err)
+	fakeSns.AssertNumberOfCalls(t, "PublishWithContext", 1)
+}
+
+func TestAWSClient_messageHandlerDeferredPublishDropped(t *testing.T) {
+	ctx := context.Background()
+	settings, messageJSON := newTestDeferredPublishSettings(t, ErrRetry)
+	fakeSns := &FakeSns{}
+	awsClient := &awsClient{sns: fakeSns}
+
+	err := awsClient.messageHandler(ctx, settings, messageJSON, &messageDelivery{throttle: true}, nil)
+	assert.Equal(t, ErrRetry, err)
+	fakeSns.AssertNotCalled(t, "PublishWithContext", mock.Anything, mock.Anything)
+}
+
+func TestAWSClient_messageHandlerDeferredPublishRetried(t *testing.T) {
+	ctx := context.Background()
+	settings, messageJSON := newTestDeferredPublishSettings(t, nil)
+	settings.IdempotencyStore = NewMemoryIdempotencyStore(10)
+	fakeSns := &FakeSns{}
+	fakeSns.On("PublishWithContext", ctx, mock.Anything).
+		Return((*sns.PublishOutput)(nil), errors.New("no internet")).Once()
+	fakeSns.On("PublishWithContext", ctx, mock.Anything).Return((*sns.PublishOutput)(nil), nil).Once()
+	awsClient := &awsClient{sns: fakeSns}
+
+	err := awsClient.messageHandler(ctx, settings, messageJSON, &messageDelivery{throttle: true}, nil)
+	assert.EqualError(t, err, "failed to publish deferred message: Failed to publish message to SNS: no internet")
+
+	// the lease was released, so the retry processes the message, and publishes the deferred message again
+	err = awsClient.messageHandler(ctx, settings, messageJSON, &messageDelivery{throttle: true}, nil)
+	assert.NoError(t, err)
+	fakeSns.AssertExpectations(t)
+
+	// the message is only marked as processed once its deferred messages are sent
+	err = awsClient.messageHandler(ctx, settings, messageJSON, &messageDelivery{throttle: true}, nil)
+	assert.NoError(t, err)
+	fakeSns.AssertNumberOfCalls(t, "PublishWithContext", 2)
+}
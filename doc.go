@@ -76,6 +76,91 @@ Callbacks are simple functions that accept a context and a hedwig.Message struct
 
 You can access the data map using message.data as well as custom headers using message.Metadata.Headers
 and other metadata fields as described in the struct definition.
+Message.TransportMetadata describes how the message was delivered, such as the SQS receive count or the SNS topic.
+
+To roll out a new major version of a message without keeping callbacks for every major version, register converters
+between major versions. Consumers convert messages to a major version that has a callback, and publishers may convert
+messages for legacy topics using Message.Convert. Messages are validated both before and after conversion:
+
+    converters := hedwig.NewConverterRegistry()
+    converters.RegisterConverter("trip_created", 1, "2.0", NewTripCreatedV1Data, UpcastTripCreated)
+    converters.RegisterConverter("trip_created", 2, "1.1", NewTripCreatedV2Data, DowncastTripCreated)
+    settings.ConverterRegistry = converters
+
+Use hedwig.AnyMajorVersion as the major version to register a callback for every major version of a message type.
+Messages without a registered callback are retried by default. CallbackRegistry.SetFallbackPolicy may be used to
+discard or dead-letter them instead, and CallbackRegistry.RegisterFallbackCallback to handle them with a callback
+that receives the message data as a json.RawMessage.
+
+Middleware may be used to add behavior around callbacks, such as logging or metrics. Middleware in
+settings.CallbackMiddleware apply to every callback, and CallbackRegistry.RegisterMiddleware adds middleware for
+a single message type and major version:
+
+    func LoggingMiddleware(next hedwig.CallbackFunction) hedwig.CallbackFunction {
+        return func(ctx context.Context, message *hedwig.Message) error {
+            log.Printf("processing message %s", message.ID)
+            return next(ctx, message)
+        }
+    }
+
+Returning an error from a callback causes the message to be retried. Return hedwig.ErrRetry to retry without logging
+an error, or hedwig.RetryAfter(delay) to retry after a specific delay. For SQS consumers, a RetryPolicy may be set to
+back off exponentially on repeated failures:
+
+    settings.RetryPolicy = hedwig.NewExponentialBackoffRetryPolicy(10*time.Second, 15*time.Minute)
+
+Messages received from SQS are deleted once the callback returns successfully. Callbacks may instead acknowledge the
+message themselves using hedwig.Acknowledger(ctx): to ack early, nack with a delay, extend the visibility timeout, or
+hand off acknowledgement to a background goroutine:
+
+    ack := hedwig.Acknowledger(ctx)
+    ack.HandOff()
+    go func() {
+        ack.ExtendVisibility(context.Background(), time.Hour)
+        pipeline.Process(message)
+        ack.Ack(context.Background())
+    }()
+
+Messages that are nacked or handed off aren't marked as processed by the idempotency store, so they're processed
+again when redelivered, and messages published with hedwig.DeferredPublisher(ctx) are dropped.
+
+Callbacks that write to a database may process messages in batches instead. Messages processed concurrently are
+accumulated per message type and major version, up to a size or wait limit, and the batch callback reports the
+outcome of each message. Batches are limited by the number of messages received together, e.g. NumMessages, which
+SQS caps at 10; they're processed without waiting any longer once every message received with them is in a batch:
+
+    registry.RegisterBatchCallback(hedwig.CallbackKey{MessageType: "trip_created", MessageMajorVersion: 1},
+        InsertTrips, NewTripCreatedData, &hedwig.BatchLimits{MaxSize: 10, MaxWait: time.Second})
+
+Callbacks that call rate limited services may be limited without shrinking NumMessages for the whole queue. SQS
+consumers defer messages over the limits by changing their visibility timeout:
+
+    registry.SetCallbackLimits(hedwig.CallbackKey{MessageType: "email.send", MessageMajorVersion: 1},
+        &hedwig.CallbackLimits{RateLimit: 20, Burst: 20, MaxInFlight: 5})
+
+SNS and SQS deliver messages at least once. To skip messages that were already processed, set
+settings.IdempotencyStore. An in-memory store is provided, which only detects duplicates within a single process.
+To deduplicate messages across processes, implement hedwig.IdempotencyStore on top of a shared database, such as
+Redis or SQL; the hedwig.IdempotencyStore example shows an adapter for Redis:
+
+    settings.IdempotencyStore = hedwig.NewMemoryIdempotencyStore(10000)
+
+Messages that are meaningless after a while may expire, either by setting a TTL when publishing, or a maximum age
+for a message type on the consumer. Expired messages don't reach the callback; they're discarded by default, and may
+be dead-lettered or passed to settings.StaleHandler instead, as per settings.ExpiryPolicy:
+
+    msg.SetTTL(5 * time.Minute)
+    registry.SetMaxAge(hedwig.CallbackKey{MessageType: "location_ping", MessageMajorVersion: 1}, 5*time.Minute)
+
+Messages that can never succeed (for example, ones failing schema validation) may be marked by wrapping the error with
+hedwig.Permanent. Consumers send such messages to the dead-letter queue (HEDWIG-<queue>-DLQ by default) right away,
+along with the failure reason and receive count, instead of retrying them until redrive.
+
+Dead-letter queues may be managed using hedwig.NewDeadLetterQueue, which can list, inspect, requeue and purge messages.
+The same operations are available on the command line:
+
+    go get github.com/Automatic/hedwig-go/cmd/hedwig
+    hedwig dlq requeue -queue DEV-MYAPP -type email.send -rate 10 -dry-run
 
 Publisher
 
@@ -88,6 +173,36 @@ Assuming the publisher has already been initialized, You can publish messages li
     }
     publisher.Publish(ctx, msg)
 
+While consumers migrate to a new major version of a message type, the publisher may publish every message as both
+major versions, on their separate topics, using the converters in settings.ConverterRegistry. Converted messages keep
+the same message id. hedwig.ListSubscriptions shows which consumers still read the old topic:
+
+    settings.DualPublishing = map[string][]int{"trip_created": {1, 2}}
+
+Hedwig may be used for asynchronous API requests, where the response is delivered as a separate message. Requests
+name the message type of their reply, and Publisher.Request waits for the reply, which is matched by the
+correlation_id header. The reply must be routed to a queue consumed by a consumer created with the same settings as
+the publisher. Replicas sharing a reply queue take each other's replies, which then go to the callback instead, so
+each replica needs a reply queue of its own. The reply type must have a callback, which deserializes replies and
+handles those that arrive after the request gave up:
+
+    msg.SetReplyTo("vehicle_info", "1.0")
+    reply, err := publisher.Request(ctx, msg)
+
+The responder replies from its callback:
+
+    publisher.Reply(ctx, message, &VehicleInfo{...})
+
+Callbacks that publish messages should use hedwig.DeferredPublisher(ctx), which holds on to the messages until the
+callback returns successfully, and drops them if it fails, so retries don't publish duplicate messages. The message
+being processed is only marked as processed by the idempotency store once they're sent, so messages that fail to
+publish are sent again by the retry, along with those sent before them:
+
+    hedwig.DeferredPublisher(ctx).Publish(ctx, msg)
+
+Messages published from a callback, using the context passed to the callback, inherit the correlation_id header of
+the message being processed, and their causation_id header is set to its id. Either header may be set explicitly.
+
 If you want to include a custom headers with the message (for example, you can include a request_id field
 for cross-application tracing), you can pass it in additional parameter headers.
 
@@ -98,7 +213,42 @@ A consumer for SQS based workers can be started as following:
     consumer := hedwig.NewQueueConsumer(sessionCache, settings)
     consumer.ListenForMessages(ctx, &hedwig.ListenRequest{...})
 
-This is a blocking function.
+Messages delivered to the queue by SNS subscriptions without raw message delivery are unwrapped automatically. Set
+settings.VerifySNSSignatures to verify the signature of such messages.
+
+Messages received together are processed concurrently. To process messages for the same entity in the order they
+were received, set settings.PartitionKey; messages sharing a key are processed one after another, while messages
+with different keys still run concurrently:
+
+    settings.PartitionKey = func(message *hedwig.Message) string {
+        return message.Data.(*TripCreatedData).VehicleID
+    }
+
+This is a blocking function. To shut down gracefully (e.g. on deploys), call Shutdown, which stops polling right away
+and waits for in-flight messages to finish processing. Messages that don't finish within settings.ShutdownTimeout are
+abandoned, and ListenForMessages returns a *hedwig.AbandonedMessagesError listing them. ShutdownOnSignals does this on
+the first SIGTERM or SIGINT:
+
+    defer hedwig.ShutdownOnSignals(consumer)()
+    consumer.ListenForMessages(ctx, &hedwig.ListenRequest{...})
+
+A single process may listen on several queues, each with its own callback registry, concurrency and visibility
+timeout, sharing one shutdown and one metrics hook. Queues that don't set NumMessages share the NumMessages of the
+listen request in proportion to their weight:
+
+    consumer := hedwig.NewMultiQueueConsumer(sessionCache, settings,
+        &hedwig.QueueConfig{QueueName: "DEV-MYAPP", Weight: 3},
+        &hedwig.QueueConfig{QueueName: "DEV-MYAPP-BULK", CallbackRegistry: bulkRegistry},
+    )
+
+To poll several queues from a single listener while giving precedence to some of them, use a priority consumer.
+With hedwig.PollStrictPriority, a queue is only polled when all queues before it are empty; with hedwig.PollWeighted,
+queues are polled in proportion to their weight:
+
+    consumer := hedwig.NewPriorityQueueConsumer(sessionCache, settings, hedwig.PollWeighted,
+        &hedwig.QueueConfig{QueueName: "DEV-MYAPP-INTERACTIVE", Weight: 9},
+        &hedwig.QueueConfig{QueueName: "DEV-MYAPP-BULK", Weight: 1},
+    )
 
 A consumer for Lambda based workers can be started as following:
 
@@ -110,4 +260,17 @@ function as described in AWS documentation: https://docs.aws.amazon.com/lambda/l
 The lambda event handler can also be passed into the AWS Lambda SDK as follows:
 
     lambda.Start(consumer.HandleLambdaEvent)
+
+Records of an SNS event are processed independently. By default, a failed record fails the whole invocation, so Lambda
+retries every record in the event. Set settings.LambdaFailurePolicy to hedwig.LambdaDeadLetter or hedwig.LambdaIgnore
+to only dead-letter or log the failed records instead, and settings.LambdaEventReportHook to inspect the outcome of
+every record. Records are dead-lettered to settings.DeadLetterQueueName, which must be set, since Lambda consumers
+have no queue of their own.
+
+Lambda may also poll the hedwig queue using an SQS event source, so messages are buffered and dead-lettered by SQS.
+Enable ReportBatchItemFailures on the event source mapping, so only failed records are retried:
+
+    lambda.Start(consumer.HandleLambdaSQSEvent)
+
+hedwig.NewLambdaHandler handles both SNS and SQS events.
 */
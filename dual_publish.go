@@ -0,0 +1,61 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/pkg/errors"
+)
+
+// TopicSubscription is a subscription to the topic of a message type and major version
+type TopicSubscription struct {
+	// Subscription protocol, e.g. sqs or lambda
+	Protocol string `json:"protocol"`
+	// Subscribed endpoint, e.g. the SQS queue or Lambda function ARN
+	Endpoint string `json:"endpoint"`
+	// ARN of the subscription
+	SubscriptionArn string `json:"subscription_arn"`
+}
+
+func listSubscriptions(ctx context.Context, snsClient snsiface.SNSAPI, settings *Settings, messageType string,
+	majorVersion int) ([]*TopicSubscription, error) {
+
+	topic, ok := settings.MessageRouting[MessageRouteKey{MessageType: messageType, MessageMajorVersion: majorVersion}]
+	if !ok {
+		return nil, errors.New("Message route is not defined for message")
+	}
+	subscriptions := []*TopicSubscription{}
+	err := snsClient.ListSubscriptionsByTopicPagesWithContext(ctx, &sns.ListSubscriptionsByTopicInput{
+		TopicArn: aws.String(getSNSTopic(settings, topic)),
+	}, func(page *sns.ListSubscriptionsByTopicOutput, _ bool) bool {
+		for _, subscription := range page.Subscriptions {
+			subscriptions = append(subscriptions, &TopicSubscription{
+				Protocol:        aws.StringValue(subscription.Protocol),
+				Endpoint:        aws.StringValue(subscription.Endpoint),
+				SubscriptionArn: aws.StringValue(subscription.SubscriptionArn),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list subscriptions")
+	}
+	return subscriptions, nil
+}
+
+// ListSubscriptions returns the subscriptions to the topic the given message type and major version is published on.
+// During a migration to a new major version, this shows which consumers still read the old topic.
+func ListSubscriptions(ctx context.Context, sessionCache *AWSSessionsCache, settings *Settings, messageType string,
+	majorVersion int) ([]*TopicSubscription, error) {
+
+	return listSubscriptions(ctx, sns.New(sessionCache.GetSession(settings)), settings, messageType, majorVersion)
+}
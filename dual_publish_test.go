@@ -0,0 +1,84 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+type FakeSNS struct {
+	mock.Mock
+	// fake interface here
+	snsiface.SNSAPI
+}
+
+func (fs *FakeSNS) ListSubscriptionsByTopicPagesWithContext(ctx aws.Context, in *sns.ListSubscriptionsByTopicInput,
+	fn func(*sns.ListSubscriptionsByTopicOutput, bool) bool, opts ...request.Option) error {
+
+	args := fs.Called(ctx, in)
+	pages := args.Get(0).([]*sns.ListSubscriptionsByTopicOutput)
+	for i, page := range pages {
+		if !fn(page, i == len(pages)-1) {
+			break
+		}
+	}
+	return args.Error(1)
+}
+
+func TestListSubscriptions(t *testing.T) {
+	ctx := context.Background()
+	settings := createTestSettings()
+	settings.AWSRegion = "us-east-1"
+	settings.AWSAccountID = "686176732873"
+	settings.MessageRouting = map[MessageRouteKey]string{
+		{MessageType: "trip_created", MessageMajorVersion: 1}: "dev-trip-created-v1",
+	}
+	fakeSNS := &FakeSNS{}
+	fakeSNS.On("ListSubscriptionsByTopicPagesWithContext", ctx, &sns.ListSubscriptionsByTopicInput{
+		TopicArn: aws.String("arn:aws:sns:us-east-1:686176732873:hedwig-dev-trip-created-v1"),
+	}).Return([]*sns.ListSubscriptionsByTopicOutput{
+		{Subscriptions: []*sns.Subscription{{
+			Protocol:        aws.String("sqs"),
+			Endpoint:        aws.String("arn:aws:sqs:us-east-1:686176732873:HEDWIG-DEV-MYAPP"),
+			SubscriptionArn: aws.String("arn:aws:sns:us-east-1:686176732873:hedwig-dev-trip-created-v1:1"),
+		}}},
+		{Subscriptions: []*sns.Subscription{{
+			Protocol:        aws.String("lambda"),
+			Endpoint:        aws.String("arn:aws:lambda:us-east-1:686176732873:function:myfunction"),
+			SubscriptionArn: aws.String("arn:aws:sns:us-east-1:686176732873:hedwig-dev-trip-created-v1:2"),
+		}}},
+	}, nil)
+
+	subscriptions, err := listSubscriptions(ctx, fakeSNS, settings, "trip_created", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []*TopicSubscription{
+		{
+			Protocol:        "sqs",
+			Endpoint:        "arn:aws:sqs:us-east-1:686176732873:HEDWIG-DEV-MYAPP",
+			SubscriptionArn: "arn:aws:sns:us-east-1:686176732873:hedwig-dev-trip-created-v1:1",
+		},
+		{
+			Protocol:        "lambda",
+			Endpoint:        "arn:aws:lambda:us-east-1:686176732873:function:myfunction",
+			SubscriptionArn: "arn:aws:sns:us-east-1:686176732873:hedwig-dev-trip-created-v1:2",
+		},
+	}, subscriptions)
+	fakeSNS.AssertExpectations(t)
+
+	_, err = listSubscriptions(ctx, fakeSNS, settings, "trip_created", 2)
+	assert.EqualError(t, err, "Message route is not defined for message")
+}
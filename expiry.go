@@ -0,0 +1,99 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TTLHeader is the message header holding the time a message is valid for after it's created, in milliseconds
+const TTLHeader = "hedwig_ttl_ms"
+
+// ExpiryPolicy determines how expired messages are handled. Expired messages never reach their callback.
+type ExpiryPolicy int
+
+const (
+	// ExpiryDiscard logs and acknowledges expired messages
+	ExpiryDiscard ExpiryPolicy = iota
+	// ExpiryDeadLetter sends expired messages to the dead-letter queue
+	ExpiryDeadLetter
+	// ExpiryStaleHandler calls settings.StaleHandler on expired messages. The message is retried if it fails.
+	ExpiryStaleHandler
+)
+
+// expiredError is returned for messages past their expiry, once they're handled as per the expiry policy
+type expiredError struct {
+	expiresAt time.Time
+}
+
+func (e *expiredError) Error() string {
+	return fmt.Sprintf("message expired at %s", e.expiresAt.Format(time.RFC3339))
+}
+
+func isExpiredError(err error) bool {
+	_, ok := errors.Cause(err).(*expiredError)
+	return ok
+}
+
+// SetTTL sets the time the message is valid for after it's created. Consumers handle messages received after this
+// time as per settings.ExpiryPolicy.
+func (m *Message) SetTTL(ttl time.Duration) {
+	if m.Metadata.Headers == nil {
+		m.Metadata.Headers = map[string]string{}
+	}
+	m.Metadata.Headers[TTLHeader] = strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+}
+
+// expiresAt returns the time the message expires, as per its TTL header and the max age of its callback, whichever
+// is earlier
+func (m *Message) expiresAt(registry *CallbackRegistry) (time.Time, bool) {
+	var ttl time.Duration
+	if value, ok := m.Metadata.Headers[TTLHeader]; ok {
+		// messages with an invalid TTL never expire
+		if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+			ttl = time.Duration(millis) * time.Millisecond
+		}
+	}
+	if maxAge, ok := registry.getMaxAge(m.callbackKey()); ok && (ttl == 0 || maxAge < ttl) {
+		ttl = maxAge
+	}
+	if ttl <= 0 {
+		return time.Time{}, false
+	}
+	return time.Time(m.Metadata.Timestamp).Add(ttl), true
+}
+
+// handleExpired checks if a message has expired, and if so, returns an expiredError once it's handled as per the
+// expiry policy. Discarding and dead-lettering are left to the caller.
+func handleExpired(ctx context.Context, settings *Settings, message *Message, loggingFields LoggingFields,
+	timeout time.Duration) error {
+
+	expiresAt, ok := message.expiresAt(settings.CallbackRegistry)
+	if !ok || time.Now().Before(expiresAt) {
+		return nil
+	}
+	expired := &expiredError{expiresAt: expiresAt}
+	if settings.ExpiryPolicy != ExpiryStaleHandler {
+		return expired
+	}
+	if settings.StaleHandler == nil {
+		return errors.New("stale handler is required")
+	}
+	err := execWithTimeout(ctx, settings, loggingFields, timeout, func(ctx context.Context) error {
+		return settings.StaleHandler(ctx, message)
+	}, nil)
+	if err != nil {
+		return errors.Wrap(err, "stale handler failed")
+	}
+	return expired
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestExpiringMessage(t *testing.T, settings *Settings, age time.Duration) *Message {
+	message, err := NewMessage(
+		settings, "vehicle_created", "1.0", nil, &FakeHedwigDataField{VehicleID: "C_1234567890123456"})
+	require.NoError(t, err)
+	message.Metadata.Timestamp = JSONTime(time.Now().Add(-age))
+	return message
+}
+
+func TestMessage_SetTTL(t *testing.T) {
+	settings := createTestSettings()
+	message := newTestExpiringMessage(t, settings, 0)
+	message.SetTTL(5 * time.Minute)
+	assert.Equal(t, "300000", message.Metadata.Headers[TTLHeader])
+
+	expiresAt, ok := message.expiresAt(settings.CallbackRegistry)
+	assert.True(t, ok)
+	assert.Equal(t, time.Time(message.Metadata.Timestamp).Add(5*time.Minute), expiresAt)
+}
+
+func TestMessage_expiresAt(t *testing.T) {
+	settings := createTestSettings()
+	message := newTestExpiringMessage(t, settings, 0)
+
+	_, ok := message.expiresAt(settings.CallbackRegistry)
+	assert.False(t, ok)
+
+	// the earlier of the TTL header and the max age wins
+	settings.CallbackRegistry.SetMaxAge(message.callbackKey(), time.Minute)
+	message.SetTTL(time.Hour)
+	expiresAt, ok := message.expiresAt(settings.CallbackRegistry)
+	assert.True(t, ok)
+	assert.Equal(t, time.Time(message.Metadata.Timestamp).Add(time.Minute), expiresAt)
+
+	message.SetTTL(time.Second)
+	expiresAt, ok = message.expiresAt(settings.CallbackRegistry)
+	assert.True(t, ok)
+	assert.Equal(t, time.Time(message.Metadata.Timestamp).Add(time.Second), expiresAt)
+}
+
+func TestMessage_expiresAtInvalidTTL(t *testing.T) {
+	settings := createTestSettings()
+	message := newTestExpiringMessage(t, settings, time.Hour)
+	message.Metadata.Headers = map[string]string{TTLHeader: "soon"}
+
+	_, ok := message.expiresAt(settings.CallbackRegistry)
+	assert.False(t, ok)
+}
+
+func TestHandleExpired(t *testing.T) {
+	ctx := context.Background()
+	settings := createTestSettings()
+
+	message := newTestExpiringMessage(t, settings, time.Minute)
+	message.SetTTL(time.Hour)
+	assert.NoError(t, handleExpired(ctx, settings, message, nil, 0))
+
+	message.SetTTL(time.Second)
+	err := handleExpired(ctx, settings, message, nil, 0)
+	assert.True(t, isExpiredError(err))
+}
+
+func TestHandleExpired_StaleHandler(t *testing.T) {
+	ctx := context.Background()
+	settings := createTestSettings()
+	settings.ExpiryPolicy = ExpiryStaleHandler
+	message := newTestExpiringMessage(t, settings, time.Minute)
+	message.SetTTL(time.Second)
+
+	var handled *Message
+	settings.StaleHandler = func(ctx context.Context, message *Message) error {
+		handled = message
+		return nil
+	}
+	err := handleExpired(ctx, settings, message, nil, 0)
+	assert.True(t, isExpiredError(err))
+	assert.Equal(t, message, handled)
+
+	settings.StaleHandler = func(ctx context.Context, message *Message) error {
+		return errors.New("oops")
+	}
+	err = handleExpired(ctx, settings, message, nil, 0)
+	assert.EqualError(t, err, "stale handler failed: oops")
+	assert.False(t, isExpiredError(err))
+}
+
+func TestHandleExpired_NoStaleHandler(t *testing.T) {
+	ctx := context.Background()
+	settings := createTestSettings()
+	settings.ExpiryPolicy = ExpiryStaleHandler
+	message := newTestExpiringMessage(t, settings, time.Minute)
+	message.SetTTL(time.Second)
+
+	err := handleExpired(ctx, settings, message, nil, 0)
+	assert.EqualError(t, err, "stale handler is required")
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultIdempotencyTTL   = 24 * time.Hour
+	defaultIdempotencyLease = 5 * time.Minute
+)
+
+var (
+	// ErrAlreadyProcessed is returned by an idempotency store when a message was already processed successfully
+	ErrAlreadyProcessed = errors.New("message already processed")
+
+	// ErrLeaseHeld is returned by an idempotency store when a duplicate message is being processed concurrently
+	ErrLeaseHeld = errors.New("message is being processed")
+)
+
+// IdempotencyKeyFunc returns the key used to deduplicate a message
+type IdempotencyKeyFunc func(message *Message) string
+
+// IdempotencyStore records which messages have been processed, so duplicate deliveries may be skipped.
+// Implementations backed by a shared database (e.g. Redis or SQL) deduplicate messages across consumer processes; see
+// the example for an adapter backed by Redis. Acquire must be atomic across processes. The lease is held until the
+// callback returns, even after it times out, so Release and MarkProcessed may be called after the lease expired.
+type IdempotencyStore interface {
+	// Acquire takes a processing lease on the key, which expires after the given duration. Returns
+	// ErrAlreadyProcessed if the key was already processed successfully, or ErrLeaseHeld if another lease on the key
+	// hasn't expired.
+	Acquire(ctx context.Context, key string, lease time.Duration) error
+
+	// MarkProcessed records that the key was processed successfully. The record expires after the given duration.
+	MarkProcessed(ctx context.Context, key string, ttl time.Duration) error
+
+	// Release drops the processing lease on the key, so the message may be retried right away
+	Release(ctx context.Context, key string) error
+}
+
+func idempotencyKey(settings *Settings, message *Message) string {
+	if settings.IdempotencyKey != nil {
+		return settings.IdempotencyKey(message)
+	}
+	return message.ID
+}
+
+// execIdempotent calls fn unless the message was already processed. Duplicates being processed concurrently are
+// retried. fn must call finish exactly once, with the result of the callback, once the callback returns; finish
+// records the outcome in the idempotency store and returns the result. Callbacks that time out keep their lease until
+// they actually return, so a retry can't run them concurrently.
+func execIdempotent(ctx context.Context, settings *Settings, message *Message, loggingFields LoggingFields,
+	timeout time.Duration, fn func(finish func(err error) error) error) error {
+
+	store := settings.IdempotencyStore
+	if store == nil {
+		return fn(func(err error) error { return err })
+	}
+	key := idempotencyKey(settings, message)
+	// leave time for callbacks that don't return right away once they time out
+	lease := 2 * timeout
+	if settings.IdempotencyLease > 0 {
+		lease = settings.IdempotencyLease
+	}
+	if lease <= 0 {
+		lease = defaultIdempotencyLease
+	}
+	ttl := settings.IdempotencyTTL
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+
+	switch err := store.Acquire(ctx, key, lease); errors.Cause(err) {
+	case nil:
+	case ErrAlreadyProcessed:
+		settings.GetLogger(ctx).Debug("Skipping duplicate message", loggingFields)
+		return nil
+	case ErrLeaseHeld:
+		return errors.Wrap(ErrRetry, "duplicate message is being processed")
+	default:
+		return errors.Wrap(err, "failed to acquire idempotency lease")
+	}
+
+	return fn(func(err error) error {
+		if err != nil {
+			if releaseErr := store.Release(ctx, key); releaseErr != nil {
+				settings.GetLogger(ctx).Error(releaseErr, "Failed to release idempotency lease", loggingFields)
+			}
+			return err
+		}
+		if err := store.MarkProcessed(ctx, key, ttl); err != nil {
+			// the message was processed, so it shouldn't be retried
+			settings.GetLogger(ctx).Error(err, "Failed to mark message as processed", loggingFields)
+		}
+		return nil
+	})
+}
+
+type memoryIdempotencyEntry struct {
+	key       string
+	processed bool
+	expires   time.Time
+}
+
+type memoryIdempotencyStore struct {
+	lock     sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	// least recently used entries at the back
+	lru *list.List
+	now func() time.Time
+}
+
+func (s *memoryIdempotencyStore) get(key string) *memoryIdempotencyEntry {
+	element, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*memoryIdempotencyEntry)
+	if !s.now().Before(entry.expires) {
+		s.lru.Remove(element)
+		delete(s.entries, key)
+		return nil
+	}
+	s.lru.MoveToFront(element)
+	return entry
+}
+
+func (s *memoryIdempotencyStore) set(key string, processed bool, expiry time.Duration) {
+	entry := &memoryIdempotencyEntry{key: key, processed: processed, expires: s.now().Add(expiry)}
+	if element, ok := s.entries[key]; ok {
+		element.Value = entry
+		s.lru.MoveToFront(element)
+		return
+	}
+	s.entries[key] = s.lru.PushFront(entry)
+	for s.lru.Len() > s.capacity {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryIdempotencyEntry).key)
+	}
+}
+
+func (s *memoryIdempotencyStore) Acquire(_ context.Context, key string, lease time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if entry := s.get(key); entry != nil {
+		if entry.processed {
+			return ErrAlreadyProcessed
+		}
+		return ErrLeaseHeld
+	}
+	s.set(key, false, lease)
+	return nil
+}
+
+func (s *memoryIdempotencyStore) MarkProcessed(_ context.Context, key string, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.set(key, true, ttl)
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Release(_ context.Context, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if entry := s.get(key); entry != nil && !entry.processed {
+		s.lru.Remove(s.entries[key])
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+// NewMemoryIdempotencyStore creates an idempotency store that keeps up to `capacity` keys in memory, evicting the
+// least recently used ones. Duplicates are only detected within a single consumer process.
+func NewMemoryIdempotencyStore(capacity int) IdempotencyStore {
+	return &memoryIdempotencyStore{
+		capacity: capacity,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+		now:      time.Now,
+	}
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMemoryIdempotencyStore(capacity int, now *time.Time) *memoryIdempotencyStore {
+	store := NewMemoryIdempotencyStore(capacity).(*memoryIdempotencyStore)
+	store.now = func() time.Time { return *now }
+	return store
+}
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	store := newTestMemoryIdempotencyStore(10, &now)
+
+	assert.NoError(t, store.Acquire(ctx, "a", time.Minute))
+	assert.Equal(t, ErrLeaseHeld, store.Acquire(ctx, "a", time.Minute))
+
+	// failed message is released
+	assert.NoError(t, store.Release(ctx, "a"))
+	assert.NoError(t, store.Acquire(ctx, "a", time.Minute))
+
+	assert.NoError(t, store.MarkProcessed(ctx, "a", time.Hour))
+	assert.Equal(t, ErrAlreadyProcessed, store.Acquire(ctx, "a", time.Minute))
+	// releasing a processed key has no effect
+	assert.NoError(t, store.Release(ctx, "a"))
+	assert.Equal(t, ErrAlreadyProcessed, store.Acquire(ctx, "a", time.Minute))
+
+	now = now.Add(time.Hour)
+	assert.NoError(t, store.Acquire(ctx, "a", time.Minute))
+}
+
+func TestMemoryIdempotencyStore_LeaseExpires(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	store := newTestMemoryIdempotencyStore(10, &now)
+
+	assert.NoError(t, store.Acquire(ctx, "a", time.Minute))
+	now = now.Add(time.Minute)
+	assert.NoError(t, store.Acquire(ctx, "a", time.Minute))
+}
+
+func TestMemoryIdempotencyStore_Evicts(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	store := newTestMemoryIdempotencyStore(2, &now)
+
+	assert.NoError(t, store.MarkProcessed(ctx, "a", time.Hour))
+	assert.NoError(t, store.MarkProcessed(ctx, "b", time.Hour))
+	// a is now the most recently used
+	assert.Equal(t, ErrAlreadyProcessed, store.Acquire(ctx, "a", time.Minute))
+	assert.NoError(t, store.MarkProcessed(ctx, "c", time.Hour))
+
+	assert.Equal(t, 2, store.lru.Len())
+	assert.Equal(t, ErrAlreadyProcessed, store.Acquire(ctx, "a", time.Minute))
+	assert.Equal(t, ErrAlreadyProcessed, store.Acquire(ctx, "c", time.Minute))
+	assert.NoError(t, store.Acquire(ctx, "b", time.Minute))
+}
+
+func TestExecIdempotent(t *testing.T) {
+	ctx := context.Background()
+	settings := createTestSettings()
+	logger := &fakeLogger{}
+	settings.GetLogger = func(_ context.Context) Logger { return logger }
+	settings.IdempotencyStore = NewMemoryIdempotencyStore(10)
+	message := &Message{ID: "123"}
+
+	calls := 0
+	fn := func(finish func(error) error) error {
+		calls++
+		return finish(nil)
+	}
+
+	assert.NoError(t, execIdempotent(ctx, settings, message, nil, 0, fn))
+	assert.NoError(t, execIdempotent(ctx, settings, message, nil, 0, fn))
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 1, len(logger.logs))
+	assert.Equal(t, "Skipping duplicate message", logger.logs[0].message)
+}
+
+func TestExecIdempotent_Failure(t *testing.T) {
+	ctx := context.Background()
+	settings := createTestSettings()
+	settings.IdempotencyStore = NewMemoryIdempotencyStore(10)
+	message := &Message{ID: "123"}
+
+	err := execIdempotent(ctx, settings, message, nil, 0, func(finish func(error) error) error {
+		return finish(errors.New("my bad"))
+	})
+	assert.EqualError(t, err, "my bad")
+
+	// failed messages may be retried
+	calls := 0
+	assert.NoError(t, execIdempotent(ctx, settings, message, nil, 0, func(finish func(error) error) error {
+		calls++
+		return finish(nil)
+	}))
+	assert.Equal(t, 1, calls)
+}
+
+func TestExecIdempotent_ConcurrentDuplicate(t *testing.T) {
+	ctx := context.Background()
+	settings := createTestSettings()
+	settings.IdempotencyStore = NewMemoryIdempotencyStore(10)
+	settings.IdempotencyKey = func(message *Message) string {
+		return message.Metadata.Headers["request_id"]
+	}
+	message := &Message{ID: "123", Metadata: &metadata{Headers: map[string]string{"request_id": "abc"}}}
+	duplicate := &Message{ID: "456", Metadata: &metadata{Headers: map[string]string{"request_id": "abc"}}}
+
+	err := execIdempotent(ctx, settings, message, nil, time.Minute, func(finish func(error) error) error {
+		err := execIdempotent(ctx, settings, duplicate, nil, time.Minute, func(finish func(error) error) error {
+			assert.Fail(t, "duplicate message must not be processed")
+			return finish(nil)
+		})
+		assert.True(t, isRetryError(err))
+		return finish(nil)
+	})
+	assert.NoError(t, err)
+}
+
+func TestExecIdempotent_Timeout(t *testing.T) {
+	ctx := context.Background()
+	settings := createTestSettings()
+	settings.GetLogger = func(_ context.Context) Logger { return &fakeLogger{} }
+	settings.IdempotencyStore = NewMemoryIdempotencyStore(10)
+	message := &Message{ID: "123"}
+
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	settings.IdempotencyLease = time.Minute
+	err := execIdempotent(ctx, settings, message, nil, time.Millisecond, func(finish func(error) error) error {
+		return execWithTimeout(ctx, settings, nil, time.Millisecond, func(context.Context) error {
+			<-release
+			return nil
+		}, func(err error) error {
+			defer close(finished)
+			return finish(err)
+		})
+	})
+	assert.True(t, isTimeoutError(err))
+
+	// the callback is still running, so the retry is deferred
+	retry := func(finish func(error) error) error {
+		return finish(nil)
+	}
+	assert.True(t, isRetryError(execIdempotent(ctx, settings, message, nil, time.Millisecond, retry)))
+
+	// the lease is released once the callback returns
+	close(release)
+	<-finished
+	assert.NoError(t, execIdempotent(ctx, settings, message, nil, time.Millisecond, retry))
+}
+
+// redisClient is the subset of a Redis client used by redisIdempotencyStore
+type redisClient interface {
+	// SetNX sets the key if it doesn't exist, i.e. SET key value NX PX ttl
+	SetNX(ctx context.Context, key string, value string, ttl time.Duration) (bool, error)
+	Get(ctx context.Context, key string) (string, error)
+	Set(ctx context.Context, key string, value string, ttl time.Duration) error
+	// DelIfEqual deletes the key if its value matches, using a Lua script so the check is atomic
+	DelIfEqual(ctx context.Context, key string, value string) error
+}
+
+const (
+	redisLeaseValue     = "processing"
+	redisProcessedValue = "processed"
+)
+
+// redisIdempotencyStore deduplicates messages across consumer processes that share a Redis server
+type redisIdempotencyStore struct {
+	client redisClient
+	prefix string
+}
+
+func (s *redisIdempotencyStore) Acquire(ctx context.Context, key string, lease time.Duration) error {
+	ok, err := s.client.SetNX(ctx, s.prefix+key, redisLeaseValue, lease)
+	if err != nil || ok {
+		return err
+	}
+	value, err := s.client.Get(ctx, s.prefix+key)
+	if err != nil {
+		return err
+	}
+	if value == redisProcessedValue {
+		return ErrAlreadyProcessed
+	}
+	return ErrLeaseHeld
+}
+
+func (s *redisIdempotencyStore) MarkProcessed(ctx context.Context, key string, ttl time.Duration) error {
+	return s.client.Set(ctx, s.prefix+key, redisProcessedValue, ttl)
+}
+
+func (s *redisIdempotencyStore) Release(ctx context.Context, key string) error {
+	// don't drop the record of a message that was processed
+	return s.client.DelIfEqual(ctx, s.prefix+key, redisLeaseValue)
+}
+
+func ExampleIdempotencyStore() {
+	var client redisClient // e.g. a thin wrapper around a Redis client library
+
+	settings := &Settings{
+		IdempotencyStore: &redisIdempotencyStore{client: client, prefix: "hedwig:dev-myapp:"},
+		IdempotencyTTL:   24 * time.Hour,
+	}
+	_ = settings
+}
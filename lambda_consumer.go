@@ -15,6 +15,17 @@ import (
 	"github.com/aws/aws-lambda-go/lambda"
 )
 
+// SQSEventResponse is the response to an SQS event, listing the records that failed processing.
+// This is equivalent to events.SQSEventResponse in newer versions of aws-lambda-go.
+type SQSEventResponse struct {
+	BatchItemFailures []SQSBatchItemFailure `json:"batchItemFailures"`
+}
+
+// SQSBatchItemFailure identifies a record that failed processing
+type SQSBatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
 type lambdaConsumer struct {
 	consumer
 }
@@ -24,6 +35,11 @@ func (c *lambdaConsumer) HandleLambdaEvent(ctx context.Context, snsEvent events.
 	return c.awsClient.HandleLambdaEvent(ctx, c.settings, snsEvent)
 }
 
+// HandleLambdaSQSEvent processes hedwig messages delivered by an SQS event source for Lambda apps
+func (c *lambdaConsumer) HandleLambdaSQSEvent(ctx context.Context, sqsEvent events.SQSEvent) (*SQSEventResponse, error) {
+	return c.awsClient.HandleLambdaSQSEvent(ctx, c.settings, sqsEvent)
+}
+
 // NewLambdaConsumer creates a new consumer object used for lambda apps
 func NewLambdaConsumer(sessionCache *AWSSessionsCache, settings *Settings) ILambdaConsumer {
 	return &lambdaConsumer{
@@ -39,9 +55,26 @@ type LambdaHandler struct {
 	lambdaConsumer ILambdaConsumer
 }
 
+// lambdaEventSource is used to tell SNS and SQS events apart
+type lambdaEventSource struct {
+	Records []struct {
+		// "aws:sns" or "aws:sqs". Field names are matched case-insensitively, so this matches both events.
+		EventSource string `json:"eventSource"`
+	} `json:"Records"`
+}
+
 func (handler *LambdaHandler) Invoke(ctx context.Context, payload []byte) ([]byte, error) {
+	source := &lambdaEventSource{}
+	err := json.Unmarshal(payload, source)
+	if err != nil {
+		return nil, err
+	}
+	if len(source.Records) > 0 && source.Records[0].EventSource == "aws:sqs" {
+		return handler.invokeSQS(ctx, payload)
+	}
+
 	snsEvent := &events.SNSEvent{}
-	err := json.Unmarshal(payload, snsEvent)
+	err = json.Unmarshal(payload, snsEvent)
 	if err != nil {
 		return nil, err
 	}
@@ -53,14 +86,28 @@ func (handler *LambdaHandler) Invoke(ctx context.Context, payload []byte) ([]byt
 	return []byte(""), nil
 }
 
-// NewLambdaHandler returns a new lambda Handler that can be started like so:
+func (handler *LambdaHandler) invokeSQS(ctx context.Context, payload []byte) ([]byte, error) {
+	sqsEvent := &events.SQSEvent{}
+	err := json.Unmarshal(payload, sqsEvent)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := handler.lambdaConsumer.HandleLambdaSQSEvent(ctx, *sqsEvent)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(response)
+}
+
+// NewLambdaHandler returns a new lambda Handler for SNS or SQS events, that can be started like so:
 //
 //   func main() {
 //       lambda.StartHandler(NewLambdaHandler(consumer))
 //   }
 //
-// If you want to add additional error handle (e.g. panic catch etc), you can always use your own Handler,
-// and call LambdaHandler.Invoke
+// Panics while processing a record are recovered by default (see Settings.DisablePanicRecovery). If you want to add
+// additional error handling, you can always use your own Handler, and call LambdaHandler.Invoke
 func NewLambdaHandler(consumer ILambdaConsumer) lambda.Handler {
 	return &LambdaHandler{
 		lambdaConsumer: consumer,
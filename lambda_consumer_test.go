@@ -49,6 +49,37 @@ func TestConsumer_HandleLambdaEvent(t *testing.T) {
 	awsClient.AssertExpectations(t)
 }
 
+func TestConsumer_HandleLambdaSQSEvent(t *testing.T) {
+	ctx := context.Background()
+	settings := &Settings{
+		AWSRegion:    "us-east-1",
+		AWSAccountID: "1234567890",
+	}
+	sqsEvent := events.SQSEvent{
+		Records: []events.SQSMessage{
+			{
+				MessageId: uuid.NewV4().String(),
+				Body:      "message",
+			},
+		},
+	}
+	expectedResponse := &SQSEventResponse{
+		BatchItemFailures: []SQSBatchItemFailure{{ItemIdentifier: sqsEvent.Records[0].MessageId}},
+	}
+	awsClient := &FakeAWSClient{}
+	awsClient.On("HandleLambdaSQSEvent", ctx, sqsEvent).Return(expectedResponse, nil)
+	consumer := lambdaConsumer{
+		consumer: consumer{
+			awsClient: awsClient,
+			settings:  settings,
+		},
+	}
+	response, err := consumer.HandleLambdaSQSEvent(ctx, sqsEvent)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedResponse, response)
+	awsClient.AssertExpectations(t)
+}
+
 func TestNewLambdaConsumer(t *testing.T) {
 	settings := &Settings{
 		AWSRegion:    "us-east-1",
@@ -71,6 +102,14 @@ func (lambdaConsumer *fakeLambdaConsumer) HandleLambdaEvent(ctx context.Context,
 	return args.Error(0)
 }
 
+func (lambdaConsumer *fakeLambdaConsumer) HandleLambdaSQSEvent(ctx context.Context,
+	sqsEvent events.SQSEvent) (*SQSEventResponse, error) {
+
+	args := lambdaConsumer.Called(ctx, sqsEvent)
+	response, _ := args.Get(0).(*SQSEventResponse)
+	return response, args.Error(1)
+}
+
 func TestLambdaHandler_Invoke(t *testing.T) {
 	lambdaConsumer := &fakeLambdaConsumer{}
 	handler := LambdaHandler{
@@ -90,6 +129,29 @@ func TestLambdaHandler_Invoke(t *testing.T) {
 	lambdaConsumer.AssertExpectations(t)
 }
 
+func TestLambdaHandler_InvokeSQS(t *testing.T) {
+	lambdaConsumer := &fakeLambdaConsumer{}
+	handler := LambdaHandler{
+		lambdaConsumer: lambdaConsumer,
+	}
+	ctx := context.Background()
+	sqsEvent := &events.SQSEvent{
+		Records: []events.SQSMessage{{MessageId: "123", Body: "message", EventSource: "aws:sqs"}},
+	}
+	payload, err := json.Marshal(sqsEvent)
+	require.NoError(t, err)
+
+	lambdaConsumer.On("HandleLambdaSQSEvent", ctx, *sqsEvent).Return(&SQSEventResponse{
+		BatchItemFailures: []SQSBatchItemFailure{{ItemIdentifier: "123"}},
+	}, nil)
+
+	response, err := handler.Invoke(ctx, payload)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"batchItemFailures": [{"itemIdentifier": "123"}]}`, string(response))
+
+	lambdaConsumer.AssertExpectations(t)
+}
+
 func TestLambdaHandler_InvokeFailUnmarshal(t *testing.T) {
 	lambdaConsumer := &fakeLambdaConsumer{}
 	handler := LambdaHandler{
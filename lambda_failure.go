@@ -0,0 +1,65 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+)
+
+// LambdaFailurePolicy determines how an SNS lambda consumer handles records that failed processing. Records that
+// should be retried, i.e. callbacks returning ErrRetry or timing out, always fail the invocation, and records that
+// failed permanently are always dead-lettered. Dead-lettering requires settings.DeadLetterQueueName, since lambda
+// consumers have no queue to derive it from; without it, such records fail the invocation.
+type LambdaFailurePolicy int
+
+const (
+	// LambdaFailInvocation fails the whole invocation, so Lambda retries every record in the event
+	LambdaFailInvocation LambdaFailurePolicy = iota
+	// LambdaDeadLetter sends failed records to settings.DeadLetterQueueName, and lets the invocation succeed
+	LambdaDeadLetter
+	// LambdaIgnore logs failed records, and lets the invocation succeed
+	LambdaIgnore
+)
+
+// LambdaRecordOutcome is the result of processing a single record of an SNS event
+type LambdaRecordOutcome struct {
+	// SNS message id of the record
+	SNSMessageID string
+	// Outcome of processing
+	Outcome MessageOutcome
+	// Error returned while processing the record, if any
+	Err error
+}
+
+// failed returns true if the record should fail the invocation
+func (o *LambdaRecordOutcome) failed() bool {
+	switch o.Outcome {
+	case OutcomeSuccess, OutcomeDeadLettered, OutcomeIgnored, OutcomeExpired:
+		return false
+	}
+	return true
+}
+
+// LambdaEventReport describes the processing of every record of an SNS event
+type LambdaEventReport struct {
+	// Outcomes of the records, in the same order as the event
+	Records []*LambdaRecordOutcome
+}
+
+// err returns the error of the first record that should fail the invocation
+func (r *LambdaEventReport) err() error {
+	for _, record := range r.Records {
+		if record.failed() {
+			return record.Err
+		}
+	}
+	return nil
+}
+
+// LambdaEventReportHook is called after every SNS event is processed by a lambda consumer
+type LambdaEventReportHook func(ctx context.Context, report *LambdaEventReport)
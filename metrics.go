@@ -0,0 +1,63 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"time"
+)
+
+// MessageOutcome is the result of processing a message
+type MessageOutcome string
+
+// Message outcomes reported to the metrics hook
+const (
+	// Message was processed successfully
+	OutcomeSuccess MessageOutcome = "success"
+	// Message was retried as requested by the callback (ErrRetry or RetryAfter)
+	OutcomeRetry MessageOutcome = "retry"
+	// Message was over its callback limits, and was deferred
+	OutcomeThrottled MessageOutcome = "throttled"
+	// Callback didn't finish within its deadline, and the message will be retried
+	OutcomeTimeout MessageOutcome = "timeout"
+	// Message failed processing, and will be retried
+	OutcomeFailure MessageOutcome = "failure"
+	// Message failed permanently, and was sent to the dead-letter queue
+	OutcomeDeadLettered MessageOutcome = "dead_lettered"
+	// Callback handed off acknowledging the message
+	OutcomeHandedOff MessageOutcome = "handed_off"
+	// Message failed, and was ignored as per the lambda failure policy
+	OutcomeIgnored MessageOutcome = "ignored"
+	// Message expired, and was handled as per the expiry policy instead of reaching the callback
+	OutcomeExpired MessageOutcome = "expired"
+)
+
+// MessageMetrics describes the processing of a single message
+type MessageMetrics struct {
+	// Hedwig queue name, excluding the `HEDWIG-` prefix. Empty for lambda consumers.
+	QueueName string
+	// Outcome of processing
+	Outcome MessageOutcome
+	// Time taken to process the message
+	Duration time.Duration
+}
+
+// MetricsHook is called after every message is processed by a consumer. This may be used to plug in your metrics
+// library. Consumers created from the same settings share the hook.
+type MetricsHook func(ctx context.Context, metrics *MessageMetrics)
+
+func reportMetrics(ctx context.Context, settings *Settings, outcome MessageOutcome, start time.Time) {
+	if settings.MetricsHook == nil {
+		return
+	}
+	settings.MetricsHook(ctx, &MessageMetrics{
+		QueueName: settings.QueueName,
+		Outcome:   outcome,
+		Duration:  time.Since(start),
+	})
+}
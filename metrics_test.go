@@ -0,0 +1,33 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportMetrics(t *testing.T) {
+	ctx := context.Background()
+	settings := createTestSettings()
+
+	// no hook
+	reportMetrics(ctx, settings, OutcomeSuccess, time.Now())
+
+	var reported *MessageMetrics
+	settings.MetricsHook = func(_ context.Context, metrics *MessageMetrics) {
+		reported = metrics
+	}
+	reportMetrics(ctx, settings, OutcomeTimeout, time.Now().Add(-time.Second))
+	assert.Equal(t, "DEV-MYAPP", reported.QueueName)
+	assert.Equal(t, OutcomeTimeout, reported.Outcome)
+	assert.True(t, reported.Duration >= time.Second)
+}
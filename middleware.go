@@ -0,0 +1,20 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+// CallbackMiddleware wraps a callback function, and may be used to add behavior around every callback invocation,
+// e.g. logging, metrics or authorization. A middleware must call next to continue processing the message.
+type CallbackMiddleware func(next CallbackFunction) CallbackFunction
+
+// chainMiddleware wraps fn with the given middleware, so that the first middleware is the outermost one
+func chainMiddleware(fn CallbackFunction, middleware ...CallbackMiddleware) CallbackFunction {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		fn = middleware[i](fn)
+	}
+	return fn
+}
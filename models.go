@@ -40,12 +40,16 @@ type Message struct {
 
 	DataSchemaVersion *semver.Version `json:"-"`
 
-	callbackRegistry *CallbackRegistry
-	dataType         string
-	validator        IMessageValidator
+	callbackRegistry  *CallbackRegistry
+	converterRegistry *ConverterRegistry
+	dataType          string
+	validator         IMessageValidator
 
 	// Set after validation
 	callback CallbackFunction
+
+	// Set by consumers
+	transport TransportMetadata
 }
 
 func createMetadata(settings *Settings, headers map[string]string) (*metadata, error) {
@@ -77,7 +81,28 @@ func (m *Message) JSONString() (string, error) {
 // execCallback executes the callback associated with message
 func (m *Message) execCallback(ctx context.Context, receipt string) error {
 	m.Metadata.Receipt = receipt
-	return m.callback(ctx, m)
+	return m.callback(withMessage(ctx, m), m)
+}
+
+// TransportMetadata returns how the message was delivered to the consumer
+func (m *Message) TransportMetadata() TransportMetadata {
+	return m.transport
+}
+
+// callbackKey returns the key identifying the callback for this message
+func (m *Message) callbackKey() CallbackKey {
+	return CallbackKey{
+		MessageType:         m.dataType,
+		MessageMajorVersion: int(m.DataSchemaVersion.Major()),
+	}
+}
+
+// upcaster returns the converter to a major version with a callback, if the message's major version doesn't have one
+func (m *Message) upcaster() *converter {
+	if _, ok := m.callbackRegistry.resolve(m.callbackKey()); ok {
+		return nil
+	}
+	return m.converterRegistry.upcaster(m.callbackRegistry, m.callbackKey())
 }
 
 // topic returns SNS message topic
@@ -118,12 +143,21 @@ func (m *Message) UnmarshalJSON(b []byte) error {
 		return errors.New("callbackRegistry must be set")
 	}
 
-	dataFactory, err := m.callbackRegistry.getMessageDataFactory(CallbackKey{
-		MessageType:         m.dataType,
-		MessageMajorVersion: int(m.DataSchemaVersion.Major()),
-	})
-	if err != nil {
-		return err
+	if _, ok := m.callbackRegistry.resolve(m.callbackKey()); !ok && m.upcaster() == nil &&
+		m.callbackRegistry.fallbackPolicy != FallbackRetry {
+		// handled by the fallback policy
+		m.Data = dataContainer.Data
+		return nil
+	}
+
+	var dataFactory NewData
+	if converter := m.upcaster(); converter != nil && converter.newData != nil {
+		dataFactory = converter.newData
+	} else {
+		dataFactory, err = m.callbackRegistry.getMessageDataFactory(m.callbackKey())
+		if err != nil {
+			return err
+		}
 	}
 
 	data := dataFactory()
@@ -168,15 +202,12 @@ func (m *Message) validate() error {
 
 // validateCallback is a convenience wrapper to validate and set callback
 func (m *Message) validateCallback(settings *Settings) error {
-	callBackFn, err := m.callbackRegistry.getCallbackFunction(CallbackKey{
-		MessageType:         m.dataType,
-		MessageMajorVersion: int(m.DataSchemaVersion.Major()),
-	})
+	callBackFn, err := m.callbackRegistry.getCallbackFunction(m.callbackKey())
 	if err != nil {
 		return err
 	}
 
-	m.callback = callBackFn
+	m.callback = chainMiddleware(callBackFn, settings.CallbackMiddleware...)
 	return nil
 }
 
@@ -391,6 +391,46 @@ func TestValidateCallbackValid(t *testing.T) {
 	assertions.NotNil(m.callback)
 }
 
+func TestValidateCallbackMiddleware(t *testing.T) {
+	assertions := assert.New(t)
+
+	data := FakeHedwigDataField{
+		VehicleID: "C_1234567890123456",
+	}
+
+	var calls []string
+	recordingMiddleware := func(name string) CallbackMiddleware {
+		return func(next CallbackFunction) CallbackFunction {
+			return func(ctx context.Context, m *Message) error {
+				calls = append(calls, name)
+				return next(ctx, m)
+			}
+		}
+	}
+
+	settings := createTestSettings()
+	settings.CallbackMiddleware = []CallbackMiddleware{recordingMiddleware("global1"), recordingMiddleware("global2")}
+	cbk := CallbackKey{
+		MessageType:         "vehicle_created",
+		MessageMajorVersion: 1,
+	}
+	settings.CallbackRegistry.RegisterCallback(cbk, func(ctx context.Context, m *Message) error {
+		calls = append(calls, "callback")
+		return nil
+	}, func() interface{} { return new(FakeHedwigDataField) })
+	settings.CallbackRegistry.RegisterMiddleware(cbk, recordingMiddleware("key"))
+
+	m, err := NewMessage(settings, "vehicle_created", "1.0", map[string]string{}, &data)
+	require.NoError(t, err)
+
+	err = m.validateCallback(settings)
+	require.NoError(t, err)
+
+	err = m.execCallback(context.Background(), "")
+	assertions.NoError(err)
+	assertions.Equal([]string{"global1", "global2", "key", "callback"}, calls)
+}
+
 func TestValidateCallbackInvalid(t *testing.T) {
 	assertions := assert.New(t)
 
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+// QueueConfig configures a single queue of a multi-queue consumer
+type QueueConfig struct {
+	// Hedwig queue name. Exclude the `HEDWIG-` prefix
+	QueueName string
+
+	// CallbackRegistry contains callbacks for messages on this queue
+	CallbackRegistry *CallbackRegistry // optional; defaults to settings.CallbackRegistry
+
+	// Dead-letter queue name for this queue. Exclude the `HEDWIG-` prefix
+	DeadLetterQueueName string // optional; defaults to settings.DeadLetterQueueName, or <QueueName>-DLQ
+
+	// Maximum number of messages fetched and processed concurrently for this queue
+	NumMessages uint32 // optional; defaults to a share of the listen request, as per Weight
+
+	// Visibility timeout for messages fetched from this queue
+	VisibilityTimeoutS uint32 // optional; defaults to listen request
+
+	// Relative weight of this queue. Multi-queue consumers split the NumMessages of the listen request between queues
+	// that don't set their own, in proportion to their weight. Priority queue consumers with PollWeighted poll
+	// queues in proportion to their weight.
+	Weight uint32 // optional; defaults to 1
+}
+
+func (q *QueueConfig) weight() uint32 {
+	if q.Weight == 0 {
+		return 1
+	}
+	return q.Weight
+}
+
+// settings returns a copy of the consumer settings for this queue
+func (q *QueueConfig) settings(settings *Settings) *Settings {
+	queueSettings := *settings
+	queueSettings.QueueName = q.QueueName
+	if q.DeadLetterQueueName != "" {
+		queueSettings.DeadLetterQueueName = q.DeadLetterQueueName
+	}
+	if q.CallbackRegistry != nil {
+		queueSettings.CallbackRegistry = q.CallbackRegistry
+	}
+	return &queueSettings
+}
+
+type multiQueueConsumer struct {
+	settings  *Settings
+	queues    []*QueueConfig
+	consumers []IQueueConsumer
+}
+
+// listenRequest returns the listen request for a queue. Queues that don't set NumMessages get a share of the
+// request's NumMessages in proportion to their weight, and at least one message.
+func (c *multiQueueConsumer) listenRequest(queue *QueueConfig, request *ListenRequest) *ListenRequest {
+	queueRequest := *request
+	if queue.NumMessages != 0 {
+		queueRequest.NumMessages = queue.NumMessages
+	} else {
+		totalWeight := uint32(0)
+		for _, q := range c.queues {
+			if q.NumMessages == 0 {
+				totalWeight += q.weight()
+			}
+		}
+		queueRequest.NumMessages = (request.NumMessages*queue.weight() + totalWeight/2) / totalWeight
+		if queueRequest.NumMessages == 0 {
+			queueRequest.NumMessages = 1
+		}
+	}
+	if queue.VisibilityTimeoutS != 0 {
+		queueRequest.VisibilityTimeoutS = queue.VisibilityTimeoutS
+	}
+	return &queueRequest
+}
+
+// ListenForMessages starts a hedwig listener on every queue. This returns once all listeners have returned; if one
+// of them fails, the others are shut down gracefully. Messages abandoned on shutdown are reported for all queues
+// together.
+func (c *multiQueueConsumer) ListenForMessages(ctx context.Context, request *ListenRequest) error {
+	if len(c.queues) == 0 {
+		return errors.New("no queues configured")
+	}
+
+	var wg errgroup.Group
+	var shutdownOnce sync.Once
+	var lock sync.Mutex
+	var abandoned []string
+	for i := range c.queues {
+		queue := c.queues[i]
+		consumer := c.consumers[i]
+		queueRequest := c.listenRequest(queue, request)
+		wg.Go(func() error {
+			err := consumer.ListenForMessages(ctx, queueRequest)
+			if abandonedErr, ok := err.(*AbandonedMessagesError); ok {
+				lock.Lock()
+				defer lock.Unlock()
+				abandoned = append(abandoned, abandonedErr.MessageIDs...)
+				return nil
+			}
+			if err != nil && ctx.Err() == nil {
+				shutdownOnce.Do(func() {
+					go func() { _ = c.Shutdown(ctx) }()
+				})
+				return errors.Wrapf(err, "failed to listen on queue %s", queue.QueueName)
+			}
+			return err
+		})
+	}
+	if err := wg.Wait(); err != nil {
+		return err
+	}
+	if len(abandoned) > 0 {
+		sort.Strings(abandoned)
+		return &AbandonedMessagesError{MessageIDs: abandoned}
+	}
+	return nil
+}
+
+// Shutdown gracefully stops listeners on all queues
+func (c *multiQueueConsumer) Shutdown(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.settings.ShutdownTimeout)
+		defer cancel()
+	}
+
+	var lock sync.Mutex
+	var abandoned []string
+	var wg sync.WaitGroup
+	for _, consumer := range c.consumers {
+		wg.Add(1)
+		go func(consumer IQueueConsumer) {
+			defer wg.Done()
+			if err, ok := consumer.Shutdown(ctx).(*AbandonedMessagesError); ok {
+				lock.Lock()
+				defer lock.Unlock()
+				abandoned = append(abandoned, err.MessageIDs...)
+			}
+		}(consumer)
+	}
+	wg.Wait()
+
+	if len(abandoned) > 0 {
+		sort.Strings(abandoned)
+		return &AbandonedMessagesError{MessageIDs: abandoned}
+	}
+	return nil
+}
+
+// NewMultiQueueConsumer creates a new consumer object that listens on several queues in a single process. All queues
+// share the settings, and the metrics hook, but may use their own callback registry, concurrency and visibility
+// timeout. Queues that don't set their concurrency share that of the listen request, as per their weight.
+// settings.QueueName is ignored.
+func NewMultiQueueConsumer(sessionCache *AWSSessionsCache, settings *Settings, queues ...*QueueConfig) IQueueConsumer {
+	settings.initDefaults()
+	awsClient := newAWSClient(sessionCache, settings)
+
+	consumers := make([]IQueueConsumer, len(queues))
+	for i, queue := range queues {
+		consumers[i] = &queueConsumer{
+			consumer: consumer{
+				awsClient: awsClient,
+				settings:  queue.settings(settings),
+			},
+		}
+	}
+	return &multiQueueConsumer{
+		settings:  settings,
+		queues:    queues,
+		consumers: consumers,
+	}
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestNewMultiQueueConsumer(t *testing.T) {
+	settings := &Settings{
+		AWSRegion:           "us-east-1",
+		AWSAccountID:        "1234567890",
+		CallbackRegistry:    NewCallbackRegistry(),
+		DeadLetterQueueName: "dev-myapp-failures",
+	}
+	registry := NewCallbackRegistry()
+
+	iconsumer := NewMultiQueueConsumer(&AWSSessionsCache{}, settings, &QueueConfig{
+		QueueName: "dev-myapp",
+	}, &QueueConfig{
+		QueueName:           "dev-myapp-bulk",
+		CallbackRegistry:    registry,
+		DeadLetterQueueName: "dev-myapp-bulk-failures",
+	})
+	consumer := iconsumer.(*multiQueueConsumer)
+	assert.Equal(t, 2, len(consumer.consumers))
+
+	settings0 := consumer.consumers[0].(*queueConsumer).settings
+	assert.Equal(t, "dev-myapp", settings0.QueueName)
+	assert.Equal(t, "dev-myapp-failures", settings0.DeadLetterQueueName)
+	assert.Equal(t, settings.CallbackRegistry, settings0.CallbackRegistry)
+
+	settings1 := consumer.consumers[1].(*queueConsumer).settings
+	assert.Equal(t, "dev-myapp-bulk", settings1.QueueName)
+	assert.Equal(t, registry, settings1.CallbackRegistry)
+	assert.Equal(t, "dev-myapp-bulk-failures", settings1.DeadLetterQueueName)
+	assert.Equal(t, settings.AWSRegion, settings1.AWSRegion)
+}
+
+func TestMultiQueueConsumer_ListenForMessages(t *testing.T) {
+	ctx := context.Background()
+	settings := &Settings{
+		AWSRegion:    "us-east-1",
+		AWSAccountID: "1234567890",
+	}
+	settings.initDefaults()
+
+	awsClient := &FakeAWSClient{}
+	queues := []*QueueConfig{
+		{QueueName: "dev-myapp", NumMessages: 10, VisibilityTimeoutS: 30},
+		{QueueName: "dev-myapp-bulk"},
+	}
+	var consumers []IQueueConsumer
+	for _, queue := range queues {
+		queueSettings := *settings
+		queueSettings.QueueName = queue.QueueName
+		consumers = append(consumers, &queueConsumer{
+			consumer: consumer{
+				awsClient: awsClient,
+				settings:  &queueSettings,
+			},
+		})
+		awsClient.On("FetchAndProcessMessages", ctx, &queueSettings, mock.Anything, mock.Anything).Return(nil)
+	}
+	consumer := &multiQueueConsumer{
+		settings:  settings,
+		queues:    queues,
+		consumers: consumers,
+	}
+
+	err := consumer.ListenForMessages(ctx, &ListenRequest{NumMessages: 1, LoopCount: 3})
+	assert.NoError(t, err)
+
+	awsClient.AssertNumberOfCalls(t, "FetchAndProcessMessages", 6)
+	for _, call := range awsClient.Calls {
+		if call.Arguments.Get(1).(*Settings).QueueName == "dev-myapp" {
+			assert.Equal(t, uint32(10), call.Arguments.Get(2))
+			assert.Equal(t, uint32(30), call.Arguments.Get(3))
+		} else {
+			assert.Equal(t, uint32(1), call.Arguments.Get(2))
+			assert.Equal(t, uint32(0), call.Arguments.Get(3))
+		}
+	}
+}
+
+func TestMultiQueueConsumer_ListenRequestWeights(t *testing.T) {
+	consumer := &multiQueueConsumer{
+		queues: []*QueueConfig{
+			{QueueName: "dev-myapp-interactive", Weight: 3},
+			{QueueName: "dev-myapp-bulk"},
+			{QueueName: "dev-myapp-backfill", NumMessages: 2},
+		},
+	}
+	request := &ListenRequest{NumMessages: 8, VisibilityTimeoutS: 30}
+	assert.Equal(t, uint32(6), consumer.listenRequest(consumer.queues[0], request).NumMessages)
+	assert.Equal(t, uint32(2), consumer.listenRequest(consumer.queues[1], request).NumMessages)
+	assert.Equal(t, uint32(2), consumer.listenRequest(consumer.queues[2], request).NumMessages)
+	assert.Equal(t, uint32(30), consumer.listenRequest(consumer.queues[1], request).VisibilityTimeoutS)
+
+	// every queue gets at least one message
+	request = &ListenRequest{NumMessages: 1}
+	assert.Equal(t, uint32(1), consumer.listenRequest(consumer.queues[1], request).NumMessages)
+}
+
+func TestMultiQueueConsumer_ListenForMessagesError(t *testing.T) {
+	ctx := context.Background()
+	settings := &Settings{}
+	settings.initDefaults()
+
+	failingClient := &FakeAWSClient{}
+	failingClient.On("FetchAndProcessMessages", ctx, mock.Anything, mock.Anything, mock.Anything).
+		Return(errors.New("no internet"))
+	blockingClient := &blockingAWSClient{release: make(chan struct{})}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(blockingClient.release)
+	}()
+
+	consumer := &multiQueueConsumer{
+		settings: settings,
+		queues:   []*QueueConfig{{QueueName: "dev-myapp"}, {QueueName: "dev-myapp-bulk"}},
+		consumers: []IQueueConsumer{
+			&queueConsumer{consumer: consumer{awsClient: failingClient, settings: settings}},
+			&queueConsumer{consumer: consumer{awsClient: blockingClient, settings: settings}},
+		},
+	}
+
+	err := consumer.ListenForMessages(ctx, &ListenRequest{})
+	assert.EqualError(t, err, "failed to listen on queue dev-myapp: no internet")
+}
+
+func TestMultiQueueConsumer_Shutdown(t *testing.T) {
+	ctx := context.Background()
+	settings := &Settings{}
+	settings.initDefaults()
+
+	blockingClient := &blockingAWSClient{release: make(chan struct{})}
+	defer close(blockingClient.release)
+	consumer := &multiQueueConsumer{
+		settings: settings,
+		queues:   []*QueueConfig{{QueueName: "dev-myapp"}, {QueueName: "dev-myapp-bulk"}},
+		consumers: []IQueueConsumer{
+			&queueConsumer{consumer: consumer{awsClient: blockingClient, settings: settings}},
+			&queueConsumer{consumer: consumer{awsClient: blockingClient, settings: settings}},
+		},
+	}
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- consumer.ListenForMessages(ctx, &ListenRequest{})
+	}()
+	time.Sleep(5 * time.Millisecond)
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err := consumer.Shutdown(shutdownCtx)
+	assert.IsType(t, &AbandonedMessagesError{}, err)
+	assert.Equal(t, err, <-listenErr)
+}
+
+func TestMultiQueueConsumer_ListenForMessagesNoQueues(t *testing.T) {
+	consumer := NewMultiQueueConsumer(&AWSSessionsCache{}, &Settings{})
+	assert.EqualError(t, consumer.ListenForMessages(context.Background(), &ListenRequest{}), "no queues configured")
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicError is returned when processing a message panics. The message is retried like any other failure.
+type PanicError struct {
+	// Value passed to panic
+	Value interface{}
+	// Stack trace of the goroutine that panicked
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// withPanicRecovery records in the context whether panics are recovered, for code that runs on a goroutine of its own,
+// such as batch callbacks
+func withPanicRecovery(ctx context.Context, settings *Settings) context.Context {
+	return context.WithValue(ctx, panicRecoveryKey, !settings.DisablePanicRecovery)
+}
+
+// recoverPanics returns whether panics are recovered for the message the context was passed to, which they are by
+// default
+func recoverPanics(ctx context.Context) bool {
+	recoverPanics, ok := ctx.Value(panicRecoveryKey).(bool)
+	return !ok || recoverPanics
+}
+
+// callWithRecover calls fn, and turns a panic into a PanicError unless panic recovery is disabled
+func callWithRecover(ctx context.Context, settings *Settings, loggingFields LoggingFields, fn func() error) (err error) {
+	if settings.DisablePanicRecovery {
+		return fn()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr := &PanicError{Value: r, Stack: debug.Stack()}
+			fields := LoggingFields{"stack": string(panicErr.Stack)}
+			for k, v := range loggingFields {
+				fields[k] = v
+			}
+			settings.GetLogger(ctx).Error(panicErr, "Recovered from panic while processing message", fields)
+			err = panicErr
+		}
+	}()
+	return fn()
+}
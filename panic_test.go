@@ -0,0 +1,51 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallWithRecover(t *testing.T) {
+	ctx := context.Background()
+	logger := &fakeLogger{}
+	settings := createTestSettings()
+	settings.GetLogger = func(_ context.Context) Logger { return logger }
+
+	err := callWithRecover(ctx, settings, LoggingFields{"message_sqs_id": "123"}, func() error {
+		panic("oops")
+	})
+	require.IsType(t, &PanicError{}, err)
+	assert.EqualError(t, err, "panic: oops")
+	assert.Equal(t, "oops", err.(*PanicError).Value)
+	assert.Contains(t, string(err.(*PanicError).Stack), "TestCallWithRecover")
+
+	require.Equal(t, 1, len(logger.logs))
+	assert.Equal(t, "error", logger.logs[0].level)
+	assert.Equal(t, "123", logger.logs[0].fields["message_sqs_id"])
+	assert.Contains(t, logger.logs[0].fields["stack"], "TestCallWithRecover")
+
+	err = callWithRecover(ctx, settings, nil, func() error { return errors.New("my bad") })
+	assert.EqualError(t, err, "my bad")
+}
+
+func TestCallWithRecoverDisabled(t *testing.T) {
+	settings := createTestSettings()
+	settings.DisablePanicRecovery = true
+
+	assert.Panics(t, func() {
+		_ = callWithRecover(context.Background(), settings, nil, func() error {
+			panic("oops")
+		})
+	})
+}
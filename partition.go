@@ -0,0 +1,101 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"sync"
+)
+
+// PartitionKeyFunc returns the key of a message for ordered processing. Messages with the same key are processed one
+// after another, in the order they were received, while messages with different keys are processed concurrently.
+// An empty key means the message may be processed in any order.
+type PartitionKeyFunc func(message *Message) string
+
+// PartitionByHeader returns a PartitionKeyFunc that partitions messages by the given header
+func PartitionByHeader(name string) PartitionKeyFunc {
+	return func(message *Message) string {
+		return message.Metadata.Headers[name]
+	}
+}
+
+// partitionSequencer orders the processing of a batch of messages received together. A message waits for every
+// message received before it to be parsed, and for the ones sharing its key to finish processing.
+type partitionSequencer struct {
+	lock      sync.Mutex
+	cond      *sync.Cond
+	keys      []string
+	announced []bool
+	done      []bool
+}
+
+func newPartitionSequencer(size int) *partitionSequencer {
+	s := &partitionSequencer{
+		keys:      make([]string, size),
+		announced: make([]bool, size),
+		done:      make([]bool, size),
+	}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+// ticket returns the ticket for the i-th message of the batch, or nil if messages aren't ordered
+func (s *partitionSequencer) ticket(i int) *partitionTicket {
+	if s == nil {
+		return nil
+	}
+	return &partitionTicket{sequencer: s, index: i}
+}
+
+// partitionTicket is the place of a message in a batch
+type partitionTicket struct {
+	sequencer *partitionSequencer
+	index     int
+}
+
+// wait blocks until every message with the same key received before this one is done processing. A nil ticket
+// never blocks.
+func (t *partitionTicket) wait(key string) {
+	if t == nil {
+		return
+	}
+	s := t.sequencer
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keys[t.index] = key
+	s.announced[t.index] = true
+	s.cond.Broadcast()
+	if key == "" {
+		return
+	}
+	for !s.ready(t.index, key) {
+		s.cond.Wait()
+	}
+}
+
+func (s *partitionSequencer) ready(index int, key string) bool {
+	for i := 0; i < index; i++ {
+		if !s.announced[i] || (s.keys[i] == key && !s.done[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// release marks the message as done processing. It must be called for every ticket, including messages that failed
+// before their key was known.
+func (t *partitionTicket) release() {
+	if t == nil {
+		return
+	}
+	s := t.sequencer
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.announced[t.index] = true
+	s.done[t.index] = true
+	s.cond.Broadcast()
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitionByHeader(t *testing.T) {
+	message := &Message{Metadata: &metadata{Headers: map[string]string{"vehicle_id": "C_1234567890123456"}}}
+	assert.Equal(t, "C_1234567890123456", PartitionByHeader("vehicle_id")(message))
+	assert.Equal(t, "", PartitionByHeader("user_id")(message))
+}
+
+func TestPartitionSequencer_SameKey(t *testing.T) {
+	sequencer := newPartitionSequencer(3)
+	first, second, third := sequencer.ticket(0), sequencer.ticket(1), sequencer.ticket(2)
+
+	first.wait("C_1")
+	second.wait("C_2")
+
+	waited := make(chan struct{})
+	go func() {
+		third.wait("C_1")
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("message processed before an earlier message with the same key")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	second.release()
+	first.release()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("message not processed after an earlier message with the same key")
+	}
+	third.release()
+}
+
+func TestPartitionSequencer_WaitsForEarlierKeys(t *testing.T) {
+	sequencer := newPartitionSequencer(2)
+	first, second := sequencer.ticket(0), sequencer.ticket(1)
+
+	waited := make(chan struct{})
+	go func() {
+		second.wait("C_1")
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("message processed before the key of an earlier message was known")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a message that fails before its key is known doesn't hold back the others
+	first.release()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("message not processed after an earlier message failed")
+	}
+}
+
+func TestPartitionSequencer_Order(t *testing.T) {
+	const size = 20
+	sequencer := newPartitionSequencer(size)
+	lock := sync.Mutex{}
+	var processed []int
+	wg := sync.WaitGroup{}
+	for i := size - 1; i >= 0; i-- {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ticket := sequencer.ticket(i)
+			defer ticket.release()
+			ticket.wait("C_1")
+			lock.Lock()
+			defer lock.Unlock()
+			processed = append(processed, i)
+		}(i)
+	}
+	wg.Wait()
+	for i := range processed {
+		assert.Equal(t, i, processed[i])
+	}
+}
+
+func TestPartitionTicket_Nil(t *testing.T) {
+	var sequencer *partitionSequencer
+	ticket := sequencer.ticket(0)
+	assert.Nil(t, ticket)
+	ticket.wait("C_1")
+	ticket.release()
+}
+
+func TestAWSClient_messageHandlerPartitionWaitTimeout(t *testing.T) {
+	ctx := context.Background()
+	settings := createTestSettings()
+	settings.PartitionKey = PartitionByHeader("vehicle_id")
+	fakeCallback := &FakeCallback{}
+	settings.CallbackRegistry.RegisterCallback(
+		CallbackKey{MessageType: "vehicle_created", MessageMajorVersion: 1}, fakeCallback.Callback,
+		func() interface{} { return new(FakeHedwigDataField) })
+
+	message, err := NewMessage(settings, "vehicle_created", "1.0", map[string]string{"vehicle_id": "C_1"},
+		&FakeHedwigDataField{VehicleID: "C_1234567890123456"})
+	require.NoError(t, err)
+	messageJSON, err := message.JSONString()
+	require.NoError(t, err)
+
+	sequencer := newPartitionSequencer(2)
+	first, second := sequencer.ticket(0), sequencer.ticket(1)
+	first.wait("C_1")
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		first.release()
+	}()
+
+	// the message waits for the earlier one for longer than its visibility timeout, so its callback isn't called
+	delivery := &messageDelivery{
+		visibilityTimeout: 200 * time.Millisecond,
+		received:          time.Now(),
+		throttle:          true,
+		partition:         second,
+	}
+	err = (&awsClient{}).messageHandler(ctx, settings, messageJSON, delivery, nil)
+	second.release()
+	assert.True(t, isTimeoutError(err))
+	fakeCallback.AssertNotCalled(t, "Callback", mock.Anything, mock.Anything)
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PollingStrategy determines the order in which a priority queue consumer polls its queues
+type PollingStrategy int
+
+const (
+	// PollWeighted polls queues at random, in proportion to their weight
+	PollWeighted PollingStrategy = iota
+	// PollStrictPriority always drains queues in the order they're configured, i.e. a queue is only polled when all
+	// queues before it are empty. When all queues are empty, the first one is long polled.
+	PollStrictPriority
+)
+
+// strictPriorityWaitTimeSeconds is the long poll duration used to check whether a queue is empty with
+// PollStrictPriority. Short polls only sample a subset of SQS servers, so they may miss messages on a queue that isn't
+// empty.
+const strictPriorityWaitTimeSeconds = 1
+
+// maxEmptyPollsDecay limits how much the weight of an empty queue decays (by half per empty poll)
+const maxEmptyPollsDecay = 4
+
+// priorityQueue is the polling state of a single queue
+type priorityQueue struct {
+	config   *QueueConfig
+	settings *Settings
+	// number of consecutive polls that returned no messages
+	emptyPolls int
+}
+
+// effectiveWeight is the configured weight, halved for every consecutive empty poll
+func (q *priorityQueue) effectiveWeight() float64 {
+	weight := float64(q.config.weight())
+	emptyPolls := q.emptyPolls
+	if emptyPolls > maxEmptyPollsDecay {
+		emptyPolls = maxEmptyPollsDecay
+	}
+	return weight / float64(int(1)<<uint(emptyPolls))
+}
+
+type priorityQueueConsumer struct {
+	consumer
+	listener
+
+	strategy PollingStrategy
+	queues   []*priorityQueue
+	rand     *rand.Rand
+}
+
+// pickWeighted picks one of the queues at random, in proportion to their effective weight
+func (c *priorityQueueConsumer) pickWeighted(queues []*priorityQueue) *priorityQueue {
+	total := 0.0
+	for _, q := range queues {
+		total += q.effectiveWeight()
+	}
+	r := c.rand.Float64() * total
+	for _, q := range queues {
+		r -= q.effectiveWeight()
+		if r < 0 {
+			return q
+		}
+	}
+	return queues[len(queues)-1]
+}
+
+// pollOrder returns the order in which queues should be short-polled in one iteration
+func (c *priorityQueueConsumer) pollOrder() []*priorityQueue {
+	if c.strategy == PollStrictPriority {
+		return c.queues
+	}
+	remaining := append([]*priorityQueue{}, c.queues...)
+	order := make([]*priorityQueue, 0, len(remaining))
+	for len(remaining) > 0 {
+		q := c.pickWeighted(remaining)
+		order = append(order, q)
+		for i := range remaining {
+			if remaining[i] == q {
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+	return order
+}
+
+func (c *priorityQueueConsumer) poll(ctx context.Context, q *priorityQueue, request *ListenRequest,
+	waitTimeSeconds int64, state *consumerState) (int, error) {
+
+	numMessages := request.NumMessages
+	if q.config.NumMessages != 0 {
+		numMessages = q.config.NumMessages
+	}
+	visibilityTimeoutS := request.VisibilityTimeoutS
+	if q.config.VisibilityTimeoutS != 0 {
+		visibilityTimeoutS = q.config.VisibilityTimeoutS
+	}
+	received, err := c.awsClient.PollAndProcessMessages(
+		ctx, q.settings, numMessages, visibilityTimeoutS, waitTimeSeconds, state)
+	if _, ok := err.(*AbandonedMessagesError); ok {
+		return 0, err
+	}
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to poll queue %s", q.config.QueueName)
+	}
+	if received == 0 {
+		q.emptyPolls++
+	} else {
+		q.emptyPolls = 0
+	}
+	return received, nil
+}
+
+// iterate polls queues in order until one of them returns messages. With PollStrictPriority, queues are checked with
+// a brief long poll, so a higher priority queue is only skipped when it's actually empty; if all queues are empty, the
+// highest priority queue is long polled. With PollWeighted, queues are short polled, and if all of them are empty, a
+// queue is long polled, picked by its effective weight so queues that have been empty recently are less likely to be
+// picked.
+func (c *priorityQueueConsumer) iterate(ctx context.Context, request *ListenRequest, state *consumerState) error {
+	waitTimeSeconds := int64(0)
+	if c.strategy == PollStrictPriority {
+		waitTimeSeconds = strictPriorityWaitTimeSeconds
+	}
+	for _, q := range c.pollOrder() {
+		received, err := c.poll(ctx, q, request, waitTimeSeconds, state)
+		if err != nil || received > 0 || state.stopped() {
+			return err
+		}
+	}
+	fallback := c.queues[0]
+	if c.strategy != PollStrictPriority {
+		fallback = c.pickWeighted(c.queues)
+	}
+	_, err := c.poll(ctx, fallback, request, sqsWaitTimeoutSeconds, state)
+	return err
+}
+
+// ListenForMessages starts a hedwig listener on all queues
+func (c *priorityQueueConsumer) ListenForMessages(ctx context.Context, request *ListenRequest) error {
+	if len(c.queues) == 0 {
+		return errors.New("no queues configured")
+	}
+	if request.NumMessages == 0 {
+		request.NumMessages = 1
+	}
+
+	state := c.start()
+	if state == nil {
+		return nil
+	}
+	defer close(state.done)
+
+	for i := uint32(0); request.LoopCount == 0 || i < request.LoopCount; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-state.stopPolling:
+			return nil
+		default:
+			if deadline, ok := ctx.Deadline(); ok {
+				// is shutting down?
+				if time.Until(deadline) < c.settings.ShutdownTimeout {
+					return nil
+				}
+			}
+			if err := c.iterate(ctx, request, state); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Shutdown stops polling for new messages right away, and waits for in-flight messages to finish processing
+func (c *priorityQueueConsumer) Shutdown(ctx context.Context) error {
+	return c.stop(ctx, c.settings)
+}
+
+// NewPriorityQueueConsumer creates a new consumer object that polls several queues from a single listener, giving
+// precedence to some queues over others. With PollStrictPriority, queues are drained in the order given; with
+// PollWeighted, queues are polled in proportion to QueueConfig.Weight, and queues that have been empty recently are
+// less likely to be long polled. settings.QueueName is ignored.
+func NewPriorityQueueConsumer(sessionCache *AWSSessionsCache, settings *Settings, strategy PollingStrategy,
+	queues ...*QueueConfig) IQueueConsumer {
+
+	settings.initDefaults()
+	priorityQueues := make([]*priorityQueue, len(queues))
+	for i, queue := range queues {
+		priorityQueues[i] = &priorityQueue{
+			config:   queue,
+			settings: queue.settings(settings),
+		}
+	}
+	return &priorityQueueConsumer{
+		consumer: consumer{
+			awsClient: newAWSClient(sessionCache, settings),
+			settings:  settings,
+		},
+		strategy: strategy,
+		queues:   priorityQueues,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestPriorityQueueConsumer(awsClient iAmazonWebServicesClient, strategy PollingStrategy,
+	queues ...*QueueConfig) *priorityQueueConsumer {
+
+	settings := &Settings{
+		AWSRegion:    "us-east-1",
+		AWSAccountID: "1234567890",
+	}
+	settings.initDefaults()
+	consumer := NewPriorityQueueConsumer(&AWSSessionsCache{}, settings, strategy, queues...).(*priorityQueueConsumer)
+	consumer.awsClient = awsClient
+	consumer.rand = rand.New(rand.NewSource(1))
+	return consumer
+}
+
+func TestPriorityQueue_EffectiveWeight(t *testing.T) {
+	q := &priorityQueue{config: &QueueConfig{}}
+	assert.Equal(t, 1.0, q.effectiveWeight())
+
+	q.config.Weight = 8
+	assert.Equal(t, 8.0, q.effectiveWeight())
+	q.emptyPolls = 2
+	assert.Equal(t, 2.0, q.effectiveWeight())
+	q.emptyPolls = 100
+	assert.Equal(t, 0.5, q.effectiveWeight())
+}
+
+func TestPriorityQueueConsumer_StrictPriority(t *testing.T) {
+	ctx := context.Background()
+	awsClient := &FakeAWSClient{}
+	consumer := newTestPriorityQueueConsumer(awsClient, PollStrictPriority,
+		&QueueConfig{QueueName: "dev-myapp-interactive", NumMessages: 10},
+		&QueueConfig{QueueName: "dev-myapp-bulk"},
+	)
+	high := consumer.queues[0].settings
+	low := consumer.queues[1].settings
+
+	wait := int64(strictPriorityWaitTimeSeconds)
+	// high priority queue has messages
+	awsClient.On("PollAndProcessMessages", ctx, high, uint32(10), uint32(0), wait).Return(10, nil).Once()
+	// high priority queue drained, low priority queue has messages
+	awsClient.On("PollAndProcessMessages", ctx, high, uint32(10), uint32(0), wait).Return(0, nil).Once()
+	awsClient.On("PollAndProcessMessages", ctx, low, uint32(1), uint32(0), wait).Return(1, nil).Once()
+	// everything is empty, so the high priority queue is long polled
+	for i := 0; i < 2; i++ {
+		awsClient.On("PollAndProcessMessages", ctx, high, uint32(10), uint32(0), wait).Return(0, nil).Once()
+		awsClient.On("PollAndProcessMessages", ctx, low, uint32(1), uint32(0), wait).Return(0, nil).Once()
+		awsClient.On("PollAndProcessMessages", ctx, high, uint32(10), uint32(0), sqsWaitTimeoutSeconds).
+			Return(0, nil).Once()
+	}
+
+	err := consumer.ListenForMessages(ctx, &ListenRequest{LoopCount: 4})
+	assert.NoError(t, err)
+	awsClient.AssertExpectations(t)
+}
+
+func TestPriorityQueueConsumer_Weighted(t *testing.T) {
+	ctx := context.Background()
+	awsClient := &FakeAWSClient{}
+	consumer := newTestPriorityQueueConsumer(awsClient, PollWeighted,
+		&QueueConfig{QueueName: "dev-myapp-interactive", Weight: 9},
+		&QueueConfig{QueueName: "dev-myapp-bulk", Weight: 1},
+	)
+	high := consumer.queues[0].settings
+	low := consumer.queues[1].settings
+
+	// both queues always have messages, so only the first queue picked is polled in each iteration
+	awsClient.On("PollAndProcessMessages", ctx, mock.Anything, uint32(1), uint32(0), int64(0)).Return(1, nil)
+
+	err := consumer.ListenForMessages(ctx, &ListenRequest{LoopCount: 1000})
+	assert.NoError(t, err)
+
+	counts := map[*Settings]int{}
+	for _, call := range awsClient.Calls {
+		counts[call.Arguments.Get(1).(*Settings)]++
+	}
+	assert.Equal(t, 1000, counts[high]+counts[low])
+	assert.True(t, counts[high] > 800, "high priority polled %d times", counts[high])
+	assert.True(t, counts[low] > 50, "low priority polled %d times", counts[low])
+}
+
+func TestPriorityQueueConsumer_WeightsAdapt(t *testing.T) {
+	consumer := newTestPriorityQueueConsumer(&FakeAWSClient{}, PollWeighted,
+		&QueueConfig{QueueName: "dev-myapp-interactive", Weight: 4},
+		&QueueConfig{QueueName: "dev-myapp-bulk", Weight: 1},
+	)
+	// interactive queue has been empty for a while
+	consumer.queues[0].emptyPolls = 4
+
+	counts := map[*priorityQueue]int{}
+	for i := 0; i < 1000; i++ {
+		counts[consumer.pickWeighted(consumer.queues)]++
+	}
+	assert.True(t, counts[consumer.queues[1]] > counts[consumer.queues[0]])
+}
+
+func TestPriorityQueueConsumer_Error(t *testing.T) {
+	ctx := context.Background()
+	awsClient := &FakeAWSClient{}
+	consumer := newTestPriorityQueueConsumer(awsClient, PollStrictPriority,
+		&QueueConfig{QueueName: "dev-myapp"},
+	)
+	awsClient.On("PollAndProcessMessages", ctx, mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(0, errors.New("no internet"))
+
+	err := consumer.ListenForMessages(ctx, &ListenRequest{})
+	assert.EqualError(t, err, "failed to poll queue dev-myapp: no internet")
+}
+
+func TestPriorityQueueConsumer_NoQueues(t *testing.T) {
+	consumer := newTestPriorityQueueConsumer(&FakeAWSClient{}, PollWeighted)
+	assert.EqualError(t, consumer.ListenForMessages(context.Background(), &ListenRequest{}), "no queues configured")
+}
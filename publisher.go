@@ -16,6 +16,12 @@ import (
 // IPublisher handles all publish related functions
 type IPublisher interface {
 	Publish(ctx context.Context, message *Message) error
+
+	// Request publishes a request, and waits for its reply
+	Request(ctx context.Context, message *Message) (*Message, error)
+
+	// Reply publishes the reply to a request
+	Reply(ctx context.Context, request *Message, data interface{}) error
 }
 
 // Publisher handles hedwig publishing for Automatic
@@ -24,8 +30,30 @@ type Publisher struct {
 	settings  *Settings
 }
 
-// Publish a message on Hedwig
+// Publish a message on Hedwig. If the message type is being migrated (see Settings.DualPublishing), the message is
+// also converted to, and published as, the other major versions. Messages published from a callback inherit the
+// correlation id of the message being processed, and are marked as caused by it.
 func (p *Publisher) Publish(ctx context.Context, message *Message) error {
+	message.inheritHeaders(ctx)
+	if err := p.publish(ctx, message); err != nil {
+		return err
+	}
+	for _, majorVersion := range p.settings.DualPublishing[message.dataType] {
+		if majorVersion == int(message.DataSchemaVersion.Major()) {
+			continue
+		}
+		converted, err := message.Convert(ctx, p.settings, majorVersion)
+		if err != nil {
+			return errors.Wrapf(err, "failed to publish %s v%d", message.dataType, majorVersion)
+		}
+		if err := p.publish(ctx, converted); err != nil {
+			return errors.Wrapf(err, "failed to publish %s v%d", message.dataType, majorVersion)
+		}
+	}
+	return nil
+}
+
+func (p *Publisher) publish(ctx context.Context, message *Message) error {
 	err := message.validate()
 	if err != nil {
 		return err
@@ -237,3 +237,68 @@ func TestNewPublisher(t *testing.T) {
 	publisher := NewPublisher(sessionCache, settings)
 	assert.NotNil(t, publisher)
 }
+
+func TestPublishDualPublishing(t *testing.T) {
+	ctx := context.Background()
+	settings := createTestSettings()
+	settings.MessageRouting = map[MessageRouteKey]string{
+		{MessageType: "trip_created", MessageMajorVersion: 1}: "dev-trip-created-v1",
+		{MessageType: "trip_created", MessageMajorVersion: 2}: "dev-trip-created-v2",
+	}
+	settings.ConverterRegistry = newTestConverterRegistry(t)
+	settings.DualPublishing = map[string][]int{"trip_created": {1, 2}}
+	awsClient := &FakeAWSClient{}
+
+	publisher := &Publisher{
+		awsClient: awsClient,
+		settings:  settings,
+	}
+
+	data := &fakeTripCreatedV2{VehicleID: "C_1234567890123456", UserID: "U_1234567890123456", VIN: "1FTEW1EG5GFA12345"}
+	message, err := NewMessage(settings, "trip_created", "2.0", nil, data)
+	require.NoError(t, err)
+	messageBody, err := message.JSONString()
+	require.NoError(t, err)
+	converted, err := message.Convert(ctx, settings, 1)
+	require.NoError(t, err)
+	convertedBody, err := converted.JSONString()
+	require.NoError(t, err)
+
+	awsClient.On("PublishSNS", ctx, settings, "dev-trip-created-v2", messageBody, message.Metadata.Headers).
+		Return(nil)
+	awsClient.On("PublishSNS", ctx, settings, "dev-trip-created-v1", convertedBody, converted.Metadata.Headers).
+		Return(nil)
+
+	err = publisher.Publish(ctx, message)
+	assert.NoError(t, err)
+
+	awsClient.AssertExpectations(t)
+}
+
+func TestPublishDualPublishingNoConverter(t *testing.T) {
+	ctx := context.Background()
+	settings := createTestSettings()
+	settings.MessageRouting = map[MessageRouteKey]string{
+		{MessageType: "vehicle_created", MessageMajorVersion: 1}: "dev-vehicle-created",
+	}
+	settings.ConverterRegistry = NewConverterRegistry()
+	settings.DualPublishing = map[string][]int{"vehicle_created": {2}}
+	awsClient := &FakeAWSClient{}
+
+	publisher := &Publisher{
+		awsClient: awsClient,
+		settings:  settings,
+	}
+
+	message, err := NewMessage(settings, "vehicle_created", "1.0", nil, &FakeHedwigDataField{
+		VehicleID: "C_1234567890123456",
+	})
+	require.NoError(t, err)
+	awsClient.On("PublishSNS", ctx, settings, "dev-vehicle-created", mock.Anything, mock.Anything).Return(nil)
+
+	err = publisher.Publish(ctx, message)
+	assert.EqualError(t, err,
+		"failed to publish vehicle_created v2: converter is not defined for vehicle_created from v1 to v2")
+
+	awsClient.AssertExpectations(t)
+}
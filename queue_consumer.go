@@ -9,24 +9,193 @@ package hedwig
 
 import (
 	"context"
-
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+// AbandonedMessagesError is returned by Shutdown if in-flight messages didn't finish processing within the grace
+// period. These messages will be retried once their visibility timeout expires.
+type AbandonedMessagesError struct {
+	// SQS message ids of abandoned messages
+	MessageIDs []string
+}
+
+func (e *AbandonedMessagesError) Error() string {
+	return fmt.Sprintf("abandoned %d in-flight message(s): %s", len(e.MessageIDs), strings.Join(e.MessageIDs, ", "))
+}
+
+// consumerState is shared between a queue consumer and the AWS client while listening for messages
+type consumerState struct {
+	// closed when the consumer should stop polling for new messages
+	stopPolling chan struct{}
+	stopOnce    sync.Once
+	// closed when the listener returns
+	done chan struct{}
+	// closed when in-flight messages are abandoned, once the shutdown grace period expires
+	abandoned   chan struct{}
+	abandonOnce sync.Once
+	abandonErr  error
+
+	lock     sync.Mutex
+	inFlight map[string]bool
+}
+
+func newConsumerState() *consumerState {
+	return &consumerState{
+		stopPolling: make(chan struct{}),
+		done:        make(chan struct{}),
+		abandoned:   make(chan struct{}),
+		inFlight:    map[string]bool{},
+	}
+}
+
+func (s *consumerState) stop() {
+	s.stopOnce.Do(func() { close(s.stopPolling) })
+}
+
+func (s *consumerState) stopped() bool {
+	select {
+	case <-s.stopPolling:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *consumerState) abandon(err error) {
+	s.abandonOnce.Do(func() {
+		s.abandonErr = err
+		close(s.abandoned)
+	})
+}
+
+// wait waits for in-flight messages to finish processing. If they're abandoned on shutdown, this returns right away
+// with the abandoned messages error, leaving them to finish in the background.
+func (s *consumerState) wait(wg *sync.WaitGroup) error {
+	if s == nil {
+		wg.Wait()
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-s.abandoned:
+		return s.abandonErr
+	}
+}
+
+func (s *consumerState) track(sqsMessageID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.inFlight[sqsMessageID] = true
+}
+
+func (s *consumerState) untrack(sqsMessageID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.inFlight, sqsMessageID)
+}
+
+func (s *consumerState) inFlightMessageIDs() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ids := make([]string, 0, len(s.inFlight))
+	for id := range s.inFlight {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// listener manages the state of a running listener, so it can be shut down
+type listener struct {
+	lock     sync.Mutex
+	state    *consumerState
+	shutdown bool
+}
+
+// start returns the state for a new listen loop, or nil if the listener has been shut down. The caller must close
+// state.done when the loop returns.
+func (l *listener) start() *consumerState {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.shutdown {
+		return nil
+	}
+	l.state = newConsumerState()
+	return l.state
+}
+
+// stop stops polling right away, and waits for in-flight messages to finish processing. Messages are deleted before
+// they're considered done, so there are no pending acknowledgements left to flush once this returns. Messages still
+// in-flight after the grace period are abandoned, and the listen loop returns right away.
+func (l *listener) stop(ctx context.Context, settings *Settings) error {
+	l.lock.Lock()
+	l.shutdown = true
+	state := l.state
+	l.lock.Unlock()
+	if state == nil {
+		return nil
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, settings.ShutdownTimeout)
+		defer cancel()
+	}
+
+	state.stop()
+	select {
+	case <-state.done:
+		return nil
+	case <-ctx.Done():
+		messageIDs := state.inFlightMessageIDs()
+		for _, messageID := range messageIDs {
+			settings.GetLogger(ctx).Warn(ctx.Err(), "Abandoning in-flight message on shutdown", LoggingFields{
+				"message_sqs_id": messageID,
+			})
+		}
+		err := &AbandonedMessagesError{MessageIDs: messageIDs}
+		state.abandon(err)
+		return err
+	}
+}
+
 type queueConsumer struct {
 	consumer
+	listener
 }
 
-// ListenForMessages starts a hedwig listener for the provided message types
+// ListenForMessages starts a hedwig listener for the provided message types. If in-flight messages are abandoned on
+// shutdown, this returns an *AbandonedMessagesError once the grace period expires.
 func (c *queueConsumer) ListenForMessages(ctx context.Context, request *ListenRequest) error {
 	if request.NumMessages == 0 {
 		request.NumMessages = 1
 	}
 
+	state := c.start()
+	if state == nil {
+		return nil
+	}
+	defer close(state.done)
+
 	for i := uint32(0); request.LoopCount == 0 || i < request.LoopCount; i++ {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
+		case <-state.stopPolling:
+			return nil
 		default:
 			if deadline, ok := ctx.Deadline(); ok {
 				// is shutting down?
@@ -35,7 +204,7 @@ func (c *queueConsumer) ListenForMessages(ctx context.Context, request *ListenRe
 				}
 			}
 			if err := c.awsClient.FetchAndProcessMessages(
-				ctx, c.settings, request.NumMessages, request.VisibilityTimeoutS,
+				ctx, c.settings, request.NumMessages, request.VisibilityTimeoutS, state,
 			); err != nil {
 				return err
 			}
@@ -44,6 +213,40 @@ func (c *queueConsumer) ListenForMessages(ctx context.Context, request *ListenRe
 	return nil
 }
 
+// Shutdown stops polling for new messages right away, and waits for in-flight messages to finish processing
+func (c *queueConsumer) Shutdown(ctx context.Context) error {
+	return c.stop(ctx, c.settings)
+}
+
+// ShutdownOnSignals gracefully shuts down the consumer when one of the given signals is received (SIGTERM and
+// SIGINT by default), allowing settings.ShutdownTimeout for in-flight messages to finish. Only the first signal is
+// handled; later signals have their default behavior, so a second SIGINT kills the process right away. Abandoned
+// messages are reported by ListenForMessages. The returned function stops listening for signals.
+func ShutdownOnSignals(consumer IQueueConsumer, signals ...os.Signal) (stop func()) {
+	if len(signals) == 0 {
+		signals = []os.Signal{syscall.SIGTERM, syscall.SIGINT}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	quit := make(chan struct{})
+	go func() {
+		select {
+		case <-ch:
+			signal.Stop(ch)
+			// ListenForMessages returns the same error
+			_ = consumer.Shutdown(context.Background())
+		case <-quit:
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(quit)
+		})
+	}
+}
+
 // NewQueueConsumer creates a new consumer object used for a queue
 func NewQueueConsumer(sessionCache *AWSSessionsCache, settings *Settings) IQueueConsumer {
 	settings.initDefaults()
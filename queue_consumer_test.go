@@ -9,6 +9,7 @@ package hedwig
 
 import (
 	"context"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -119,6 +120,117 @@ func TestConsumer_ListenForMessagesContextDeadline(t *testing.T) {
 	assert.True(t, len(awsClient.Calls) < 1000)
 }
 
+type blockingAWSClient struct {
+	FakeAWSClient
+	release chan struct{}
+}
+
+func (b *blockingAWSClient) FetchAndProcessMessages(ctx context.Context, settings *Settings, numMessages uint32,
+	visibilityTimeoutS uint32, state *consumerState) error {
+
+	state.track("in-flight-message")
+	defer state.untrack("in-flight-message")
+	select {
+	case <-b.release:
+		return nil
+	case <-state.abandoned:
+		return state.abandonErr
+	}
+}
+
+func TestConsumer_Shutdown(t *testing.T) {
+	ctx := context.Background()
+	settings := &Settings{
+		AWSRegion:    "us-east-1",
+		AWSAccountID: "1234567890",
+		QueueName:    "dev-myapp",
+	}
+	settings.initDefaults()
+	awsClient := &blockingAWSClient{release: make(chan struct{})}
+	consumer := queueConsumer{
+		consumer: consumer{
+			awsClient: awsClient,
+			settings:  settings,
+		},
+	}
+	ch := make(chan bool)
+	go func() {
+		err := consumer.ListenForMessages(ctx, &ListenRequest{})
+		assert.NoError(t, err)
+		close(ch)
+	}()
+	time.Sleep(1 * time.Millisecond)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(awsClient.release)
+	}()
+	shutdownCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	err := consumer.Shutdown(shutdownCtx)
+	assert.NoError(t, err)
+	<-ch
+
+	// listener doesn't restart after shutdown
+	assert.NoError(t, consumer.ListenForMessages(ctx, &ListenRequest{}))
+}
+
+func TestConsumer_ShutdownAbandonsMessages(t *testing.T) {
+	ctx := context.Background()
+	logger := &fakeLogger{}
+	settings := &Settings{
+		AWSRegion:    "us-east-1",
+		AWSAccountID: "1234567890",
+		QueueName:    "dev-myapp",
+		GetLogger:    func(_ context.Context) Logger { return logger },
+	}
+	settings.initDefaults()
+	awsClient := &blockingAWSClient{release: make(chan struct{})}
+	defer close(awsClient.release)
+	consumer := queueConsumer{
+		consumer: consumer{
+			awsClient: awsClient,
+			settings:  settings,
+		},
+	}
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- consumer.ListenForMessages(ctx, &ListenRequest{})
+	}()
+	time.Sleep(1 * time.Millisecond)
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err := consumer.Shutdown(shutdownCtx)
+	assert.Equal(t, &AbandonedMessagesError{MessageIDs: []string{"in-flight-message"}}, err)
+	assert.Equal(t, 1, len(logger.logs))
+	assert.Equal(t, "in-flight-message", logger.logs[0].fields["message_sqs_id"])
+
+	// the listener returns once the grace period expires, without waiting for in-flight messages
+	select {
+	case err := <-listenErr:
+		assert.Equal(t, &AbandonedMessagesError{MessageIDs: []string{"in-flight-message"}}, err)
+	case <-time.After(time.Second):
+		t.Fatal("listener didn't return after the grace period")
+	}
+}
+
+func TestConsumerState_WaitAbandoned(t *testing.T) {
+	state := newConsumerState()
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	defer wg.Done()
+
+	err := &AbandonedMessagesError{MessageIDs: []string{"in-flight-message"}}
+	state.abandon(err)
+	assert.Equal(t, err, state.wait(&wg))
+}
+
+func TestConsumer_ShutdownNotListening(t *testing.T) {
+	consumer := NewQueueConsumer(&AWSSessionsCache{}, &Settings{QueueName: "dev-myapp"})
+	assert.NoError(t, consumer.Shutdown(context.Background()))
+}
+
 func TestNewQueueConsumer(t *testing.T) {
 	settings := &Settings{
 		AWSRegion:    "us-east-1",
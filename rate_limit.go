@@ -0,0 +1,106 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// minThrottleDelay is the least time a throttled message is deferred for. SQS visibility timeouts have a granularity
+// of one second.
+const minThrottleDelay = time.Second
+
+// CallbackLimits limits how fast messages are processed by a callback. Limits are enforced per consumer process.
+type CallbackLimits struct {
+	// Maximum number of messages processed per second, on average. Zero means unlimited.
+	RateLimit float64
+
+	// Maximum number of messages processed in a burst when RateLimit is set. Defaults to 1.
+	Burst int
+
+	// Maximum number of messages processed concurrently. Callbacks that time out count towards the limit until they
+	// return. Zero means unlimited.
+	MaxInFlight int
+}
+
+// throttledError is returned when a message is over its callback limits. The message is deferred until the callback
+// is expected to be under its limits again.
+type throttledError struct {
+	delay time.Duration
+}
+
+func (e *throttledError) Error() string {
+	return fmt.Sprintf("callback throttled, deferring for %s", e.delay)
+}
+
+func isThrottledError(err error) bool {
+	_, ok := errors.Cause(err).(*throttledError)
+	return ok
+}
+
+// callbackLimiter is a token bucket, combined with a counter of in-flight messages
+type callbackLimiter struct {
+	lock     sync.Mutex
+	limits   CallbackLimits
+	tokens   float64
+	last     time.Time
+	inFlight int
+}
+
+func newCallbackLimiter(limits *CallbackLimits) *callbackLimiter {
+	l := &callbackLimiter{limits: *limits}
+	if l.limits.Burst <= 0 {
+		l.limits.Burst = 1
+	}
+	l.tokens = float64(l.limits.Burst)
+	return l
+}
+
+// acquire admits a message if it's under the limits, and returns a function that must be called once it's
+// processed. Otherwise, a throttledError is returned.
+func (l *callbackLimiter) acquire(now time.Time) (func(), error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.limits.MaxInFlight > 0 && l.inFlight >= l.limits.MaxInFlight {
+		return nil, &throttledError{delay: minThrottleDelay}
+	}
+	if l.limits.RateLimit > 0 {
+		if !l.last.IsZero() {
+			l.tokens += now.Sub(l.last).Seconds() * l.limits.RateLimit
+			if l.tokens > float64(l.limits.Burst) {
+				l.tokens = float64(l.limits.Burst)
+			}
+		}
+		l.last = now
+		if l.tokens < 1 {
+			// round up to whole seconds so the message isn't received again before a token is available
+			delay := time.Duration(math.Ceil((1-l.tokens)/l.limits.RateLimit)) * time.Second
+			if delay < minThrottleDelay {
+				delay = minThrottleDelay
+			}
+			return nil, &throttledError{delay: delay}
+		}
+		l.tokens--
+	}
+	l.inFlight++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.lock.Lock()
+			defer l.lock.Unlock()
+			l.inFlight--
+		})
+	}, nil
+}
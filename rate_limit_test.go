@@ -0,0 +1,91 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallbackLimiter_RateLimit(t *testing.T) {
+	limiter := newCallbackLimiter(&CallbackLimits{RateLimit: 0.5, Burst: 2})
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		release, err := limiter.acquire(now)
+		require.NoError(t, err)
+		release()
+	}
+
+	_, err := limiter.acquire(now)
+	assert.Equal(t, &throttledError{delay: 2 * time.Second}, err)
+
+	// half a token refilled
+	_, err = limiter.acquire(now.Add(time.Second))
+	assert.Equal(t, &throttledError{delay: time.Second}, err)
+
+	release, err := limiter.acquire(now.Add(2 * time.Second))
+	assert.NoError(t, err)
+	release()
+
+	// bucket never holds more than burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		release, err := limiter.acquire(now)
+		require.NoError(t, err)
+		release()
+	}
+	_, err = limiter.acquire(now)
+	assert.Error(t, err)
+}
+
+func TestCallbackLimiter_MaxInFlight(t *testing.T) {
+	limiter := newCallbackLimiter(&CallbackLimits{MaxInFlight: 2})
+	now := time.Now()
+
+	release1, err := limiter.acquire(now)
+	require.NoError(t, err)
+	release2, err := limiter.acquire(now)
+	require.NoError(t, err)
+
+	_, err = limiter.acquire(now)
+	assert.Equal(t, &throttledError{delay: minThrottleDelay}, err)
+
+	release1()
+	// releasing twice has no effect
+	release1()
+	release3, err := limiter.acquire(now)
+	assert.NoError(t, err)
+
+	_, err = limiter.acquire(now)
+	assert.Error(t, err)
+
+	release2()
+	release3()
+}
+
+func TestCallbackRegistry_Acquire(t *testing.T) {
+	registry := NewCallbackRegistry()
+	cbk := CallbackKey{MessageType: "vehicle_created", MessageMajorVersion: 1}
+
+	// unlimited by default
+	for i := 0; i < 100; i++ {
+		_, err := registry.acquire(cbk)
+		require.NoError(t, err)
+	}
+
+	registry.SetCallbackLimits(cbk, &CallbackLimits{MaxInFlight: 1})
+	_, err := registry.acquire(cbk)
+	require.NoError(t, err)
+	_, err = registry.acquire(cbk)
+	assert.True(t, isThrottledError(errors.Wrap(err, "wrapped")))
+}
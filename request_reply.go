@@ -0,0 +1,209 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/pkg/errors"
+)
+
+// ReplyToHeader is the message header of a request naming the message type and schema version of the reply, as
+// <message type>/<version>
+const ReplyToHeader = "reply_to"
+
+// defaultRequestTimeout is the time a request waits for its reply if settings.RequestTimeout isn't set
+const defaultRequestTimeout = 30 * time.Second
+
+// ErrRequestTimeout is returned when the reply to a request doesn't arrive in time
+var ErrRequestTimeout = errors.New("request timed out waiting for reply")
+
+// SetReplyTo sets the message type and schema version that the reply to this request is published as
+func (m *Message) SetReplyTo(messageType string, dataSchemaVersion string) {
+	if m.Metadata.Headers == nil {
+		m.Metadata.Headers = map[string]string{}
+	}
+	m.Metadata.Headers[ReplyToHeader] = fmt.Sprintf("%s/%s", messageType, dataSchemaVersion)
+}
+
+// replyTo returns the message type and schema version of the reply to this request
+func (m *Message) replyTo() (string, string, error) {
+	replyTo, ok := m.Metadata.Headers[ReplyToHeader]
+	if !ok {
+		return "", "", errors.New("message has no reply_to header")
+	}
+	parts := strings.SplitN(replyTo, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.Errorf("invalid reply_to header: %s", replyTo)
+	}
+	return parts[0], parts[1], nil
+}
+
+// pendingRequest is a request waiting for its reply
+type pendingRequest struct {
+	replyType string
+	reply     chan *Message
+}
+
+// replyRegistry tracks the requests that are waiting for a reply. Requests are keyed by correlation id, which is
+// unique across processes.
+type replyRegistry struct {
+	lock    sync.Mutex
+	pending map[string]*pendingRequest
+}
+
+func newReplyRegistry() *replyRegistry {
+	return &replyRegistry{pending: map[string]*pendingRequest{}}
+}
+
+func (r *replyRegistry) add(correlationID string, replyType string) (*pendingRequest, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.pending[correlationID]; ok {
+		return nil, errors.Errorf("request with correlation id %s is already pending", correlationID)
+	}
+	request := &pendingRequest{replyType: replyType, reply: make(chan *Message, 1)}
+	r.pending[correlationID] = request
+	return request, nil
+}
+
+func (r *replyRegistry) remove(correlationID string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.pending, correlationID)
+}
+
+// waiting returns whether a request is waiting for the message
+func (r *replyRegistry) waiting(message *Message) bool {
+	if r == nil {
+		return false
+	}
+	correlationID, ok := message.Metadata.Headers[CorrelationIDHeader]
+	if !ok {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	request, ok := r.pending[correlationID]
+	return ok && request.replyType == message.dataType
+}
+
+// deliver hands a reply to the request waiting for it. Returns false if no request is waiting for the message.
+func (r *replyRegistry) deliver(message *Message) bool {
+	if r == nil {
+		return false
+	}
+	correlationID, ok := message.Metadata.Headers[CorrelationIDHeader]
+	if !ok {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	request, ok := r.pending[correlationID]
+	if !ok || request.replyType != message.dataType {
+		return false
+	}
+	delete(r.pending, correlationID)
+	request.reply <- message
+	return true
+}
+
+// Request publishes a request, and waits for its reply. The reply type must be set with Message.SetReplyTo, and
+// registered with settings.CallbackRegistry, so the reply can be deserialized. A consumer created with the same
+// settings as the publisher must be running for the queue the reply is delivered to; consumers of other processes
+// reading the same queue can't deliver the reply, so each replica needs a reply queue of its own. The correlation id
+// header defaults to the message id, even when called from a callback, so replies are matched to a single request.
+// Gives up after settings.RequestTimeout, or when the context is done.
+func (p *Publisher) Request(ctx context.Context, message *Message) (*Message, error) {
+	replyType, replyVersion, err := message.replyTo()
+	if err != nil {
+		return nil, err
+	}
+	if err := validateReplyType(p.settings, replyType, replyVersion); err != nil {
+		return nil, err
+	}
+	correlationID, ok := message.Metadata.Headers[CorrelationIDHeader]
+	if !ok {
+		correlationID = message.ID
+		message.Metadata.Headers[CorrelationIDHeader] = correlationID
+	}
+
+	replies := p.settings.replies
+	if replies == nil {
+		return nil, errors.New("publisher settings aren't initialized, use NewPublisher")
+	}
+	request, err := replies.add(correlationID, replyType)
+	if err != nil {
+		return nil, err
+	}
+	defer replies.remove(correlationID)
+
+	if err := p.Publish(ctx, message); err != nil {
+		return nil, err
+	}
+
+	timeout := p.settings.RequestTimeout
+	if timeout == 0 {
+		timeout = defaultRequestTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case reply := <-request.reply:
+		return reply, nil
+	case <-timer.C:
+		return nil, errors.Wrapf(ErrRequestTimeout, "no reply after %s", timeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// validateReplyType checks that the reply type of a request has a data factory, without which consumers can't
+// deserialize the reply
+func validateReplyType(settings *Settings, replyType string, replyVersion string) error {
+	version, err := semver.NewVersion(replyVersion)
+	if err != nil {
+		return errors.Wrapf(err, "invalid reply version: %s", replyVersion)
+	}
+	cbk := CallbackKey{MessageType: replyType, MessageMajorVersion: int(version.Major())}
+	if settings.CallbackRegistry == nil {
+		return errors.Errorf("no callback registered for reply type %v, settings.CallbackRegistry is nil", cbk)
+	}
+	if _, err := settings.CallbackRegistry.getMessageDataFactory(cbk); err != nil {
+		return errors.Errorf("no callback registered for reply type %v", cbk)
+	}
+	return nil
+}
+
+// Reply publishes the reply to a request, as the message type and schema version named by its reply_to header.
+// The reply keeps the correlation id of the request.
+func (p *Publisher) Reply(ctx context.Context, request *Message, data interface{}) error {
+	reply, err := newReply(p.settings, request, data)
+	if err != nil {
+		return err
+	}
+	return p.Publish(ctx, reply)
+}
+
+// newReply creates the reply to a request
+func newReply(settings *Settings, request *Message, data interface{}) (*Message, error) {
+	replyType, replyVersion, err := request.replyTo()
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{}
+	if correlationID, ok := request.Metadata.Headers[CorrelationIDHeader]; ok {
+		headers[CorrelationIDHeader] = correlationID
+	}
+	return NewMessage(settings, replyType, replyVersion, headers, data)
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRequestPublisher(awsClient iAmazonWebServicesClient) (*Publisher, *Settings) {
+	settings := createTestSettings()
+	settings.MessageRouting = map[MessageRouteKey]string{
+		{MessageType: "trip_created", MessageMajorVersion: 1}:    "dev-trip-created-v1",
+		{MessageType: "vehicle_created", MessageMajorVersion: 1}: "dev-vehicle-created-v1",
+	}
+	settings.RequestTimeout = time.Second
+	settings.CallbackRegistry.RegisterCallback(
+		CallbackKey{MessageType: "vehicle_created", MessageMajorVersion: 1}, (&FakeCallback{}).Callback,
+		func() interface{} { return new(FakeHedwigDataField) })
+	return &Publisher{awsClient: awsClient, settings: settings}, settings
+}
+
+func newTestRequest(t *testing.T, settings *Settings) *Message {
+	data := &fakeTripCreatedV1{VehicleID: "C_1234567890123456", UserID: "U_1234567890123456"}
+	request, err := NewMessage(settings, "trip_created", "1.0", nil, data)
+	require.NoError(t, err)
+	request.SetReplyTo("vehicle_created", "1.0")
+	return request
+}
+
+func TestMessage_replyTo(t *testing.T) {
+	settings := createTestSettings()
+	request := newTestRequest(t, settings)
+	assert.Equal(t, "vehicle_created/1.0", request.Metadata.Headers[ReplyToHeader])
+
+	replyType, replyVersion, err := request.replyTo()
+	assert.NoError(t, err)
+	assert.Equal(t, "vehicle_created", replyType)
+	assert.Equal(t, "1.0", replyVersion)
+
+	request.Metadata.Headers[ReplyToHeader] = "vehicle_created"
+	_, _, err = request.replyTo()
+	assert.EqualError(t, err, "invalid reply_to header: vehicle_created")
+
+	delete(request.Metadata.Headers, ReplyToHeader)
+	_, _, err = request.replyTo()
+	assert.EqualError(t, err, "message has no reply_to header")
+}
+
+func TestPublisher_Reply(t *testing.T) {
+	ctx := context.Background()
+	awsClient := &FakeAWSClient{}
+	publisher, settings := newTestRequestPublisher(awsClient)
+	request := newTestRequest(t, settings)
+	request.Metadata.Headers[CorrelationIDHeader] = "abc"
+
+	awsClient.On("PublishSNS", ctx, settings, "dev-vehicle-created-v1", mock.Anything,
+		map[string]string{CorrelationIDHeader: "abc"}).Return(nil)
+
+	err := publisher.Reply(ctx, request, &FakeHedwigDataField{VehicleID: "C_1234567890123456"})
+	assert.NoError(t, err)
+	awsClient.AssertExpectations(t)
+}
+
+func TestPublisher_Request(t *testing.T) {
+	ctx := context.Background()
+	awsClient := &FakeAWSClient{}
+	publisher, settings := newTestRequestPublisher(awsClient)
+	request := newTestRequest(t, settings)
+
+	var reply *Message
+	awsClient.On("PublishSNS", ctx, settings, "dev-trip-created-v1", mock.Anything, mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			headers := args.Get(4).(map[string]string)
+			assert.Equal(t, request.ID, headers[CorrelationIDHeader])
+
+			var err error
+			reply, err = NewMessage(settings, "vehicle_created", "1.0",
+				map[string]string{CorrelationIDHeader: headers[CorrelationIDHeader]},
+				&FakeHedwigDataField{VehicleID: "C_1234567890123456"})
+			require.NoError(t, err)
+			// only the reply type is delivered to the request
+			unrelated := newTestRequest(t, settings)
+			unrelated.Metadata.Headers[CorrelationIDHeader] = request.ID
+			assert.False(t, settings.replies.deliver(unrelated))
+			go func() { assert.True(t, settings.replies.deliver(reply)) }()
+		})
+
+	received, err := publisher.Request(ctx, request)
+	assert.NoError(t, err)
+	assert.Equal(t, reply, received)
+	awsClient.AssertExpectations(t)
+	assert.Empty(t, settings.replies.pending)
+}
+
+func TestPublisher_RequestTimeout(t *testing.T) {
+	ctx := context.Background()
+	awsClient := &FakeAWSClient{}
+	publisher, settings := newTestRequestPublisher(awsClient)
+	settings.RequestTimeout = time.Millisecond
+	request := newTestRequest(t, settings)
+	request.Metadata.Headers[CorrelationIDHeader] = "abc"
+
+	awsClient.On("PublishSNS", ctx, settings, "dev-trip-created-v1", mock.Anything, mock.Anything).Return(nil)
+
+	_, err := publisher.Request(ctx, request)
+	assert.Equal(t, ErrRequestTimeout, errors.Cause(err))
+	assert.Empty(t, settings.replies.pending)
+}
+
+func TestPublisher_RequestNoReplyTo(t *testing.T) {
+	ctx := context.Background()
+	publisher, settings := newTestRequestPublisher(&FakeAWSClient{})
+	request := newTestRequest(t, settings)
+	delete(request.Metadata.Headers, ReplyToHeader)
+
+	_, err := publisher.Request(ctx, request)
+	assert.EqualError(t, err, "message has no reply_to header")
+}
+
+func TestPublisher_RequestNoReplyCallback(t *testing.T) {
+	ctx := context.Background()
+	awsClient := &FakeAWSClient{}
+	publisher, settings := newTestRequestPublisher(awsClient)
+	// replies can't be deserialized without the data factory of their callback
+	settings.CallbackRegistry = NewCallbackRegistry()
+	request := newTestRequest(t, settings)
+
+	_, err := publisher.Request(ctx, request)
+	assert.EqualError(t, err, "no callback registered for reply type {vehicle_created 1}")
+	awsClient.AssertNotCalled(t, "PublishSNS", mock.Anything, mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything)
+	assert.Empty(t, settings.replies.pending)
+}
+
+func TestAWSClient_messageHandlerReply(t *testing.T) {
+	ctx := context.Background()
+	settings := createTestSettings()
+	fakeCallback := &FakeCallback{}
+	settings.CallbackRegistry.RegisterCallback(
+		CallbackKey{MessageType: "vehicle_created", MessageMajorVersion: 1}, fakeCallback.Callback,
+		func() interface{} { return new(FakeHedwigDataField) })
+
+	pending, err := settings.replies.add("abc", "vehicle_created")
+	require.NoError(t, err)
+	defer settings.replies.remove("abc")
+
+	reply, err := NewMessage(settings, "vehicle_created", "1.0", map[string]string{CorrelationIDHeader: "abc"},
+		&FakeHedwigDataField{VehicleID: "C_1234567890123456"})
+	require.NoError(t, err)
+	replyJSON, err := reply.JSONString()
+	require.NoError(t, err)
+
+	awsClient := &awsClient{}
+	err = awsClient.messageHandler(ctx, settings, replyJSON, &messageDelivery{throttle: true}, nil)
+	assert.NoError(t, err)
+
+	received := <-pending.reply
+	assert.Equal(t, reply.ID, received.ID)
+	assert.Equal(t, reply.Data, received.Data)
+	fakeCallback.AssertNotCalled(t, "Callback", mock.Anything, mock.Anything)
+}
+
+func TestAWSClient_messageHandlerReplyOtherSettings(t *testing.T) {
+	ctx := context.Background()
+	settings := createTestSettings()
+	fakeCallback := &FakeCallback{}
+	settings.CallbackRegistry.RegisterCallback(
+		CallbackKey{MessageType: "vehicle_created", MessageMajorVersion: 1}, fakeCallback.Callback,
+		func() interface{} { return new(FakeHedwigDataField) })
+
+	// requests are only matched by consumers using the settings of their publisher
+	other := createTestSettings()
+	pending, err := other.replies.add("abc", "vehicle_created")
+	require.NoError(t, err)
+	defer other.replies.remove("abc")
+
+	reply, err := NewMessage(settings, "vehicle_created", "1.0", map[string]string{CorrelationIDHeader: "abc"},
+		&FakeHedwigDataField{VehicleID: "C_1234567890123456"})
+	require.NoError(t, err)
+	replyJSON, err := reply.JSONString()
+	require.NoError(t, err)
+
+	fakeCallback.On("Callback", mock.Anything, mock.Anything).Return(nil)
+
+	awsClient := &awsClient{}
+	err = awsClient.messageHandler(ctx, settings, replyJSON, &messageDelivery{throttle: true}, nil)
+	assert.NoError(t, err)
+
+	fakeCallback.AssertExpectations(t)
+	assert.Empty(t, pending.reply)
+}
+
+func TestPublisher_RequestUninitializedSettings(t *testing.T) {
+	ctx := context.Background()
+	publisher, settings := newTestRequestPublisher(&FakeAWSClient{})
+	settings.replies = nil
+	request := newTestRequest(t, settings)
+
+	_, err := publisher.Request(ctx, request)
+	assert.EqualError(t, err, "publisher settings aren't initialized, use NewPublisher")
+}
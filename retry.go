@@ -0,0 +1,99 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+)
+
+// maxVisibilityTimeout is the maximum visibility timeout allowed by SQS
+const maxVisibilityTimeout = 12 * time.Hour
+
+// RetryPolicy returns the delay before a failed message should be made visible again, given the number of times the
+// message has been received so far (starting at 1). Returning a negative duration leaves the message visibility
+// untouched, so it's retried once the queue visibility timeout expires.
+type RetryPolicy func(receiveCount int) time.Duration
+
+// NewExponentialBackoffRetryPolicy creates a retry policy that doubles the delay on every attempt, starting at
+// `base` and never exceeding `max`.
+func NewExponentialBackoffRetryPolicy(base time.Duration, max time.Duration) RetryPolicy {
+	return func(receiveCount int) time.Duration {
+		delay := base
+		for i := 1; i < receiveCount && delay < max; i++ {
+			delay *= 2
+		}
+		if delay > max {
+			delay = max
+		}
+		return delay
+	}
+}
+
+// RetryAfterError may be returned by a callback to retry the message after a specific delay, regardless of the
+// configured retry policy. Like ErrRetry, this isn't treated as an error.
+type RetryAfterError struct {
+	Delay time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("Retry after %s", e.Delay)
+}
+
+// RetryAfter returns an error that causes the message to be retried after the given delay
+func RetryAfter(delay time.Duration) error {
+	return &RetryAfterError{Delay: delay}
+}
+
+// isRetryError returns true if the error is a request for retry, as opposed to a processing failure
+func isRetryError(err error) bool {
+	if errors.Cause(err) == ErrRetry {
+		return true
+	}
+	_, ok := errors.Cause(err).(*RetryAfterError)
+	return ok
+}
+
+// receiveCount returns the number of times the SQS message has been received, defaulting to 1 if unknown
+func receiveCount(queueMessage *sqs.Message) int {
+	value, ok := queueMessage.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]
+	if !ok || value == nil {
+		return 1
+	}
+	count, err := strconv.Atoi(*value)
+	if err != nil || count < 1 {
+		return 1
+	}
+	return count
+}
+
+// retryDelay returns the visibility timeout to be set for a failed message. The second return value is false if the
+// message visibility should be left untouched.
+func retryDelay(settings *Settings, queueMessage *sqs.Message, err error) (time.Duration, bool) {
+	var delay time.Duration
+	if retryAfterErr, ok := errors.Cause(err).(*RetryAfterError); ok {
+		delay = retryAfterErr.Delay
+	} else if throttledErr, ok := errors.Cause(err).(*throttledError); ok {
+		delay = throttledErr.delay
+	} else if settings.RetryPolicy != nil {
+		delay = settings.RetryPolicy(receiveCount(queueMessage))
+	} else {
+		return 0, false
+	}
+	if delay < 0 {
+		return 0, false
+	}
+	if delay > maxVisibilityTimeout {
+		delay = maxVisibilityTimeout
+	}
+	return delay, true
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExponentialBackoffRetryPolicy(t *testing.T) {
+	policy := NewExponentialBackoffRetryPolicy(time.Second, 10*time.Second)
+
+	assert.Equal(t, time.Second, policy(1))
+	assert.Equal(t, 2*time.Second, policy(2))
+	assert.Equal(t, 4*time.Second, policy(3))
+	assert.Equal(t, 8*time.Second, policy(4))
+	assert.Equal(t, 10*time.Second, policy(5))
+	assert.Equal(t, 10*time.Second, policy(100))
+}
+
+func TestIsRetryError(t *testing.T) {
+	assert.True(t, isRetryError(ErrRetry))
+	assert.True(t, isRetryError(RetryAfter(time.Second)))
+	assert.True(t, isRetryError(errors.Wrap(RetryAfter(time.Second), "wrapped")))
+	assert.False(t, isRetryError(errors.New("my bad")))
+}
+
+func TestReceiveCount(t *testing.T) {
+	assert.Equal(t, 1, receiveCount(&sqs.Message{}))
+	assert.Equal(t, 1, receiveCount(&sqs.Message{
+		Attributes: map[string]*string{
+			sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("foo"),
+		},
+	}))
+	assert.Equal(t, 5, receiveCount(&sqs.Message{
+		Attributes: map[string]*string{
+			sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("5"),
+		},
+	}))
+}
+
+func TestRetryDelay(t *testing.T) {
+	settings := createTestSettings()
+	queueMessage := &sqs.Message{
+		Attributes: map[string]*string{
+			sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String("3"),
+		},
+	}
+
+	_, ok := retryDelay(settings, queueMessage, errors.New("my bad"))
+	assert.False(t, ok)
+
+	delay, ok := retryDelay(settings, queueMessage, RetryAfter(time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, delay)
+
+	settings.RetryPolicy = NewExponentialBackoffRetryPolicy(time.Second, time.Hour)
+	delay, ok = retryDelay(settings, queueMessage, errors.New("my bad"))
+	assert.True(t, ok)
+	assert.Equal(t, 4*time.Second, delay)
+
+	delay, ok = retryDelay(settings, queueMessage, RetryAfter(24*time.Hour))
+	assert.True(t, ok)
+	assert.Equal(t, maxVisibilityTimeout, delay)
+
+	settings.RetryPolicy = func(int) time.Duration { return -1 }
+	_, ok = retryDelay(settings, queueMessage, ErrRetry)
+	assert.False(t, ok)
+}
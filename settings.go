@@ -80,6 +80,13 @@ type Settings struct {
 	// CallbackRegistry contains callbacks and message data factories by message type and message version
 	CallbackRegistry *CallbackRegistry
 
+	// ConverterRegistry contains functions converting messages between major versions
+	ConverterRegistry *ConverterRegistry // optional
+
+	// CallbackMiddleware wrap around every callback function, for both queue and lambda consumers. The first
+	// middleware is the outermost one. Use CallbackRegistry.RegisterMiddleware to add middleware for a single callback.
+	CallbackMiddleware []CallbackMiddleware // optional
+
 	// GetLogger is a function that takes the context object and returns a logger. This may be used to plug in
 	// your desired logger library. Defaults to using std library.
 	// Convenience structs are provided for popular libraries: LogrusGetLoggerFunc
@@ -95,6 +102,58 @@ type Settings struct {
 	// recommended that major versions of a message be published on separate topics.
 	MessageRouting map[MessageRouteKey]string
 
+	// CallbackTimeout is the time a callback is allowed to run for. The context passed to the callback expires after
+	// this time, and the message is retried if the callback doesn't return in time. Callbacks should return once their
+	// context expires: a callback that doesn't keeps running, and keeps holding the message's in-flight slot and
+	// idempotency lease until it returns. For queue consumers, callbacks are also limited by the visibility timeout of
+	// the listen request, or that of the queue, which is looked up once and needs permission for
+	// sqs:GetQueueAttributes. Use CallbackRegistry.SetCallbackTimeout to set a timeout for a single callback.
+	CallbackTimeout time.Duration // optional; defaults to the visibility timeout
+
+	// DisablePanicRecovery lets panics while processing a message crash the process. By default, panics are
+	// recovered, logged with the stack trace, and the message is retried like any other failure.
+	DisablePanicRecovery bool // optional; defaults to false
+
+	// IdempotencyStore is checked before running the callback, so messages delivered more than once are only
+	// processed once. Successfully processed messages are recorded in the store.
+	IdempotencyStore IdempotencyStore // optional; messages aren't deduplicated by default
+
+	// IdempotencyKey returns the key used to deduplicate a message
+	IdempotencyKey IdempotencyKeyFunc // optional; defaults to the message id
+
+	// IdempotencyTTL is how long successfully processed messages are remembered
+	IdempotencyTTL time.Duration // optional; defaults to 24h
+
+	// IdempotencyLease is how long a message is reserved while it's being processed. Duplicates received during
+	// this time are retried. The lease is held until the callback returns, even after it times out, so it should be
+	// longer than the callback timeout.
+	IdempotencyLease time.Duration // optional; defaults to twice the callback timeout, or 5 minutes if there is none
+
+	// PartitionKey returns the key of a message for ordered processing. Messages received together from an SQS queue
+	// that share a key are processed one after another, in the order they were received; messages with different
+	// keys are processed concurrently. A failed message doesn't hold back the messages after it. Time spent waiting
+	// for earlier messages counts towards the callback deadline, since the visibility timeout runs from when messages
+	// are received; messages that run out of time are retried.
+	PartitionKey PartitionKeyFunc // optional; defaults to processing every message concurrently
+
+	// ExpiryPolicy determines how messages past their TTL header, or the max age set with CallbackRegistry.SetMaxAge,
+	// are handled. Expired messages are reported with OutcomeExpired.
+	ExpiryPolicy ExpiryPolicy // optional; defaults to ExpiryDiscard
+
+	// StaleHandler is called on expired messages when ExpiryPolicy is ExpiryStaleHandler
+	StaleHandler CallbackFunction // optional
+
+	// LambdaFailurePolicy determines how SNS lambda consumers handle records that failed processing. Records are
+	// processed independently, so the policy only applies to the failed records of an event.
+	LambdaFailurePolicy LambdaFailurePolicy // optional; defaults to LambdaFailInvocation
+
+	// LambdaEventReportHook is called with the outcome of every record, after an SNS event is processed by a lambda
+	// consumer
+	LambdaEventReportHook LambdaEventReportHook // optional
+
+	// MetricsHook is called after every message is processed by a queue consumer, with the outcome and duration
+	MetricsHook MetricsHook // optional
+
 	// Hedwig pre process hook called before any processing is done on message
 	PreProcessHookLambda PreProcessHookLambda // optional
 	PreProcessHookSQS    PreProcessHookSQS    // optional
@@ -105,18 +164,50 @@ type Settings struct {
 	// Hedwig hook called before a message has been deserialized into a Message struct
 	PreDeserializeHook PreDeserializeHook // optional
 
+	// DualPublishing maps message types being migrated to a new major version to the other major versions they're
+	// published as. Messages are converted using ConverterRegistry, and published on the topic for each major
+	// version, keeping the same message id. Use ListSubscriptions to find consumers still reading an old topic.
+	//   <message type> => major versions
+	DualPublishing map[string][]int // optional
+
 	// Publisher name
 	Publisher string
 
+	// RequestTimeout is the time Publisher.Request waits for a reply
+	RequestTimeout time.Duration // optional; defaults to 30s
+
 	// Hedwig queue name. Exclude the `HEDWIG-` prefix
 	QueueName string
 
+	// DeadLetterQueueName is the queue that messages failing permanently are sent to. Exclude the `HEDWIG-` prefix.
+	// Required for SNS lambda consumers that dead-letter records.
+	DeadLetterQueueName string // optional; defaults to <QueueName>-DLQ
+
+	// PermanentErrorClassifier may be used to mark additional errors as permanent failures, so the message is
+	// dead-lettered right away instead of being retried. Errors wrapped with Permanent are always permanent failures.
+	PermanentErrorClassifier PermanentErrorClassifier // optional
+
+	// RetryPolicy determines the visibility timeout of a message that failed processing. This may be used to back off
+	// exponentially from a flapping downstream. Callbacks may always ask for a specific delay by returning RetryAfter.
+	RetryPolicy RetryPolicy // optional; defaults to retrying at the queue visibility timeout
+
+	// VerifySNSSignatures verifies the signature of SNS notifications delivered to SQS queues subscribed without raw
+	// message delivery. Messages with an invalid signature are dead-lettered.
+	VerifySNSSignatures bool // optional; defaults to false
+
+	// SNSCertificateFetcher fetches the certificates used to verify SNS signatures
+	SNSCertificateFetcher SNSCertificateFetcher // optional; defaults to fetching over HTTPS, with an in-memory cache
+
 	// ShutdownTimeout is the time the app has to shut down before being brutally killed
 	ShutdownTimeout time.Duration // optional; defaults to 10s
 
 	// Message validator using JSON schema for validation. Additional JSON schema formats may be added.
 	// Please see github.com/santhosh-tekuri/jsonschema for more details.
 	Validator IMessageValidator
+
+	// replies tracks the requests of publishers using these settings that are waiting for a reply, so consumers
+	// using the same settings deliver replies to them
+	replies *replyRegistry
 }
 
 func (s *Settings) initDefaults() {
@@ -130,4 +221,7 @@ func (s *Settings) initDefaults() {
 		stdLogger := &stdLogger{}
 		s.GetLogger = func(_ context.Context) Logger { return stdLogger }
 	}
+	if s.replies == nil {
+		s.replies = newReplyRegistry()
+	}
 }
@@ -0,0 +1,223 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+)
+
+// snsSigningCertHost matches the hosts SNS signing certificates are served from
+var snsSigningCertHost = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+// SNSCertificateFetcher returns the certificate at the given URL, used to verify the signature of SNS messages.
+// URLs are validated to be SNS certificate URLs before the fetcher is called.
+type SNSCertificateFetcher func(ctx context.Context, certURL string) (*x509.Certificate, error)
+
+// snsEnvelopeAttribute is a message attribute in an SNS notification
+type snsEnvelopeAttribute struct {
+	Type  string `json:"Type"`
+	Value string `json:"Value"`
+}
+
+// snsEnvelope is the JSON notification SNS delivers to SQS queues subscribed without raw message delivery
+type snsEnvelope struct {
+	Type              string                          `json:"Type"`
+	MessageID         string                          `json:"MessageId"`
+	TopicArn          string                          `json:"TopicArn"`
+	Subject           string                          `json:"Subject"`
+	Message           string                          `json:"Message"`
+	Timestamp         string                          `json:"Timestamp"`
+	SignatureVersion  string                          `json:"SignatureVersion"`
+	Signature         string                          `json:"Signature"`
+	SigningCertURL    string                          `json:"SigningCertURL"`
+	MessageAttributes map[string]snsEnvelopeAttribute `json:"MessageAttributes"`
+}
+
+// parseSNSEnvelope returns the SNS notification wrapping the message body, or nil if the message was delivered raw
+func parseSNSEnvelope(body string) *snsEnvelope {
+	if !strings.HasPrefix(strings.TrimSpace(body), "{") {
+		return nil
+	}
+	envelope := &snsEnvelope{}
+	if err := json.Unmarshal([]byte(body), envelope); err != nil {
+		return nil
+	}
+	if envelope.Type != "Notification" || envelope.TopicArn == "" || envelope.MessageID == "" {
+		return nil
+	}
+	return envelope
+}
+
+// stringToSign returns the canonical representation of the notification that SNS signs
+func (e *snsEnvelope) stringToSign() string {
+	var b strings.Builder
+	field := func(name, value string) {
+		b.WriteString(name)
+		b.WriteString("\n")
+		b.WriteString(value)
+		b.WriteString("\n")
+	}
+	field("Message", e.Message)
+	field("MessageId", e.MessageID)
+	if e.Subject != "" {
+		field("Subject", e.Subject)
+	}
+	field("Timestamp", e.Timestamp)
+	field("TopicArn", e.TopicArn)
+	field("Type", e.Type)
+	return b.String()
+}
+
+// verify checks the signature of the notification
+func (e *snsEnvelope) verify(ctx context.Context, fetcher SNSCertificateFetcher) error {
+	certURL, err := url.Parse(e.SigningCertURL)
+	if err != nil || certURL.Scheme != "https" || !snsSigningCertHost.MatchString(certURL.Host) {
+		return Permanent(errors.Errorf("invalid SNS signing certificate URL: %s", e.SigningCertURL))
+	}
+	signature, err := base64.StdEncoding.DecodeString(e.Signature)
+	if err != nil {
+		return Permanent(errors.Wrap(err, "invalid SNS signature"))
+	}
+
+	var hash crypto.Hash
+	var digest []byte
+	switch e.SignatureVersion {
+	case "1":
+		hash = crypto.SHA1
+		sum := sha1.Sum([]byte(e.stringToSign()))
+		digest = sum[:]
+	case "2":
+		hash = crypto.SHA256
+		sum := sha256.Sum256([]byte(e.stringToSign()))
+		digest = sum[:]
+	default:
+		return Permanent(errors.Errorf("unsupported SNS signature version: %s", e.SignatureVersion))
+	}
+
+	cert, err := fetcher(ctx, e.SigningCertURL)
+	if err != nil {
+		return errors.Wrap(err, "failed to fetch SNS signing certificate")
+	}
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return Permanent(errors.New("SNS signing certificate doesn't have an RSA public key"))
+	}
+	if err := rsa.VerifyPKCS1v15(publicKey, hash, digest, signature); err != nil {
+		return Permanent(errors.Wrap(err, "invalid SNS signature"))
+	}
+	return nil
+}
+
+// unwrapSNSEnvelope returns a copy of a message delivered without raw message delivery, with the hedwig message inside
+// the SNS notification as the body, and the notification attributes added to the message attributes, along with the
+// notification. Messages delivered raw are returned as is, with a nil notification. The message itself is left
+// untouched either way.
+func unwrapSNSEnvelope(ctx context.Context, settings *Settings, queueMessage *sqs.Message) (
+	*sqs.Message, *snsEnvelope, error) {
+
+	if queueMessage.Body == nil {
+		return queueMessage, nil, nil
+	}
+	envelope := parseSNSEnvelope(*queueMessage.Body)
+	if envelope == nil {
+		return queueMessage, nil, nil
+	}
+	if settings.VerifySNSSignatures {
+		fetcher := settings.SNSCertificateFetcher
+		if fetcher == nil {
+			fetcher = defaultSNSCertificateFetcher.fetch
+		}
+		if err := envelope.verify(ctx, fetcher); err != nil {
+			return queueMessage, nil, err
+		}
+	}
+
+	unwrapped := *queueMessage
+	unwrapped.Body = aws.String(envelope.Message)
+	unwrapped.MessageAttributes = make(
+		map[string]*sqs.MessageAttributeValue, len(queueMessage.MessageAttributes)+len(envelope.MessageAttributes))
+	for key, attribute := range queueMessage.MessageAttributes {
+		unwrapped.MessageAttributes[key] = attribute
+	}
+	for key, attribute := range envelope.MessageAttributes {
+		value := &sqs.MessageAttributeValue{DataType: aws.String(attribute.Type)}
+		if strings.HasPrefix(attribute.Type, "Binary") {
+			// binary values are base64 encoded in notifications
+			binaryValue, err := base64.StdEncoding.DecodeString(attribute.Value)
+			if err != nil {
+				settings.GetLogger(ctx).Warn(err, "Skipping invalid binary SNS message attribute", LoggingFields{
+					"message_sqs_id": aws.StringValue(queueMessage.MessageId),
+					"attribute":      key,
+				})
+				continue
+			}
+			value.BinaryValue = binaryValue
+		} else {
+			value.StringValue = aws.String(attribute.Value)
+		}
+		unwrapped.MessageAttributes[key] = value
+	}
+	return &unwrapped, envelope, nil
+}
+
+// snsCertificateCache fetches SNS signing certificates over HTTPS, and caches them in memory
+type snsCertificateCache struct {
+	certs sync.Map
+}
+
+func (c *snsCertificateCache) fetch(ctx context.Context, certURL string) (*x509.Certificate, error) {
+	if cert, ok := c.certs.Load(certURL); ok {
+		return cert.(*x509.Certificate), nil
+	}
+	req, err := http.NewRequest(http.MethodGet, certURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, errors.New("invalid PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	c.certs.Store(certURL, cert)
+	return cert, nil
+}
+
+var defaultSNSCertificateFetcher = &snsCertificateCache{}
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSigningCertURL = "https://sns.us-east-1.amazonaws.com/SimpleNotificationService-1234.pem"
+
+func newTestSigningCert(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return key, cert
+}
+
+func newTestSNSEnvelope(t *testing.T, key *rsa.PrivateKey) *snsEnvelope {
+	envelope := &snsEnvelope{
+		Type:             "Notification",
+		MessageID:        "a5b8bd1c-7e4d-5b2a-9a57-5e0f23b1d2f5",
+		TopicArn:         "arn:aws:sns:us-east-1:686176732873:hedwig-dev-vehicle_created-v1",
+		Message:          `{"id": "123"}`,
+		Timestamp:        "2019-01-01T00:00:00.000Z",
+		SignatureVersion: "2",
+		SigningCertURL:   testSigningCertURL,
+		MessageAttributes: map[string]snsEnvelopeAttribute{
+			"request_id": {Type: "String", Value: "abc"},
+			"checksum":   {Type: "Binary", Value: base64.StdEncoding.EncodeToString([]byte{0xca, 0xfe})},
+		},
+	}
+	digest := sha256.Sum256([]byte(envelope.stringToSign()))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	envelope.Signature = base64.StdEncoding.EncodeToString(signature)
+	return envelope
+}
+
+func newTestSNSEnvelopeMessage(t *testing.T, envelope *snsEnvelope) *sqs.Message {
+	body, err := json.Marshal(envelope)
+	require.NoError(t, err)
+	return &sqs.Message{
+		MessageId: aws.String("123"),
+		Body:      aws.String(string(body)),
+	}
+}
+
+func TestParseSNSEnvelope(t *testing.T) {
+	assert.Nil(t, parseSNSEnvelope(`{"id": "123", "schema": "vehicle_created", "data": {}}`))
+	assert.Nil(t, parseSNSEnvelope(`{"Type": "SubscriptionConfirmation", "MessageId": "1", "TopicArn": "arn"}`))
+	assert.Nil(t, parseSNSEnvelope(`bad json`))
+
+	envelope := parseSNSEnvelope(`{"Type": "Notification", "MessageId": "1", "TopicArn": "arn", "Message": "{}"}`)
+	require.NotNil(t, envelope)
+	assert.Equal(t, "{}", envelope.Message)
+}
+
+func TestUnwrapSNSEnvelope(t *testing.T) {
+	key, _ := newTestSigningCert(t)
+	settings := createTestSettings()
+	queueMessage := newTestSNSEnvelopeMessage(t, newTestSNSEnvelope(t, key))
+	body := *queueMessage.Body
+
+	unwrapped, envelope, err := unwrapSNSEnvelope(context.Background(), settings, queueMessage)
+	assert.NoError(t, err)
+	assert.NotNil(t, envelope)
+	assert.Equal(t, `{"id": "123"}`, *unwrapped.Body)
+	assert.Equal(t, queueMessage.MessageId, unwrapped.MessageId)
+	assert.Equal(t, map[string]*sqs.MessageAttributeValue{
+		"request_id": {DataType: aws.String("String"), StringValue: aws.String("abc")},
+		"checksum":   {DataType: aws.String("Binary"), BinaryValue: []byte{0xca, 0xfe}},
+	}, unwrapped.MessageAttributes)
+
+	// the message as received is left untouched
+	assert.Equal(t, body, *queueMessage.Body)
+	assert.Nil(t, queueMessage.MessageAttributes)
+}
+
+func TestUnwrapSNSEnvelope_InvalidBinaryAttribute(t *testing.T) {
+	key, _ := newTestSigningCert(t)
+	settings := createTestSettings()
+	settings.GetLogger = func(_ context.Context) Logger { return &fakeLogger{} }
+	envelope := newTestSNSEnvelope(t, key)
+	envelope.MessageAttributes["checksum"] = snsEnvelopeAttribute{Type: "Binary", Value: "not base64!"}
+
+	unwrapped, _, err := unwrapSNSEnvelope(context.Background(), settings, newTestSNSEnvelopeMessage(t, envelope))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]*sqs.MessageAttributeValue{
+		"request_id": {DataType: aws.String("String"), StringValue: aws.String("abc")},
+	}, unwrapped.MessageAttributes)
+}
+
+func TestUnwrapSNSEnvelope_Raw(t *testing.T) {
+	settings := createTestSettings()
+	settings.VerifySNSSignatures = true
+	body := `{"id": "123", "schema": "vehicle_created", "data": {}}`
+	queueMessage := &sqs.Message{Body: aws.String(body)}
+
+	unwrapped, envelope, err := unwrapSNSEnvelope(context.Background(), settings, queueMessage)
+	assert.NoError(t, err)
+	assert.Nil(t, envelope)
+	assert.Equal(t, queueMessage, unwrapped)
+	assert.Equal(t, body, *queueMessage.Body)
+	assert.Nil(t, queueMessage.MessageAttributes)
+}
+
+func TestUnwrapSNSEnvelope_VerifySignature(t *testing.T) {
+	ctx := context.Background()
+	key, cert := newTestSigningCert(t)
+	settings := createTestSettings()
+	settings.VerifySNSSignatures = true
+	settings.SNSCertificateFetcher = func(_ context.Context, certURL string) (*x509.Certificate, error) {
+		assert.Equal(t, testSigningCertURL, certURL)
+		return cert, nil
+	}
+
+	envelope := newTestSNSEnvelope(t, key)
+	queueMessage := newTestSNSEnvelopeMessage(t, envelope)
+	unwrapped, _, err := unwrapSNSEnvelope(ctx, settings, queueMessage)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"id": "123"}`, *unwrapped.Body)
+
+	envelope.Message = `{"id": "456"}`
+	_, _, err = unwrapSNSEnvelope(ctx, settings, newTestSNSEnvelopeMessage(t, envelope))
+	assert.EqualError(t, err, "invalid SNS signature: crypto/rsa: verification error")
+	assert.True(t, isPermanentError(settings, err))
+}
+
+func TestUnwrapSNSEnvelope_InvalidCertURL(t *testing.T) {
+	key, _ := newTestSigningCert(t)
+	settings := createTestSettings()
+	settings.VerifySNSSignatures = true
+	settings.SNSCertificateFetcher = func(context.Context, string) (*x509.Certificate, error) {
+		assert.Fail(t, "certificate must not be fetched")
+		return nil, nil
+	}
+
+	envelope := newTestSNSEnvelope(t, key)
+	envelope.SigningCertURL = "https://sns.us-east-1.amazonaws.com.evil.com/cert.pem"
+	_, _, err := unwrapSNSEnvelope(context.Background(), settings, newTestSNSEnvelopeMessage(t, envelope))
+	assert.EqualError(t, err, "invalid SNS signing certificate URL: "+envelope.SigningCertURL)
+	assert.True(t, isPermanentError(settings, err))
+}
+
+func TestUnwrapSNSEnvelope_FetchError(t *testing.T) {
+	key, _ := newTestSigningCert(t)
+	settings := createTestSettings()
+	settings.VerifySNSSignatures = true
+	settings.SNSCertificateFetcher = func(context.Context, string) (*x509.Certificate, error) {
+		return nil, errors.New("no internet")
+	}
+
+	_, _, err := unwrapSNSEnvelope(context.Background(), settings, newTestSNSEnvelopeMessage(t, newTestSNSEnvelope(t, key)))
+	assert.EqualError(t, err, "failed to fetch SNS signing certificate: no internet")
+	// fetch errors may be retried
+	assert.False(t, isPermanentError(settings, err))
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxVisibilityTimeoutSafetyMargin is the most time reserved at the end of a message visibility timeout for
+// acknowledging the message after the callback returns
+const maxVisibilityTimeoutSafetyMargin = 5 * time.Second
+
+// ErrCallbackTimeout is returned when a callback doesn't finish within its deadline. The message is retried.
+var ErrCallbackTimeout = errors.New("callback timed out")
+
+func isTimeoutError(err error) bool {
+	return errors.Cause(err) == ErrCallbackTimeout
+}
+
+// callbackTimeout returns the time a callback is allowed to run for, or 0 if there is no limit. Callbacks must
+// finish before the message becomes visible again, so the limit is never more than the visibility timeout, minus a
+// safety margin and the time the message already waited since it was received. Queue consumers fall back to the
+// queue's default visibility timeout, if it can be looked up; Lambda consumers are limited by the deadline of the
+// invocation. Returns ErrCallbackTimeout if the message waited for so long that there's no time left.
+func callbackTimeout(settings *Settings, cbk CallbackKey, visibilityTimeout time.Duration,
+	waited time.Duration) (time.Duration, error) {
+
+	timeout := settings.CallbackTimeout
+	if settings.CallbackRegistry != nil {
+		if keyTimeout, ok := settings.CallbackRegistry.getCallbackTimeout(cbk); ok {
+			timeout = keyTimeout
+		}
+	}
+	if visibilityTimeout > 0 {
+		margin := visibilityTimeout / 10
+		if margin > maxVisibilityTimeoutSafetyMargin {
+			margin = maxVisibilityTimeoutSafetyMargin
+		}
+		remaining := visibilityTimeout - margin - waited
+		if remaining <= 0 {
+			return 0, errors.Wrapf(ErrCallbackTimeout, "message waited for %s before its callback could run", waited)
+		}
+		if timeout == 0 || remaining < timeout {
+			timeout = remaining
+		}
+	}
+	return timeout, nil
+}
+
+// execWithTimeout calls fn with a context that expires after the timeout, then calls done with the result of fn, and
+// returns what done returns. Callbacks are expected to give up once their context expires. If fn doesn't return in
+// time, ErrCallbackTimeout is returned right away; goroutines can't be stopped, so fn keeps running in the background,
+// and done is only called once fn actually returns, with ErrCallbackTimeout, since the message is retried either way.
+// Resources held for the message, such as in-flight slots and idempotency leases, should be released by done, so
+// they're held for as long as the callback runs.
+func execWithTimeout(ctx context.Context, settings *Settings, loggingFields LoggingFields, timeout time.Duration,
+	fn func(ctx context.Context) error, done func(err error) error) error {
+
+	if done == nil {
+		done = func(err error) error { return err }
+	}
+	if timeout <= 0 {
+		return done(fn(ctx))
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+
+	var lock sync.Mutex
+	abandoned := false
+	result := make(chan error, 1)
+	go func() {
+		defer cancel()
+		// panics in this goroutine can't be recovered by the caller
+		err := callWithRecover(timeoutCtx, settings, loggingFields, func() error {
+			return fn(timeoutCtx)
+		})
+		lock.Lock()
+		if !abandoned {
+			result <- err
+			lock.Unlock()
+			return
+		}
+		lock.Unlock()
+
+		// the caller already gave up on the callback
+		if err != nil {
+			settings.GetLogger(ctx).Error(err, "Callback failed after timing out", loggingFields)
+		} else {
+			settings.GetLogger(ctx).Debug("Callback finished after timing out", loggingFields)
+		}
+		_ = done(errors.Wrapf(ErrCallbackTimeout, "callback exceeded %s", timeout))
+	}()
+
+	select {
+	case err := <-result:
+		return done(timeoutResult(timeoutCtx, timeout, err))
+	case <-timeoutCtx.Done():
+	}
+
+	lock.Lock()
+	select {
+	case err := <-result:
+		// returned just in time
+		lock.Unlock()
+		return done(timeoutResult(timeoutCtx, timeout, err))
+	default:
+		abandoned = true
+		lock.Unlock()
+	}
+	if ctx.Err() == context.Canceled {
+		return ctx.Err()
+	}
+	return errors.Wrapf(ErrCallbackTimeout, "callback exceeded %s", timeout)
+}
+
+// timeoutResult turns errors caused by the callback deadline into ErrCallbackTimeout
+func timeoutResult(timeoutCtx context.Context, timeout time.Duration, err error) error {
+	if err != nil && timeoutCtx.Err() == context.DeadlineExceeded && errors.Cause(err) == context.DeadlineExceeded {
+		return errors.Wrapf(ErrCallbackTimeout, "callback exceeded %s", timeout)
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallbackTimeout(t *testing.T) {
+	settings := createTestSettings()
+	cbk := CallbackKey{MessageType: "vehicle_created", MessageMajorVersion: 1}
+	callbackTimeout := func(settings *Settings, cbk CallbackKey, visibilityTimeout time.Duration) time.Duration {
+		timeout, err := callbackTimeout(settings, cbk, visibilityTimeout, 0)
+		require.NoError(t, err)
+		return timeout
+	}
+
+	assert.Equal(t, time.Duration(0), callbackTimeout(settings, cbk, 0))
+	assert.Equal(t, 9*time.Second, callbackTimeout(settings, cbk, 10*time.Second))
+	assert.Equal(t, 295*time.Second, callbackTimeout(settings, cbk, 300*time.Second))
+
+	settings.CallbackTimeout = time.Minute
+	assert.Equal(t, time.Minute, callbackTimeout(settings, cbk, 0))
+	assert.Equal(t, time.Minute, callbackTimeout(settings, cbk, 300*time.Second))
+	assert.Equal(t, 9*time.Second, callbackTimeout(settings, cbk, 10*time.Second))
+
+	settings.CallbackRegistry.SetCallbackTimeout(cbk, 2*time.Minute)
+	assert.Equal(t, 2*time.Minute, callbackTimeout(settings, cbk, 0))
+	assert.Equal(t, time.Minute, callbackTimeout(
+		settings, CallbackKey{MessageType: "vehicle_created", MessageMajorVersion: 2}, 0))
+}
+
+func TestCallbackTimeoutWaited(t *testing.T) {
+	settings := createTestSettings()
+	settings.CallbackTimeout = time.Minute
+	cbk := CallbackKey{MessageType: "vehicle_created", MessageMajorVersion: 1}
+
+	// time spent waiting counts towards the visibility timeout, but not the callback timeout
+	timeout, err := callbackTimeout(settings, cbk, 300*time.Second, 200*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, timeout)
+	timeout, err = callbackTimeout(settings, cbk, 300*time.Second, 270*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, 25*time.Second, timeout)
+	timeout, err = callbackTimeout(settings, cbk, 0, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, timeout)
+
+	_, err = callbackTimeout(settings, cbk, 300*time.Second, 295*time.Second)
+	assert.True(t, isTimeoutError(err))
+}
+
+func TestExecWithTimeout(t *testing.T) {
+	ctx := context.Background()
+	settings := createTestSettings()
+
+	err := execWithTimeout(ctx, settings, nil, 0, func(callbackCtx context.Context) error {
+		assert.Equal(t, ctx, callbackCtx)
+		return errors.New("my bad")
+	}, nil)
+	assert.EqualError(t, err, "my bad")
+
+	err = execWithTimeout(ctx, settings, nil, time.Second, func(callbackCtx context.Context) error {
+		deadline, ok := callbackCtx.Deadline()
+		assert.True(t, ok)
+		assert.True(t, time.Until(deadline) <= time.Second)
+		return nil
+	}, nil)
+	assert.NoError(t, err)
+}
+
+func TestExecWithTimeoutExceeded(t *testing.T) {
+	ctx := context.Background()
+	settings := createTestSettings()
+
+	// callback respects context
+	err := execWithTimeout(ctx, settings, nil, time.Millisecond, func(callbackCtx context.Context) error {
+		<-callbackCtx.Done()
+		return errors.Wrap(callbackCtx.Err(), "gave up")
+	}, nil)
+	assert.True(t, isTimeoutError(err))
+
+	// callback ignores context
+	release := make(chan struct{})
+	defer close(release)
+	err = execWithTimeout(ctx, settings, nil, time.Millisecond, func(callbackCtx context.Context) error {
+		<-release
+		return nil
+	}, nil)
+	assert.True(t, isTimeoutError(err))
+}
+
+func TestExecWithTimeoutDone(t *testing.T) {
+	ctx := context.Background()
+	settings := createTestSettings()
+	settings.GetLogger = func(_ context.Context) Logger { return &fakeLogger{} }
+
+	// done gets the result of the callback, and its own result is returned
+	err := execWithTimeout(ctx, settings, nil, time.Second, func(context.Context) error {
+		return errors.New("my bad")
+	}, func(err error) error {
+		assert.EqualError(t, err, "my bad")
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// done is only called once a callback that timed out returns
+	release := make(chan struct{})
+	finished := make(chan error, 1)
+	err = execWithTimeout(ctx, settings, nil, time.Millisecond, func(context.Context) error {
+		<-release
+		return nil
+	}, func(err error) error {
+		finished <- err
+		return err
+	})
+	assert.True(t, isTimeoutError(err))
+	select {
+	case <-finished:
+		t.Fatal("done called before the callback returned")
+	default:
+	}
+	close(release)
+	assert.True(t, isTimeoutError(<-finished))
+}
+
+func TestExecWithTimeoutCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	settings := createTestSettings()
+
+	go func() {
+		time.Sleep(time.Millisecond)
+		cancel()
+	}()
+	err := execWithTimeout(ctx, settings, nil, time.Minute, func(callbackCtx context.Context) error {
+		<-callbackCtx.Done()
+		return callbackCtx.Err()
+	}, nil)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestExecWithTimeoutPanic(t *testing.T) {
+	settings := createTestSettings()
+	settings.GetLogger = func(_ context.Context) Logger { return &fakeLogger{} }
+
+	err := execWithTimeout(context.Background(), settings, nil, time.Minute, func(context.Context) error {
+		panic("oops")
+	}, nil)
+	assert.IsType(t, &PanicError{}, err)
+}
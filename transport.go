@@ -0,0 +1,79 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// TransportMetadata describes how a message was delivered. Fields that aren't known for the delivery path are left
+// empty: SQS fields are only set for messages received from SQS, and SNS fields for messages received from SNS,
+// or through an SQS queue without raw message delivery.
+type TransportMetadata struct {
+	// SQS message id
+	SQSMessageID string
+	// Number of times the message has been received from SQS, including this time
+	ReceiveCount int
+	// Time the message was first received from SQS
+	FirstReceiveTime time.Time
+	// Time the message was sent to SQS
+	SentTime time.Time
+	// Hedwig queue name, excluding the `HEDWIG-` prefix
+	QueueName string
+
+	// SNS message id
+	SNSMessageID string
+	// ARN of the SNS topic the message was published on
+	TopicARN string
+	// ARN of the SNS subscription the message was delivered through. Only set for lambda consumers.
+	SubscriptionARN string
+}
+
+// epochMillisAttribute parses an SQS timestamp attribute, in milliseconds since epoch
+func epochMillisAttribute(queueMessage *sqs.Message, name string) time.Time {
+	value, ok := queueMessage.Attributes[name]
+	if !ok || value == nil {
+		return time.Time{}
+	}
+	millis, err := strconv.ParseInt(*value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, millis*int64(time.Millisecond))
+}
+
+// sqsTransportMetadata returns the transport metadata of a message received from SQS, optionally wrapped in an SNS
+// notification
+func sqsTransportMetadata(settings *Settings, queueMessage *sqs.Message, envelope *snsEnvelope) *TransportMetadata {
+	transport := &TransportMetadata{
+		SQSMessageID:     *queueMessage.MessageId,
+		ReceiveCount:     receiveCount(queueMessage),
+		FirstReceiveTime: epochMillisAttribute(queueMessage, sqs.MessageSystemAttributeNameApproximateFirstReceiveTimestamp),
+		SentTime:         epochMillisAttribute(queueMessage, sqs.MessageSystemAttributeNameSentTimestamp),
+		QueueName:        settings.QueueName,
+	}
+	if envelope != nil {
+		transport.SNSMessageID = envelope.MessageID
+		transport.TopicARN = envelope.TopicArn
+	}
+	return transport
+}
+
+// snsTransportMetadata returns the transport metadata of a message received by a lambda from SNS
+func snsTransportMetadata(eventRecord *events.SNSEventRecord) *TransportMetadata {
+	return &TransportMetadata{
+		SentTime:        eventRecord.SNS.Timestamp,
+		SNSMessageID:    eventRecord.SNS.MessageID,
+		TopicARN:        eventRecord.SNS.TopicArn,
+		SubscriptionARN: eventRecord.EventSubscriptionArn,
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2018, Automatic Inc.
+ * All rights reserved.
+ *
+ * Author: Michael Ngo
+ */
+
+package hedwig
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQSTransportMetadata(t *testing.T) {
+	settings := &Settings{QueueName: "DEV-MYAPP"}
+	queueMessage := &sqs.Message{
+		MessageId: aws.String("123"),
+		Attributes: map[string]*string{
+			sqs.MessageSystemAttributeNameApproximateReceiveCount:          aws.String("3"),
+			sqs.MessageSystemAttributeNameApproximateFirstReceiveTimestamp: aws.String("1546300800500"),
+			sqs.MessageSystemAttributeNameSentTimestamp:                    aws.String("1546300800000"),
+		},
+	}
+
+	transport := sqsTransportMetadata(settings, queueMessage, nil)
+	assert.Equal(t, &TransportMetadata{
+		SQSMessageID:     "123",
+		ReceiveCount:     3,
+		FirstReceiveTime: time.Unix(1546300800, int64(500*time.Millisecond)),
+		SentTime:         time.Unix(1546300800, 0),
+		QueueName:        "DEV-MYAPP",
+	}, transport)
+}
+
+func TestSQSTransportMetadata_SNSEnvelope(t *testing.T) {
+	settings := &Settings{QueueName: "DEV-MYAPP"}
+	queueMessage := &sqs.Message{
+		MessageId: aws.String("123"),
+	}
+	envelope := &snsEnvelope{
+		MessageID: "456",
+		TopicArn:  "arn:aws:sns:us-east-1:686176732873:hedwig-dev-vehicle_created-v1",
+	}
+
+	transport := sqsTransportMetadata(settings, queueMessage, envelope)
+	assert.Equal(t, "123", transport.SQSMessageID)
+	assert.Equal(t, "456", transport.SNSMessageID)
+	assert.Equal(t, envelope.TopicArn, transport.TopicARN)
+	assert.True(t, transport.SentTime.IsZero())
+}
+
+func TestSNSTransportMetadata(t *testing.T) {
+	timestamp := time.Unix(1546300800, 0)
+	eventRecord := &events.SNSEventRecord{
+		EventSubscriptionArn: "arn:aws:sns:us-east-1:686176732873:hedwig-dev-vehicle_created-v1:abc",
+		SNS: events.SNSEntity{
+			MessageID: "456",
+			TopicArn:  "arn:aws:sns:us-east-1:686176732873:hedwig-dev-vehicle_created-v1",
+			Timestamp: timestamp,
+		},
+	}
+
+	transport := snsTransportMetadata(eventRecord)
+	assert.Equal(t, &TransportMetadata{
+		SentTime:        timestamp,
+		SNSMessageID:    "456",
+		TopicARN:        eventRecord.SNS.TopicArn,
+		SubscriptionARN: eventRecord.EventSubscriptionArn,
+	}, transport)
+}